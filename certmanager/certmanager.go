@@ -0,0 +1,365 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Management of X.509 certificates which can be replaced while the
+// server is running.
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var x509_cert_not_after = expvar.NewInt("x509-certificate-not-after")
+var x509_ca_not_after = expvar.NewInt("x509-ca-certificate-not-after")
+var x509_num_reloads = expvar.NewInt("x509-num-reloads")
+var x509_reload_errors = expvar.NewMap("x509-reload-errors")
+
+// Expiry dates of the certificates of all managers, so the gauge reports
+// the one which expires first.
+var not_after_mtx sync.Mutex
+var not_after = make(map[*CertificateManager]time.Time)
+
+// Keeps the currently valid certificate, key and CA certificate of a
+// service and replaces them whenever they are changed on disk.
+type CertificateManager struct {
+	certPath string
+	keyPath  string
+	caPath   string
+
+	mtx      sync.RWMutex
+	cert     *tls.Certificate
+	ca       *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// Create a new certificate manager for the X.509 certificate at
+// "certPath", the corresponding key at "keyPath" and the CA certificate
+// the peers are verified against at "caPath". If "caPath" is empty,
+// peers can't be verified. The files are loaded immediately; if any of
+// them are unusable, an error is returned.
+func NewCertificateManager(certPath, keyPath, caPath string) (
+	*CertificateManager, error) {
+	var ret = &CertificateManager{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+	}
+	var err error
+
+	err = ret.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Read the certificate, key and CA certificate from disk again. They are
+// only put into use if they have been loaded and validated successfully;
+// otherwise the previous set is kept and an error is returned.
+func (self *CertificateManager) Reload() error {
+	var cert tls.Certificate
+	var leaf *x509.Certificate
+	var ca *x509.CertPool
+	var ca_not_after time.Time
+	var mtimes map[string]time.Time
+	var certdata []byte
+	var now time.Time = time.Now()
+	var err error
+
+	// Record the modification times before reading, so a change while
+	// we're reading will be picked up by the next check.
+	mtimes = self.statFiles()
+
+	cert, err = tls.LoadX509KeyPair(self.certPath, self.keyPath)
+	if err != nil {
+		x509_reload_errors.Add(err.Error(), 1)
+		return errors.New("Unable to load X.509 key pair: " + err.Error())
+	}
+
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		x509_reload_errors.Add(err.Error(), 1)
+		return errors.New("Unable to parse " + self.certPath + ": " +
+			err.Error())
+	}
+	if now.Before(leaf.NotBefore) {
+		x509_reload_errors.Add("certificate-not-yet-valid", 1)
+		return errors.New(self.certPath + " is not valid before " +
+			leaf.NotBefore.String())
+	}
+	if now.After(leaf.NotAfter) {
+		x509_reload_errors.Add("certificate-expired", 1)
+		return errors.New(self.certPath + " has expired on " +
+			leaf.NotAfter.String())
+	}
+	cert.Leaf = leaf
+
+	if len(self.caPath) > 0 {
+		ca = x509.NewCertPool()
+		certdata, err = ioutil.ReadFile(self.caPath)
+		if err != nil {
+			x509_reload_errors.Add(err.Error(), 1)
+			return errors.New("Error reading " + self.caPath + ": " +
+				err.Error())
+		}
+		if !ca.AppendCertsFromPEM(certdata) {
+			x509_reload_errors.Add("ca-certificate-unparseable", 1)
+			return errors.New("Unable to load the X.509 certificates " +
+				"from " + self.caPath)
+		}
+		ca_not_after = earliestExpiry(certdata)
+	}
+
+	self.mtx.Lock()
+	self.cert = &cert
+	self.ca = ca
+	self.modTimes = mtimes
+	self.mtx.Unlock()
+
+	x509_num_reloads.Add(1)
+	recordExpiry(self, leaf.NotAfter)
+	if !ca_not_after.IsZero() {
+		x509_ca_not_after.Set(ca_not_after.Unix())
+	}
+	return nil
+}
+
+// Record that the certificate of "manager" expires at "expiry", and
+// export the earliest expiry date of all managers.
+func recordExpiry(manager *CertificateManager, expiry time.Time) {
+	var earliest, t time.Time
+
+	not_after_mtx.Lock()
+	defer not_after_mtx.Unlock()
+
+	not_after[manager] = expiry
+	for _, t = range not_after {
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	x509_cert_not_after.Set(earliest.Unix())
+}
+
+// Determine the expiry date of the first CA certificate in "pemdata"
+// to expire. Returns the zero time if nothing could be parsed.
+func earliestExpiry(pemdata []byte) time.Time {
+	var ret time.Time
+	var block *pem.Block
+
+	for {
+		var cert *x509.Certificate
+		var err error
+
+		block, pemdata = pem.Decode(pemdata)
+		if block == nil {
+			return ret
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if ret.IsZero() || cert.NotAfter.Before(ret) {
+			ret = cert.NotAfter
+		}
+	}
+}
+
+// Determine the current modification times of all managed files.
+func (self *CertificateManager) statFiles() map[string]time.Time {
+	var ret = make(map[string]time.Time)
+	var path string
+
+	for _, path = range []string{self.certPath, self.keyPath, self.caPath} {
+		var fi os.FileInfo
+		var err error
+
+		fi, err = os.Stat(path)
+		if err == nil {
+			ret[path] = fi.ModTime()
+		}
+	}
+
+	return ret
+}
+
+// Determine whether any of the managed files changed since they were
+// last loaded successfully.
+func (self *CertificateManager) filesChanged() bool {
+	var current map[string]time.Time = self.statFiles()
+	var path string
+	var mtime time.Time
+
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+
+	for path, mtime = range current {
+		if !mtime.Equal(self.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Invoke all functions in "handlers" whenever the process receives a
+// SIGHUP.
+func OnSignal(handlers ...func()) {
+	var c = make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		var f func()
+
+		for range c {
+			for _, f = range handlers {
+				f()
+			}
+		}
+	}()
+}
+
+// Reload the certificates whenever the process receives a SIGHUP.
+// Other parts of the program which want to be reloaded on SIGHUP as well
+// can be passed as "also"; they are invoked after the certificates.
+func (self *CertificateManager) ReloadOnSignal(also ...func()) {
+	OnSignal(append([]func(){self.reloadAndLog}, also...)...)
+}
+
+// Reload the certificates, logging any errors.
+func (self *CertificateManager) reloadAndLog() {
+	var err error
+
+	log.Print("Reloading X.509 certificates")
+	err = self.Reload()
+	if err != nil {
+		log.Print("Error reloading certificates, keeping the old ones: ",
+			err)
+	}
+}
+
+// Check the managed files for changes every "interval" and reload them
+// if they have been modified.
+func (self *CertificateManager) WatchFiles(interval time.Duration) {
+	go func() {
+		var err error
+
+		for range time.Tick(interval) {
+			if !self.filesChanged() {
+				continue
+			}
+
+			log.Print("Certificate files changed, reloading")
+			err = self.Reload()
+			if err != nil {
+				log.Print("Error reloading certificates, keeping the ",
+					"old ones: ", err)
+				// Don't try the same broken files over and over again.
+				self.mtx.Lock()
+				self.modTimes = self.statFiles()
+				self.mtx.Unlock()
+			}
+		}
+	}()
+}
+
+// Retrieve the currently active certificate of the service. Suitable
+// for use as tls.Config.GetCertificate.
+func (self *CertificateManager) GetCertificate(*tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+	return self.cert, nil
+}
+
+// Retrieve the currently active certificate of the service for
+// authenticating against servers. Suitable for use as
+// tls.Config.GetClientCertificate.
+func (self *CertificateManager) GetClientCertificate(
+	*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+	return self.cert, nil
+}
+
+// Retrieve the pool of currently active CA certificates.
+func (self *CertificateManager) GetCertPool() *x509.CertPool {
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+	return self.ca
+}
+
+// Build a TLS configuration for servers. Clients are authenticated
+// according to "auth" against the CA certificate active at the time
+// the connection is established.
+func (self *CertificateManager) ServerConfig(auth tls.ClientAuthType) (
+	config *tls.Config) {
+	config = new(tls.Config)
+	config.MinVersion = tls.VersionTLS12
+	config.ClientAuth = auth
+	config.GetCertificate = self.GetCertificate
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (
+		*tls.Config, error) {
+		var ret *tls.Config = config.Clone()
+		ret.GetConfigForClient = nil
+		ret.ClientCAs = self.GetCertPool()
+		return ret, nil
+	}
+
+	return
+}
+
+// Build a TLS configuration for clients, using the certificate and CA
+// certificate active at the time of the call.
+func (self *CertificateManager) ClientConfig() *tls.Config {
+	var config = new(tls.Config)
+
+	config.MinVersion = tls.VersionTLS12
+	config.GetClientCertificate = self.GetClientCertificate
+	config.RootCAs = self.GetCertPool()
+
+	return config
+}
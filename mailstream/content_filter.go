@@ -0,0 +1,436 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Counts the actions taken by the content filter.
+var content_filter_actions = expvar.NewMap("content-filter-actions")
+
+// Magic numbers of file types http.DetectContentType doesn't know about.
+var magicNumbers = []struct {
+	magic string
+	ctype string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+}
+
+// Content types of files which can be run directly.
+var executableTypes = map[string]bool{
+	"application/x-msdownload":  true,
+	"application/x-executable":  true,
+	"application/x-mach-binary": true,
+	"application/x-dosexec":     true,
+}
+
+// File name extensions of files which can be run directly.
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".com": true, ".scr": true, ".sys": true,
+	".cpl": true, ".ocx": true, ".pif": true, ".elf": true, ".bin": true,
+	".so": true, ".dylib": true, "": true,
+}
+
+// Severity of the content filter actions; the most severe action of all
+// matching rules is taken.
+var actionSeverity = map[mailpump.ContentFilterRule_Action]int{
+	mailpump.ContentFilterRule_STRIP:      1,
+	mailpump.ContentFilterRule_QUARANTINE: 2,
+	mailpump.ContentFilterRule_REJECT:     3,
+}
+
+// Part of a message which matched a rule of the content filter.
+type contentMatch struct {
+	part   *mailpump.MimePart
+	action mailpump.ContentFilterRule_Action
+	reason string
+}
+
+// Determine the content type of "body" from its contents.
+func sniffContentType(body []byte) string {
+	var ctype string
+	var i int
+
+	for i = range magicNumbers {
+		if bytes.HasPrefix(body, []byte(magicNumbers[i].magic)) {
+			return magicNumbers[i].ctype
+		}
+	}
+
+	ctype = http.DetectContentType(body)
+	return strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0])
+}
+
+// Determine the extension of the file name "name" the way the recipient's
+// system would, i.e. ignoring trailing dots and spaces.
+func fileExtension(name string) string {
+	name = strings.TrimRight(name, ". ")
+	name = name[strings.LastIndexAny(name, "/\\")+1:]
+	return strings.ToLower(path.Ext(name))
+}
+
+// Determine whether the file name "name" has any of the extensions
+// "exts", which may be given with or without the leading dot.
+func extensionMatches(name string, exts []string) bool {
+	var ext string = fileExtension(name)
+	var pattern string
+
+	if len(ext) == 0 {
+		return false
+	}
+	for _, pattern = range exts {
+		pattern = strings.ToLower(pattern)
+		if !strings.HasPrefix(pattern, ".") {
+			pattern = "." + pattern
+		}
+		if ext == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether "ctype" is matched by any of the "patterns". Patterns
+// ending in /* match all subtypes.
+func contentTypeMatches(ctype string, patterns []string) bool {
+	var pattern string
+
+	ctype = strings.ToLower(ctype)
+	for _, pattern = range patterns {
+		pattern = strings.ToLower(pattern)
+		if ctype == pattern {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") &&
+			strings.HasPrefix(ctype, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// List the names of the files in the zip archive "body". Only the central
+// directory is read, so nothing gets decompressed. At most "max" names are
+// returned.
+func listZip(body []byte, max int) ([]string, error) {
+	var archive *zip.Reader
+	var names []string
+	var file *zip.File
+	var err error
+
+	archive, err = zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file = range archive.File {
+		if len(names) >= max {
+			return names, errors.New("Too many files in archive")
+		}
+		names = append(names, file.Name)
+	}
+	return names, nil
+}
+
+// Describe "part" for use in verdicts.
+func describePart(part *mailpump.MimePart) string {
+	if len(part.GetFilename()) > 0 {
+		return "attachment " + strconv.Quote(part.GetFilename())
+	}
+	return "part of type " + strconv.Quote(part.GetContentType())
+}
+
+// Check whether the part with the file name "name", declared content type
+// "declared", detected content type "sniffed" and archive contents
+// "entries" matches "rule". Returns an explanation if it does.
+func ruleMatches(rule *mailpump.ContentFilterRule, name, declared,
+	sniffed string, entries []string) (string, bool) {
+	var entry string
+
+	if extensionMatches(name, rule.GetExtensions()) {
+		return "file name matches rule " + rule.GetName(), true
+	}
+	if contentTypeMatches(declared, rule.GetContentTypes()) {
+		return "declared type " + declared + " matches rule " +
+			rule.GetName(), true
+	}
+	if contentTypeMatches(sniffed, rule.GetContentTypes()) {
+		return "detected type " + sniffed + " matches rule " +
+			rule.GetName(), true
+	}
+	if !rule.GetMatchArchiveContents() {
+		return "", false
+	}
+	for _, entry = range entries {
+		if extensionMatches(entry, rule.GetExtensions()) {
+			return "archive contains " + strconv.Quote(entry) +
+				", matching rule " + rule.GetName(), true
+		}
+	}
+	return "", false
+}
+
+// Walk the MIME structure below "part" of the raw message "raw" and
+// collect the parts matching the filter settings in "config".
+func checkParts(config *mailpump.ContentFilterConfiguration, raw []byte,
+	part *mailpump.MimePart, matches []*contentMatch) []*contentMatch {
+	var rule *mailpump.ContentFilterRule
+	var child *mailpump.MimePart
+	var body []byte
+	var entries []string
+	var name, declared, sniffed, reason string
+	var ok bool
+	var err error
+
+	if len(part.Parts) > 0 {
+		for _, child = range part.Parts {
+			matches = checkParts(config, raw, child, matches)
+		}
+		return matches
+	}
+	if strings.HasPrefix(part.GetContentType(), "multipart/") {
+		return matches
+	}
+
+	// Decoding errors have already been recorded in the MIME structure;
+	// check whatever could be decoded.
+	body, _ = mailpump.DecodePartBody(raw, part)
+	name = part.GetFilename()
+	declared = strings.ToLower(part.GetContentType())
+	sniffed = sniffContentType(body)
+	if sniffed == "application/zip" {
+		entries, err = listZip(body, int(config.GetMaxArchiveEntries()))
+		if err != nil {
+			log.Print("Unable to inspect zip archive ", strconv.Quote(name),
+				": ", err)
+		}
+	}
+
+	for _, rule = range config.Rules {
+		if reason, ok = ruleMatches(rule, name, declared, sniffed,
+			entries); ok {
+			matches = append(matches, &contentMatch{
+				part:   part,
+				action: rule.GetAction(),
+				reason: describePart(part) + ": " + reason,
+			})
+		}
+	}
+
+	if config.GetRejectDisguisedExecutables() && executableTypes[sniffed] &&
+		((len(name) > 0 && !executableExtensions[fileExtension(name)]) ||
+			(declared != "application/octet-stream" &&
+				!executableTypes[declared])) {
+		matches = append(matches, &contentMatch{
+			part:   part,
+			action: mailpump.ContentFilterRule_REJECT,
+			reason: describePart(part) + ": executable disguised as " +
+				declared,
+		})
+	}
+
+	return matches
+}
+
+// Replace the "parts" of the raw message "raw" with a notice explaining
+// why they were removed. The parts must not overlap.
+func stripParts(raw []byte, parts []*contentMatch) []byte {
+	var ret []byte = raw
+	var newline string = "\n"
+	var match *contentMatch
+
+	if bytes.Contains(raw, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+
+	// Replace from the end so the offsets of the remaining parts stay
+	// valid.
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].part.GetOffset() > parts[j].part.GetOffset()
+	})
+	for _, match = range parts {
+		var start int64 = match.part.GetOffset()
+		var end int64 = start + match.part.GetLength()
+		var notice string = "Content-Type: text/plain; charset=utf-8" +
+			newline + "Content-Transfer-Encoding: 8bit" + newline +
+			"Content-Disposition: inline" + newline + newline +
+			"The " + describePart(match.part) +
+			" was removed by the content filter."
+
+		ret = append(append(append([]byte{}, ret[:start]...),
+			notice...), ret[end:]...)
+	}
+	return ret
+}
+
+// Keep a copy of "msg" in the quarantine directory of "config", along
+// with the envelope and the "reasons" for quarantining it.
+func quarantineMessage(config *mailpump.ContentFilterConfiguration,
+	msg *mailpump.MailMessage, reasons []string) (string, error) {
+	var f *os.File
+	var buf bytes.Buffer
+	var value string
+	var err error
+
+	if len(config.GetQuarantineDir()) == 0 {
+		return "", errors.New("No quarantine directory configured")
+	}
+
+	for _, value = range reasons {
+		buf.WriteString("X-Mailpump-Quarantine-Reason: " + value + "\r\n")
+	}
+	buf.WriteString("X-Mailpump-Peer: " + msg.GetSmtpPeer() + "\r\n")
+	buf.WriteString("X-Mailpump-Envelope-From: <" + msg.GetSmtpFrom() +
+		">\r\n")
+	for _, value = range msg.SmtpTo {
+		buf.WriteString("X-Mailpump-Envelope-To: <" + value + ">\r\n")
+	}
+	buf.Write(msg.RawBytes())
+
+	f, err = ioutil.TempFile(config.GetQuarantineDir(), "quarantine-*.eml")
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Run the content filter over "msg". Parts matching rules with the STRIP
+// action are removed from the message; for the other actions, "ret" is
+// filled in and true is returned, meaning that the message must not be
+// processed any further.
+func (self *MailSubmissionService) filterContent(msg *mailpump.MailMessage,
+	ret *mailpump.MailSubmissionResult) bool {
+	var config *mailpump.ContentFilterConfiguration
+	var matches, strip []*contentMatch
+	var match, decisive *contentMatch
+	var stripped = make(map[*mailpump.MimePart]bool)
+	var reasons []string
+	var hdrlen int
+	var file string
+	var err error
+
+	config = self.GetConfig().GetContentFilter()
+	if config == nil || msg.MimeStructure == nil {
+		return false
+	}
+
+	matches = checkParts(config, msg.RawBytes(), msg.MimeStructure, nil)
+	if len(matches) == 0 {
+		return false
+	}
+
+	for _, match = range matches {
+		var verdict *mailpump.QualityVerdict = mailpump.NewVerdict(
+			"ContentFilter", mailpump.QualityVerdict_SPAM, match.reason)
+		msg.Verdicts = append(msg.Verdicts, verdict)
+		ret.Verdicts = append(ret.Verdicts, verdict)
+		reasons = append(reasons, match.reason)
+
+		// A message consisting of a single part can't be stripped.
+		if match.action == mailpump.ContentFilterRule_STRIP &&
+			match.part == msg.MimeStructure {
+			match.action = mailpump.ContentFilterRule_REJECT
+		}
+		if match.action == mailpump.ContentFilterRule_STRIP &&
+			!stripped[match.part] {
+			stripped[match.part] = true
+			strip = append(strip, match)
+		}
+		if decisive == nil ||
+			actionSeverity[match.action] > actionSeverity[decisive.action] {
+			decisive = match
+		}
+	}
+
+	switch decisive.action {
+	case mailpump.ContentFilterRule_REJECT:
+		content_filter_actions.Add("reject", 1)
+		log.Print("Rejecting message from ", msg.GetSmtpFrom(), ": ",
+			strings.Join(reasons, "; "))
+		fillSmtpError(ret, smtpump.SMTP_TRANSACTION_FAILED,
+			"Message refused by content filter: "+decisive.reason)
+		return true
+	case mailpump.ContentFilterRule_QUARANTINE:
+		file, err = quarantineMessage(config, msg, reasons)
+		if err != nil {
+			content_filter_actions.Add("quarantine-error", 1)
+			log.Print("Unable to quarantine message from ",
+				msg.GetSmtpFrom(), ": ", err)
+			fillSmtpError(ret, smtpump.SMTP_LOCALERR,
+				"Error processing message")
+			return true
+		}
+		content_filter_actions.Add("quarantine", 1)
+		log.Print("Quarantined message from ", msg.GetSmtpFrom(), " as ",
+			file, ": ", strings.Join(reasons, "; "))
+		fillSmtpError(ret, smtpump.SMTP_COMPLETED, "Ok.")
+		return true
+	}
+
+	content_filter_actions.Add("strip", 1)
+	msg.RawMessage = stripParts(msg.RawBytes(), strip)
+	msg.Body = nil
+	_, hdrlen = mailpump.SplitHeaders(msg.RawMessage)
+	msg.BodyOffset = new(int64)
+	*msg.BodyOffset = int64(hdrlen)
+	msg.MimeStructure = mailpump.ParseMimeStructure(msg.RawMessage,
+		mailpump.DefaultMimeLimits)
+	return false
+}
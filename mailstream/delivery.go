@@ -0,0 +1,277 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/metrics"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Counts the outcomes of deliveries per recipient, and the problems
+// encountered talking to the destinations.
+var delivery_results = expvar.NewMap("delivery-results")
+var delivery_errors = expvar.NewMap("delivery-errors")
+
+// Time spent delivering messages to a single destination.
+var delivery_duration = metrics.NewHistogramVec(
+	"delivery_duration_seconds",
+	"Time spent delivering messages, by delivery method.", "method",
+	metrics.DefaultBuckets)
+
+// Recipients of a message which are delivered to the same destination in
+// the same way.
+type deliveryRoute struct {
+	method mailpump.DomainDeliveryConfiguration_DeliveryMethod
+
+	// Server to deliver to. If empty, mail goes to the MX hosts of
+	// "domain".
+	destination string
+	domain      string
+
+	// Only deliver over verified TLS connections.
+	requireTls bool
+
+	// Directory holding the maildirs of the users of "domain", and
+	// whether missing maildirs are created.
+	maildirRoot   string
+	maildirCreate bool
+
+	recipients []string
+}
+
+// Create a status of "code" and "text" for the recipient "rcpt",
+// reported by "host" if it's not empty.
+func newRecipientStatus(rcpt string, code int32, text, host string) (
+	ret *mailpump.RecipientStatus) {
+	ret = new(mailpump.RecipientStatus)
+	ret.Recipient = new(string)
+	*ret.Recipient = rcpt
+	ret.Code = new(int32)
+	*ret.Code = code
+	ret.Text = new(string)
+	*ret.Text = text
+	if len(host) > 0 {
+		ret.RemoteHost = new(string)
+		*ret.RemoteHost = host
+	}
+	return
+}
+
+// Report the same "code" and "text" for all "recipients".
+func failAll(recipients []string, code int32, text, host string) (
+	ret []*mailpump.RecipientStatus) {
+	var rcpt string
+
+	for _, rcpt = range recipients {
+		ret = append(ret, newRecipientStatus(rcpt, code, text, host))
+	}
+	return
+}
+
+// Name of the host (or domain, for MX based delivery) "route" delivers
+// to. Concurrent deliveries are limited by this name.
+func (self *deliveryRoute) target() string {
+	if len(self.destination) > 0 {
+		return strings.ToLower(self.destination)
+	}
+	return self.domain
+}
+
+// Determine how to deliver "msg" to each of "recipients", which have to
+// be expanded already. Mail to domains which aren't configured is only
+// relayed for authenticated users and delivery status notifications.
+// Recipients which can't be delivered to at all are returned as failed
+// right away.
+func (self *MailSubmissionService) routeMessage(msg *mailpump.MailMessage,
+	recipients []string) (
+	routes []*deliveryRoute, failed []*mailpump.RecipientStatus) {
+	var table *recipientTable = self.getRecipients()
+	var byKey = make(map[string]*deliveryRoute)
+	var rcpt string
+
+	for _, rcpt = range recipients {
+		var route = new(deliveryRoute)
+		var dr *domainRecipients
+		var key string
+		var err error
+
+		_, route.domain, err = splitAddress(rcpt)
+		if err != nil {
+			failed = append(failed, newRecipientStatus(rcpt,
+				smtpump.SMTP_PARAMETER_ERROR, err.Error(), ""))
+			continue
+		}
+
+		dr = table.domains[route.domain]
+		if dr != nil {
+			route.method = dr.config.GetDeliveryMethod()
+			route.destination = dr.config.GetDestinationServer()
+			route.requireTls = dr.config.GetRequireTls()
+			route.maildirRoot = dr.config.GetMaildirRoot()
+			route.maildirCreate = dr.config.GetMaildirCreate()
+		} else if len(msg.GetAuthenticatedUser()) > 0 ||
+			msg.GetIsNotification() {
+			route.method = mailpump.DomainDeliveryConfiguration_SMTP
+		} else {
+			failed = append(failed, newRecipientStatus(rcpt,
+				smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl,
+				"Relaying denied.", ""))
+			continue
+		}
+
+		key = route.method.String() + " " + route.target() + " " +
+			strconv.FormatBool(route.requireTls)
+		if byKey[key] == nil {
+			byKey[key] = route
+			routes = append(routes, route)
+		}
+		byKey[key].recipients = append(byKey[key].recipients, rcpt)
+	}
+	return
+}
+
+// Deliver "msg" to the recipients of "route" and report the outcome
+// for each of them.
+func (self *MailSubmissionService) deliverRoute(route *deliveryRoute,
+	msg *mailpump.MailMessage) []*mailpump.RecipientStatus {
+	var method string = strings.ToLower(route.method.String())
+	var start time.Time = time.Now()
+
+	defer delivery_duration.ObserveSinceWithLabel(method, start)
+
+	switch route.method {
+	case mailpump.DomainDeliveryConfiguration_SMTP:
+		return self.deliverSMTP(route, msg)
+	case mailpump.DomainDeliveryConfiguration_MAILDIR:
+		return deliverMaildir(route, msg)
+	case mailpump.DomainDeliveryConfiguration_LMTP:
+		return self.deliverLMTP(route, msg)
+	}
+
+	log.Print("Unsupported delivery method ", route.method, " for ",
+		route.domain)
+	return failAll(route.recipients, smtpump.SMTP_LOCALERR,
+		"Unsupported delivery method.", "")
+}
+
+// Combine the outcomes of the deliveries to all recipients into a single
+// SMTP code and text. Once the message has been delivered to anyone, it
+// counts as accepted, since retrying would duplicate it.
+func summarizeDelivery(statuses []*mailpump.RecipientStatus) (
+	int32, string) {
+	var status, temporary, permanent *mailpump.RecipientStatus
+	var delivered int
+
+	for _, status = range statuses {
+		switch {
+		case status.GetCode() < 400:
+			delivered++
+		case status.GetCode() < 500 && temporary == nil:
+			temporary = status
+		case status.GetCode() >= 500 && permanent == nil:
+			permanent = status
+		}
+	}
+
+	if delivered == len(statuses) {
+		return smtpump.SMTP_COMPLETED, "Ok, delivered."
+	}
+	if delivered > 0 {
+		return smtpump.SMTP_COMPLETED, "Ok, delivered to " +
+			strconv.Itoa(delivered) + " of " + strconv.Itoa(len(statuses)) +
+			" recipients."
+	}
+	if temporary != nil {
+		return temporary.GetCode(), temporary.GetText()
+	}
+	return permanent.GetCode(), permanent.GetText()
+}
+
+// Count the outcomes of delivering "msg" and log the failures.
+func recordDelivery(msg *mailpump.MailMessage,
+	statuses []*mailpump.RecipientStatus) {
+	var status *mailpump.RecipientStatus
+
+	for _, status = range statuses {
+		switch {
+		case status.GetCode() < 400:
+			delivery_results.Add("delivered", 1)
+		case status.GetCode() < 500:
+			delivery_results.Add("deferred", 1)
+		default:
+			delivery_results.Add("failed", 1)
+		}
+		if status.GetCode() >= 400 {
+			log.Print("Delivery of ", msg.GetMsgidHdr(), " to ",
+				status.GetRecipient(), " failed: ", status.GetText())
+		}
+	}
+}
+
+// Deliver "msg" to all of its recipients and put the outcome into "ret".
+func (self *MailSubmissionService) deliver(msg *mailpump.MailMessage,
+	ret *mailpump.MailSubmissionResult) {
+	var routes []*deliveryRoute
+	var route *deliveryRoute
+	var statuses []*mailpump.RecipientStatus
+	var code int32
+	var text string
+
+	routes, statuses = self.routeMessage(msg,
+		self.getRecipients().expandEnvelope(msg))
+	for _, route = range routes {
+		statuses = append(statuses, self.deliverRoute(route, msg)...)
+	}
+
+	if len(statuses) == 0 {
+		fillSmtpError(ret, smtpump.SMTP_BAD_SEQUENCE, "No recipients.")
+		return
+	}
+	recordDelivery(msg, statuses)
+
+	ret.RecipientStatus = statuses
+	code, text = summarizeDelivery(statuses)
+	fillSmtpError(ret, code, text)
+
+	// Without a queue, there are no retries; the sender has to learn
+	// about the failed recipients if the message was accepted for others.
+	if code < 400 {
+		self.notifySender(msg, statuses, time.Now(), time.Time{})
+	}
+}
@@ -0,0 +1,390 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Counts the delivery status notifications generated, by action, and
+// those which weren't sent, by reason.
+var dsn_generated = expvar.NewMap("dsn-generated")
+var dsn_suppressed = expvar.NewMap("dsn-suppressed")
+var dsn_errors = expvar.NewInt("dsn-errors")
+
+// Actions reported in delivery status notifications (RFC 3464, section
+// 2.3.3).
+const (
+	DSN_ACTION_FAILED    = "failed"
+	DSN_ACTION_DELAYED   = "delayed"
+	DSN_ACTION_DELIVERED = "delivered"
+)
+
+// Enhanced status code (RFC 3463) at the start of an SMTP reply.
+var enhanced_status_re *regexp.Regexp = regexp.MustCompile(
+	"^([245])\\.[0-9]{1,3}\\.[0-9]{1,3}\\b")
+
+// Retrieve the DSN parameters given for "rcpt" in "msg", if any.
+func dsnParameters(msg *mailpump.MailMessage,
+	rcpt string) *mailpump.DsnRecipientParameters {
+	var dsn *mailpump.DsnRecipientParameters
+
+	for _, dsn = range msg.DsnRecipients {
+		if strings.EqualFold(dsn.GetRecipient(), rcpt) {
+			return dsn
+		}
+	}
+	return nil
+}
+
+// Determine whether the sender of "msg" wants to be notified when
+// "action" is taken for "rcpt". Without a NOTIFY parameter, senders are
+// told about failures and delays (RFC 3461, section 4.1).
+func wantsNotification(msg *mailpump.MailMessage, rcpt,
+	action string) bool {
+	var notify = dsnParameters(msg, rcpt).GetNotify()
+	var cond mailpump.DsnRecipientParameters_Notify
+
+	if len(notify) == 0 {
+		return action != DSN_ACTION_DELIVERED
+	}
+
+	for _, cond = range notify {
+		switch {
+		case cond == mailpump.DsnRecipientParameters_SUCCESS &&
+			action == DSN_ACTION_DELIVERED:
+			return true
+		case cond == mailpump.DsnRecipientParameters_FAILURE &&
+			action == DSN_ACTION_FAILED:
+			return true
+		case cond == mailpump.DsnRecipientParameters_DELAY &&
+			action == DSN_ACTION_DELAYED:
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieve the reply of the remote host contained in "status", if any.
+func remoteReply(status *mailpump.RecipientStatus) (string, bool) {
+	var prefix string = status.GetRemoteHost() + " said: "
+
+	if len(status.GetRemoteHost()) == 0 ||
+		!strings.HasPrefix(status.GetText(), prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(status.GetText(), prefix), true
+}
+
+// Determine the enhanced status code (RFC 3463) describing "status".
+// Codes given by the remote host are passed on if they fit the SMTP code.
+func enhancedStatus(status *mailpump.RecipientStatus) string {
+	var class string = strconv.Itoa(int(status.GetCode()) / 100)
+	var reply string
+	var match []string
+	var ok bool
+
+	if reply, ok = remoteReply(status); ok {
+		match = enhanced_status_re.FindStringSubmatch(reply)
+		if match != nil && match[1] == class {
+			return match[0]
+		}
+	}
+	return class + ".0.0"
+}
+
+// Format the original recipient "orcpt", given as addr-type;address, for
+// the Original-Recipient field.
+func formatOriginalRecipient(orcpt string) string {
+	var parts []string = strings.SplitN(orcpt, ";", 2)
+
+	if len(parts) < 2 {
+		return "rfc822;" + smtpump.EncodeXtext(orcpt)
+	}
+	return parts[0] + ";" + smtpump.EncodeXtext(parts[1])
+}
+
+// Generate a random string for use in message IDs and MIME boundaries.
+func randomToken() string {
+	var buf [16]byte
+
+	if _, err := rand.Read(buf[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Compose a delivery status notification (RFC 3464) identified by
+// "msgid", telling the sender of "msg" that "action" was taken for the
+// recipients in "statuses". "arrival" is the time the message was
+// received; "retryUntil" the time delivery to delayed recipients will be
+// given up.
+func (self *MailSubmissionService) composeDsn(msg *mailpump.MailMessage,
+	msgid, action string, statuses []*mailpump.RecipientStatus,
+	arrival, retryUntil time.Time) []byte {
+	var helo string = self.heloName()
+	var boundary string = randomToken()
+	var raw []byte = msg.RawBytes()
+	var status *mailpump.RecipientStatus
+	var buf bytes.Buffer
+	var subject, intro string
+
+	switch action {
+	case DSN_ACTION_FAILED:
+		subject = "Undelivered Mail Returned to Sender"
+		intro = "Your message could not be delivered to the following " +
+			"recipients."
+	case DSN_ACTION_DELAYED:
+		subject = "Delayed Mail (still being retried)"
+		intro = "Your message has not been delivered to the following " +
+			"recipients yet.\r\nDelivery will be retried until " +
+			retryUntil.Format(time.RFC1123Z) + "."
+	default:
+		subject = "Successful Mail Delivery Report"
+		intro = "Your message has been delivered to the following " +
+			"recipients."
+	}
+
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n",
+		helo)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", msg.GetSmtpFrom())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", msgid)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; "+
+		"report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n",
+		boundary)
+	fmt.Fprintf(&buf, "This is a MIME-encapsulated message.\r\n\r\n")
+
+	// Explanation for humans.
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "This is the mail system at %s.\r\n\r\n%s\r\n\r\n",
+		helo, intro)
+	for _, status = range statuses {
+		fmt.Fprintf(&buf, "<%s>: %s\r\n", status.GetRecipient(),
+			status.GetText())
+	}
+	fmt.Fprintf(&buf, "\r\n")
+
+	// The same for machines.
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", helo)
+	if len(msg.GetDsnEnvid()) > 0 {
+		fmt.Fprintf(&buf, "Original-Envelope-Id: %s\r\n",
+			smtpump.EncodeXtext(msg.GetDsnEnvid()))
+	}
+	fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", arrival.Format(time.RFC1123Z))
+	for _, status = range statuses {
+		var dsn = dsnParameters(msg, status.GetRecipient())
+		var reply string
+		var ok bool
+
+		fmt.Fprintf(&buf, "\r\n")
+		if len(dsn.GetOriginalRecipient()) > 0 {
+			fmt.Fprintf(&buf, "Original-Recipient: %s\r\n",
+				formatOriginalRecipient(dsn.GetOriginalRecipient()))
+		}
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n",
+			status.GetRecipient())
+		fmt.Fprintf(&buf, "Action: %s\r\n", action)
+		fmt.Fprintf(&buf, "Status: %s\r\n", enhancedStatus(status))
+		if len(status.GetRemoteHost()) > 0 {
+			fmt.Fprintf(&buf, "Remote-MTA: dns; %s\r\n",
+				status.GetRemoteHost())
+		}
+		if reply, ok = remoteReply(status); ok {
+			fmt.Fprintf(&buf, "Diagnostic-Code: smtp; %d %s\r\n",
+				status.GetCode(), reply)
+		}
+		if action == DSN_ACTION_DELAYED {
+			fmt.Fprintf(&buf, "Will-Retry-Until: %s\r\n",
+				retryUntil.Format(time.RFC1123Z))
+		}
+	}
+	fmt.Fprintf(&buf, "\r\n")
+
+	// The message itself, or only its headers if the sender asked for
+	// that. Successes and delays don't need more than the headers.
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	if action == DSN_ACTION_FAILED &&
+		msg.GetDsnRet() != mailpump.MailMessage_HDRS {
+		fmt.Fprintf(&buf, "Content-Type: message/rfc822\r\n\r\n")
+	} else {
+		fmt.Fprintf(&buf, "Content-Type: text/rfc822-headers\r\n\r\n")
+		if msg.BodyOffset != nil && msg.GetBodyOffset() <= int64(len(raw)) {
+			raw = raw[:msg.GetBodyOffset()]
+		}
+	}
+	buf.Write(raw)
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		fmt.Fprintf(&buf, "\r\n")
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+// Send a delivery status notification about "action" having been taken
+// for the recipients in "statuses" to the sender of "msg". It's
+// delivered through the queue, if there is one, like any other mail.
+func (self *MailSubmissionService) sendDsn(msg *mailpump.MailMessage,
+	action string, statuses []*mailpump.RecipientStatus,
+	arrival, retryUntil time.Time) {
+	var dsn = new(mailpump.MailMessage)
+	var result mailpump.MailSubmissionResult
+	var helo string = self.heloName()
+	var msgid string = "<" + randomToken() + "@" + helo + ">"
+	var from string = "MAILER-DAEMON@" + helo
+	var peer, sender string
+	var notification bool = true
+	var offset int
+	var err error
+
+	dsn.RawMessage = self.composeDsn(msg, msgid, action, statuses,
+		arrival, retryUntil)
+	dsn.Headers, offset = mailpump.SplitHeaders(dsn.RawMessage)
+	dsn.BodyOffset = new(int64)
+	*dsn.BodyOffset = int64(offset)
+	dsn.MimeStructure = mailpump.ParseMimeStructure(dsn.RawMessage,
+		mailpump.DefaultMimeLimits)
+
+	// Notifications are sent from the null sender, so they never cause
+	// further notifications.
+	dsn.SmtpPeer = &peer
+	dsn.SmtpHelo = &helo
+	dsn.SmtpFrom = &sender
+	dsn.SmtpTo = []string{msg.GetSmtpFrom()}
+	dsn.FromHdr = &from
+	dsn.ToHdr = []string{msg.GetSmtpFrom()}
+	dsn.MsgidHdr = &msgid
+	dsn.IsNotification = &notification
+
+	dsn_generated.Add(action, 1)
+	if self.queue != nil {
+		self.enqueue(dsn, &result)
+	} else {
+		self.deliver(dsn, &result)
+	}
+	if result.GetErrorCode() >= 400 {
+		err = fmt.Errorf("%d %s", result.GetErrorCode(),
+			result.GetErrorText())
+	}
+	if err != nil {
+		log.Print("Unable to send ", action, " notification about ",
+			msg.GetMsgidHdr(), " to ", msg.GetSmtpFrom(), ": ", err)
+		dsn_errors.Add(1)
+	}
+}
+
+// Tell the sender of "msg" about the outcome of delivering it to the
+// recipients in "statuses", as far as the sender asked for it. Temporary
+// failures are reported as delays if "retryUntil" is set, and as
+// failures otherwise. "arrival" is the time the message was received.
+func (self *MailSubmissionService) notifySender(msg *mailpump.MailMessage,
+	statuses []*mailpump.RecipientStatus, arrival, retryUntil time.Time) {
+	var byAction = make(map[string][]*mailpump.RecipientStatus)
+	var status *mailpump.RecipientStatus
+	var action string
+
+	for _, status = range statuses {
+		switch {
+		case status.GetCode() < 400:
+			action = DSN_ACTION_DELIVERED
+		case status.GetCode() < 500 && !retryUntil.IsZero():
+			action = DSN_ACTION_DELAYED
+		default:
+			action = DSN_ACTION_FAILED
+		}
+
+		if !wantsNotification(msg, status.GetRecipient(), action) {
+			continue
+		}
+		byAction[action] = append(byAction[action], status)
+	}
+
+	for _, action = range []string{DSN_ACTION_FAILED, DSN_ACTION_DELAYED,
+		DSN_ACTION_DELIVERED} {
+		if len(byAction[action]) == 0 {
+			continue
+		}
+		if len(msg.GetSmtpFrom()) == 0 {
+			// Never notify the null sender (RFC 5321, section 4.5.5).
+			dsn_suppressed.Add("null-sender", 1)
+			continue
+		}
+		self.sendDsn(msg, action, byAction[action], arrival, retryUntil)
+	}
+}
+
+// Return "msg", which the client was already told had been accepted, to
+// its sender if it was rejected with the outcome "ret". Since the client
+// has nothing left to do with the message then, "ret" is turned into a
+// success. Temporary failures are only returned on the final attempt;
+// until then, the client keeps retrying.
+func (self *MailSubmissionService) returnToSender(msg *mailpump.MailMessage,
+	ret *mailpump.MailSubmissionResult) {
+	var statuses []*mailpump.RecipientStatus
+	var arrival time.Time = time.Now()
+
+	if !msg.GetAlreadyAccepted() || ret.GetErrorCode() < 400 ||
+		(ret.GetErrorCode() < 500 && !msg.GetFinalAttempt()) {
+		return
+	}
+	if msg.AcceptedAt != nil {
+		arrival = time.Unix(msg.GetAcceptedAt(), 0)
+	}
+
+	statuses = ret.RecipientStatus
+	if len(statuses) == 0 {
+		statuses = failAll(self.getRecipients().expandEnvelope(msg),
+			ret.GetErrorCode(), ret.GetErrorText(), "")
+	}
+	self.notifySender(msg, statuses, arrival, time.Time{})
+	fillSmtpError(ret, smtpump.SMTP_COMPLETED,
+		"Ok, returned to the sender: "+ret.GetErrorText())
+}
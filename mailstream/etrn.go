@@ -0,0 +1,181 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Counts the responses to ETRN requests.
+var etrn_requests = expvar.NewMap("etrn-requests")
+
+// Queue of mail waiting to be delivered to other hosts.
+type deliveryQueue interface {
+	// Put "msg" into the queue, to be delivered to the expanded
+	// "recipients". Returns an ID identifying the message in the queue.
+	Enqueue(msg *mailpump.MailMessage, recipients []string) (string, error)
+
+	// Retry delivery of all queued mail for the domain "domain" right
+	// away. Returns the number of messages affected, or a negative
+	// number if it isn't known.
+	Flush(domain string) (int, error)
+}
+
+// Determine which of the configured domains are addressed by the ETRN
+// argument "node" (RFC 1985, section 3): either the domain itself, all
+// domains under @domain, or the queue #queue, which is named after the
+// domain it holds mail for.
+func (self *MailSubmissionService) etrnDomains(node string) []string {
+	var ret []string
+	var dc *mailpump.DomainDeliveryConfiguration
+
+	node = strings.ToLower(strings.TrimSuffix(node, "."))
+	for _, dc = range self.GetConfig().DomainConfigs {
+		var domain string = strings.ToLower(dc.GetDomainName())
+
+		switch {
+		case strings.HasPrefix(node, "@"):
+			if domain == node[1:] ||
+				strings.HasSuffix(domain, "."+node[1:]) {
+				ret = append(ret, domain)
+			}
+		case strings.HasPrefix(node, "#"):
+			if domain == node[1:] {
+				ret = append(ret, domain)
+			}
+		default:
+			if domain == node {
+				ret = append(ret, domain)
+			}
+		}
+	}
+	return ret
+}
+
+// Determine whether the peer at "ip" may request delivery for "domain".
+func (self *MailSubmissionService) etrnAllowed(domain string,
+	ip net.IP) bool {
+	var dc *mailpump.DomainDeliveryConfiguration
+
+	for _, dc = range self.GetConfig().DomainConfigs {
+		if strings.ToLower(dc.GetDomainName()) == domain {
+			return ip != nil && ipInNetworks(ip, dc.GetEtrnNetworks())
+		}
+	}
+	return false
+}
+
+// Start delivering the mail queued for the node in "req", as requested
+// by the peer with ETRN.
+func (self *MailSubmissionService) StartDeliveryRun(
+	req mailpump.EtrnRequest, ret *mailpump.MailSubmissionResult) error {
+	var node string = req.GetNode()
+	var ip net.IP = net.ParseIP(req.GetSmtpPeer())
+	var domains []string
+	var domain string
+	var code int32
+	var text string
+	var total int
+	var unknown bool
+
+	defer func() {
+		etrn_requests.Add(strconv.Itoa(int(code)), 1)
+		ret.ErrorCode = &code
+		ret.ErrorText = &text
+	}()
+
+	domains = self.etrnDomains(node)
+	if len(domains) == 0 {
+		code = smtpump.SMTP_ETRN_NOT_ALLOWED
+		text = "Node " + node + " not allowed: no mail is queued here " +
+			"for it"
+		return nil
+	}
+
+	// Authenticated users are trusted to request delivery for any domain;
+	// this only causes delivery to be attempted earlier.
+	for _, domain = range domains {
+		if len(req.GetAuthenticatedUser()) == 0 &&
+			!self.etrnAllowed(domain, ip) {
+			code = smtpump.SMTP_ETRN_NOT_ALLOWED
+			text = "Node " + node + " not allowed: access denied for " +
+				req.GetSmtpPeer()
+			return nil
+		}
+	}
+
+	for _, domain = range domains {
+		var num int
+		var err error
+
+		if self.queue == nil {
+			// Nothing is ever queued without a delivery queue.
+			continue
+		}
+
+		num, err = self.queue.Flush(domain)
+		if err != nil {
+			log.Print("Error flushing queue for ", domain, ": ", err)
+			code = smtpump.SMTP_ETRN_UNABLE_TO_QUEUE
+			text = "Unable to queue messages for node " + node
+			return nil
+		}
+		if num < 0 {
+			unknown = true
+		} else {
+			total += num
+		}
+	}
+
+	if strings.HasPrefix(node, "#") {
+		code = smtpump.SMTP_ETRN_STARTED
+		text = "OK, queuing for node " + node + " started"
+	} else if unknown {
+		code = smtpump.SMTP_ETRN_PENDING_STARTED
+		text = "OK, pending messages for node " + node + " started"
+	} else if total == 0 {
+		code = smtpump.SMTP_ETRN_NO_MESSAGES
+		text = "OK, no messages waiting for node " + node
+	} else {
+		code = smtpump.SMTP_ETRN_MESSAGES_STARTED
+		text = "OK, " + strconv.Itoa(total) +
+			" pending messages for node " + node + " started"
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+var lmtp_connections_opened = expvar.NewInt("lmtp-connections-opened")
+var lmtp_connections_reused = expvar.NewInt("lmtp-connections-reused")
+var lmtp_errors = expvar.NewMap("lmtp-errors")
+
+// Time an unused LMTP connection is kept open for further deliveries.
+const lmtpIdleTimeout = 30 * time.Second
+
+// Maximum number of unused LMTP connections kept open per destination.
+const lmtpMaxIdle = 4
+
+// Connection to an LMTP server.
+type lmtpConn struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	extensions map[string]string
+	lastUsed   time.Time
+}
+
+// Unused LMTP connections which can be reused, by destination.
+type lmtpPool struct {
+	idle map[string][]*lmtpConn
+	mtx  sync.Mutex
+}
+
+func newLmtpPool() *lmtpPool {
+	return &lmtpPool{
+		idle: make(map[string][]*lmtpConn),
+	}
+}
+
+// Determine the network and address to connect to for the LMTP
+// destination "destination".
+func lmtpAddress(destination string) (network, address string) {
+	if strings.HasPrefix(destination, "unix:") {
+		return "unix", strings.TrimPrefix(destination, "unix:")
+	}
+	if strings.HasPrefix(destination, "/") {
+		return "unix", destination
+	}
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		return "tcp", net.JoinHostPort(destination, "24")
+	}
+	return "tcp", destination
+}
+
+// Describe the reply "text" of the LMTP server "destination".
+func lmtpReply(destination, text string) string {
+	// Replies spanning several lines are joined by line breaks.
+	return destination + " said: " + strings.Replace(text, "\n", " ", -1)
+}
+
+// Send the command given by "format" and "args" and read the reply,
+// which is expected to have the code (or class of codes) "expect".
+func (self *lmtpConn) cmd(expect int, format string, args ...interface{}) (
+	int, string, error) {
+	if err := self.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return self.text.ReadResponse(expect)
+}
+
+// Introduce ourselves as "name" and record the extensions the server
+// supports.
+func (self *lmtpConn) hello(name string) error {
+	var text, line string
+	var err error
+
+	if _, text, err = self.cmd(250, "LHLO %s", name); err != nil {
+		return err
+	}
+
+	self.extensions = make(map[string]string)
+	for _, line = range strings.Split(text, "\n")[1:] {
+		var fields []string = strings.SplitN(line, " ", 2)
+
+		if len(fields) > 1 {
+			self.extensions[strings.ToUpper(fields[0])] = fields[1]
+		} else {
+			self.extensions[strings.ToUpper(fields[0])] = ""
+		}
+	}
+	return nil
+}
+
+// End the session with the server politely.
+func (self *lmtpConn) quit() {
+	self.conn.SetDeadline(time.Now().Add(time.Second))
+	self.cmd(221, "QUIT")
+	self.text.Close()
+}
+
+// Transmit "msg" to "recipients" over the connection to "destination".
+// A status is returned for each of the recipients; the error is set if
+// the connection can't be used any further.
+func (self *lmtpConn) send(destination string, msg *mailpump.MailMessage,
+	recipients []string) (statuses []*mailpump.RecipientStatus, err error) {
+	var pending []string = recipients
+	var accepted []string
+	var tperr *textproto.Error
+	var format string = "MAIL FROM:<%s>"
+	var w io.WriteCloser
+	var rcpt, text string
+	var code int
+	var ok bool
+
+	// Recipients whose fate is unknown may have to be retried.
+	defer func() {
+		if err != nil {
+			statuses = append(statuses, failAll(pending,
+				smtpump.SMTP_LOCALERR, "Error talking to "+destination+
+					": "+err.Error(), destination)...)
+		}
+	}()
+
+	if _, ok = self.extensions["8BITMIME"]; ok {
+		format += " BODY=8BITMIME"
+	}
+	code, text, err = self.cmd(2, format, msg.GetSmtpFrom())
+	if tperr, ok = err.(*textproto.Error); ok {
+		statuses = failAll(recipients, int32(code),
+			lmtpReply(destination, tperr.Msg), destination)
+		pending = nil
+		_, _, err = self.cmd(250, "RSET")
+		return
+	} else if err != nil {
+		return
+	}
+
+	for _, rcpt = range recipients {
+		code, text, err = self.cmd(2, "RCPT TO:<%s>", rcpt)
+		if tperr, ok = err.(*textproto.Error); ok {
+			// Rejections don't affect the connection.
+			statuses = append(statuses, newRecipientStatus(rcpt,
+				int32(code), lmtpReply(destination, tperr.Msg),
+				destination))
+			err = nil
+		} else if err != nil {
+			pending = append(accepted, pending[len(statuses)+
+				len(accepted):]...)
+			return
+		} else {
+			accepted = append(accepted, rcpt)
+		}
+	}
+
+	pending = accepted
+	if len(accepted) == 0 {
+		_, _, err = self.cmd(250, "RSET")
+		return
+	}
+
+	code, text, err = self.cmd(354, "DATA")
+	if tperr, ok = err.(*textproto.Error); ok {
+		statuses = append(statuses, failAll(accepted, int32(code),
+			lmtpReply(destination, tperr.Msg), destination)...)
+		pending = nil
+		_, _, err = self.cmd(250, "RSET")
+		return
+	} else if err != nil {
+		return
+	}
+
+	w = self.text.DotWriter()
+	if _, err = w.Write(msg.RawBytes()); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return
+	}
+
+	// Unlike SMTP, there is one reply for each accepted recipient.
+	for _, rcpt = range accepted {
+		code, text, err = self.text.ReadResponse(2)
+		if tperr, ok = err.(*textproto.Error); ok {
+			statuses = append(statuses, newRecipientStatus(rcpt,
+				int32(code), lmtpReply(destination, tperr.Msg),
+				destination))
+			err = nil
+		} else if err != nil {
+			return
+		} else {
+			statuses = append(statuses, newRecipientStatus(rcpt,
+				int32(code), lmtpReply(destination, text), destination))
+		}
+		pending = pending[1:]
+	}
+	return
+}
+
+// Retrieve an unused connection to "destination" which still works, if
+// there is one.
+func (self *lmtpPool) get(destination string) *lmtpConn {
+	for {
+		var conns []*lmtpConn
+		var conn *lmtpConn
+		var err error
+
+		self.mtx.Lock()
+		conns = self.idle[destination]
+		if len(conns) == 0 {
+			self.mtx.Unlock()
+			return nil
+		}
+		conn = conns[len(conns)-1]
+		self.idle[destination] = conns[:len(conns)-1]
+		self.mtx.Unlock()
+
+		if time.Now().Sub(conn.lastUsed) > lmtpIdleTimeout {
+			conn.quit()
+			continue
+		}
+
+		// The server may have closed the connection in the meantime.
+		conn.conn.SetDeadline(time.Now().Add(lmtpIdleTimeout))
+		if _, _, err = conn.cmd(250, "RSET"); err != nil {
+			conn.text.Close()
+			continue
+		}
+		lmtp_connections_reused.Add(1)
+		return conn
+	}
+}
+
+// Keep the connection "conn" to "destination" for further deliveries.
+// Connections which have been unused for too long are closed.
+func (self *lmtpPool) put(destination string, conn *lmtpConn) {
+	var now time.Time = time.Now()
+	var conns, stale []*lmtpConn
+	var c *lmtpConn
+
+	// Clear the deadline; expired connections are detected by the RSET
+	// before they are reused.
+	conn.conn.SetDeadline(time.Time{})
+	conn.lastUsed = now
+
+	self.mtx.Lock()
+	for _, c = range self.idle[destination] {
+		if now.Sub(c.lastUsed) > lmtpIdleTimeout {
+			stale = append(stale, c)
+		} else {
+			conns = append(conns, c)
+		}
+	}
+	conns = append(conns, conn)
+	if len(conns) > lmtpMaxIdle {
+		stale = append(stale, conns[:len(conns)-lmtpMaxIdle]...)
+		conns = conns[len(conns)-lmtpMaxIdle:]
+	}
+	self.idle[destination] = conns
+	self.mtx.Unlock()
+
+	for _, c = range stale {
+		c.quit()
+	}
+}
+
+// Open a connection to the LMTP server of "route". Connections over TCP
+// are encrypted if the server offers STARTTLS.
+func (self *MailSubmissionService) dialLMTP(route *deliveryRoute,
+	timeout time.Duration) (*lmtpConn, error) {
+	var network, address string = lmtpAddress(route.destination)
+	var ret = new(lmtpConn)
+	var conn net.Conn
+	var err error
+
+	if network == "unix" {
+		conn, err = net.DialTimeout(network, address, timeout)
+	} else {
+		conn, err = dialSMTP(self.getResolver(), address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	ret.conn = conn
+	ret.text = textproto.NewConn(conn)
+
+	if _, _, err = ret.text.ReadResponse(220); err == nil {
+		err = ret.hello(self.heloName())
+	}
+	if err == nil && network == "tcp" {
+		if _, ok := ret.extensions["STARTTLS"]; ok {
+			var host string
+			var tlsconn *tls.Conn
+
+			host, _, _ = net.SplitHostPort(address)
+			tlsconn = tls.Client(conn, &tls.Config{
+				ServerName:         host,
+				InsecureSkipVerify: !route.requireTls,
+			})
+			if _, _, err = ret.cmd(220, "STARTTLS"); err == nil {
+				err = tlsconn.Handshake()
+			}
+			if err == nil {
+				ret.conn = tlsconn
+				ret.text = textproto.NewConn(tlsconn)
+				err = ret.hello(self.heloName())
+			}
+		} else if route.requireTls {
+			err = errors.New(route.destination + " doesn't offer STARTTLS")
+		}
+	}
+	if err != nil {
+		ret.conn.Close()
+		return nil, err
+	}
+
+	lmtp_connections_opened.Add(1)
+	return ret, nil
+}
+
+// Deliver "msg" via LMTP to the recipients of "route", reusing an
+// earlier connection to the destination if possible.
+func (self *MailSubmissionService) deliverLMTP(route *deliveryRoute,
+	msg *mailpump.MailMessage) []*mailpump.RecipientStatus {
+	var timeout = time.Duration(self.GetConfig().GetDeliveryTimeout()) *
+		time.Second
+	var statuses []*mailpump.RecipientStatus
+	var conn *lmtpConn
+	var err error
+
+	if len(route.destination) == 0 {
+		return failAll(route.recipients, smtpump.SMTP_LOCALERR,
+			"No LMTP server configured.", "")
+	}
+
+	if conn = self.lmtp_pool.get(route.destination); conn == nil {
+		conn, err = self.dialLMTP(route, timeout)
+		if err != nil {
+			lmtp_errors.Add("connect", 1)
+			return failAll(route.recipients, smtpump.SMTP_LOCALERR,
+				"Error talking to "+route.destination+": "+err.Error(),
+				route.destination)
+		}
+	}
+
+	conn.conn.SetDeadline(time.Now().Add(timeout))
+	statuses, err = conn.send(route.destination, msg, route.recipients)
+	if err != nil {
+		lmtp_errors.Add("transaction", 1)
+		conn.text.Close()
+		return statuses
+	}
+	self.lmtp_pool.put(route.destination, conn)
+	return statuses
+}
@@ -34,13 +34,14 @@ package main
 import (
 	"errors"
 	"expvar"
-	"fmt"
 	"log"
 	"strconv"
 	"sync"
 	"time"
 
 	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/metrics"
+	"ancient-solutions.com/mailpump/resolver"
 	"ancient-solutions.com/mailpump/smtpump"
 	"github.com/saintienn/go-spamc"
 )
@@ -48,6 +49,9 @@ import (
 // Counts the SMTP errors which have been returned.
 var smtp_return_codes = expvar.NewMap("smtp-return-codes")
 
+// Counts the results of recipient validations.
+var recipient_validations = expvar.NewMap("recipient-validations")
+
 // Statistics for spamd.
 var spamd_ping_errors = expvar.NewMap("spamd-ping-errors")
 var spamd_ping_requests = expvar.NewInt("spamd-ping-requests")
@@ -63,13 +67,95 @@ var num_spam_mails = expvar.NewInt("num-mails-rejected-for-spam")
 var total_num_messages = expvar.NewInt("num-messages-total")
 var total_timing = expvar.NewFloat("message-timing-total")
 
+// Latency distributions for Prometheus.
+var spamd_request_duration = metrics.NewHistogramVec(
+	"spamd_request_duration_seconds",
+	"Time spent waiting for spamd, by operation.", "operation",
+	metrics.DefaultBuckets)
+var send_duration = metrics.NewHistogram("send_duration_seconds",
+	"Time spent processing Send requests.", metrics.DefaultBuckets)
+
 // Implementation class of the submission service itself.
 type MailSubmissionService struct {
 	config       *mailpump.MailPumpConfiguration
+	recipients   *recipientTable
+	resolver     resolver.Resolver
+	queue        deliveryQueue
+	lmtp_pool    *lmtpPool
+	config_mtx   sync.RWMutex
 	spamd_client *spamc.Client
 	spamd_mtx    sync.Mutex
 }
 
+// Create a new submission service using the configuration "config".
+// DNS lookups are cached and go to the server configured in "config";
+// changes to those settings only take effect after a restart.
+func NewMailSubmissionService(
+	config *mailpump.MailPumpConfiguration) *MailSubmissionService {
+	var ret = new(MailSubmissionService)
+	var dns *resolver.CachingResolver
+
+	dns = resolver.NewCachingResolver(
+		resolver.NewUpstream(config.GetDnsServer()),
+		time.Duration(config.GetDnsCacheTtl())*time.Second,
+		time.Duration(config.GetDnsNegativeCacheTtl())*time.Second)
+	go dns.ExpireCache(time.Minute)
+
+	ret.resolver = dns
+	ret.lmtp_pool = newLmtpPool()
+	ret.SetConfig(config)
+	return ret
+}
+
+// Replace the resolver used for all DNS lookups, e.g. by an in-memory
+// zone.
+func (self *MailSubmissionService) SetResolver(res resolver.Resolver) {
+	self.config_mtx.Lock()
+	defer self.config_mtx.Unlock()
+	self.resolver = res
+}
+
+// Retrieve the resolver used for all DNS lookups.
+func (self *MailSubmissionService) getResolver() resolver.Resolver {
+	self.config_mtx.RLock()
+	defer self.config_mtx.RUnlock()
+	return self.resolver
+}
+
+// Retrieve the currently active configuration.
+func (self *MailSubmissionService) GetConfig() *mailpump.MailPumpConfiguration {
+	self.config_mtx.RLock()
+	defer self.config_mtx.RUnlock()
+	return self.config
+}
+
+// Replace the active configuration, e.g. after it has been reloaded.
+// Requests which are already being processed keep using the old one.
+func (self *MailSubmissionService) SetConfig(
+	config *mailpump.MailPumpConfiguration) {
+	var recipients *recipientTable = newRecipientTable(config)
+	var domain string
+	var dr *domainRecipients
+
+	for domain, dr = range recipients.domains {
+		if dr.err != nil {
+			log.Print("Unable to load recipients of ", domain, ": ", dr.err)
+		}
+	}
+
+	self.config_mtx.Lock()
+	defer self.config_mtx.Unlock()
+	self.config = config
+	self.recipients = recipients
+}
+
+// Retrieve the table of recipients belonging to the active configuration.
+func (self *MailSubmissionService) getRecipients() *recipientTable {
+	self.config_mtx.RLock()
+	defer self.config_mtx.RUnlock()
+	return self.recipients
+}
+
 // Put the code and text inside the submission result and do expvar
 // bookkeeping.
 func fillSmtpError(result *mailpump.MailSubmissionResult, code int32,
@@ -81,25 +167,22 @@ func fillSmtpError(result *mailpump.MailSubmissionResult, code int32,
 	*result.ErrorText = text
 }
 
-// Submit a message which hasn't previously been checked for validity.
-// This will run SPAM and SPF filter as well as policies before
-// attempting to deliver the mail.
-func (self *MailSubmissionService) Send(
-	msg mailpump.MailMessage, ret *mailpump.MailSubmissionResult) error {
-	var start, total_start time.Time
+// Run the message "msg" through spamd and record the verdict. If the
+// message must not be processed any further, "ret" is filled in and true
+// is returned.
+func (self *MailSubmissionService) checkSpam(msg *mailpump.MailMessage,
+	ret *mailpump.MailSubmissionResult) bool {
+	var start time.Time
 	var res *spamc.SpamDOut
-	var rawmessage string
 	var spam_verdict *mailpump.QualityVerdict
-	var hdr *mailpump.MailMessage_MailHeader
 	var spamresult, ok bool
 	var err error
 
-	total_start = time.Now()
-
 	if self.spamd_client != nil {
 		start = time.Now()
 		res, err = self.spamd_client.Ping()
 		spamd_ping_timing.Add(time.Now().Sub(start).Seconds())
+		spamd_request_duration.ObserveSinceWithLabel("ping", start)
 		spamd_ping_requests.Add(1)
 		if err != nil {
 			spamd_ping_errors.Add(err.Error(), 1)
@@ -111,20 +194,16 @@ func (self *MailSubmissionService) Send(
 		self.spamd_mtx.Lock()
 		// TODO(caoimhe): this will reconnect multiple times in case of
 		// lock contention, it's just good enough for testing.
-		self.spamd_client = spamc.New(self.config.GetSpamdHost(), 5)
+		self.spamd_client = spamc.New(self.GetConfig().GetSpamdHost(), 5)
 		self.spamd_mtx.Unlock()
 	}
 
-	for _, hdr = range msg.Headers {
-		rawmessage += fmt.Sprintf("%s: %s\r\n", hdr.GetName(), hdr.GetValue())
-	}
-	rawmessage += "\r\n" + string(msg.Body)
-
 	// TODO(caoimhe): invoke spamd asynchronously and gather the result via
 	// a channel.
 	start = time.Now()
-	res, err = self.spamd_client.Check(rawmessage)
+	res, err = self.spamd_client.Check(string(msg.RawBytes()))
 	spamd_eval_timing.Add(time.Now().Sub(start).Seconds())
+	spamd_request_duration.ObserveSinceWithLabel("check", start)
 	spamd_num_evaluations.Add(1)
 	if err == nil && res.Code != spamc.EX_OK {
 		err = errors.New(spamc.SpamDError[res.Code])
@@ -135,9 +214,7 @@ func (self *MailSubmissionService) Send(
 		spamd_eval_errors.Add(err.Error(), 1)
 		fillSmtpError(ret, smtpump.SMTP_LOCALERR,
 			"Error communicating with backend")
-		total_num_messages.Add(1)
-		total_timing.Add(time.Now().Sub(total_start).Seconds())
-		return nil
+		return true
 	}
 
 	spam_verdict = new(mailpump.QualityVerdict)
@@ -150,9 +227,7 @@ func (self *MailSubmissionService) Send(
 		log.Print("Unable to determine SPAM score (", res.Vars, ")")
 		fillSmtpError(ret, smtpump.SMTP_LOCALERR,
 			"Error communicating with backend")
-		total_num_messages.Add(1)
-		total_timing.Add(time.Now().Sub(total_start).Seconds())
-		return nil
+		return true
 	}
 
 	spamresult, ok = res.Vars["isSpam"].(bool)
@@ -161,9 +236,7 @@ func (self *MailSubmissionService) Send(
 		log.Print("Unable to determine SPAM flag (", res.Vars, ")")
 		fillSmtpError(ret, smtpump.SMTP_LOCALERR,
 			"Error communicating with backend")
-		total_num_messages.Add(1)
-		total_timing.Add(time.Now().Sub(total_start).Seconds())
-		return nil
+		return true
 	}
 	spam_verdict.Verdict = new(mailpump.QualityVerdict_VerdictType)
 	if spamresult {
@@ -179,15 +252,124 @@ func (self *MailSubmissionService) Send(
 	if spamresult {
 		fillSmtpError(ret, smtpump.SMTP_TRANSACTION_FAILED,
 			"Reject, please keep your SPAM to yourself!")
+		return true
+	}
+	return false
+}
+
+// Put "msg" into the delivery queue, so it's delivered in the background,
+// and put the outcome into "ret". Recipients which can't be delivered to
+// at all are rejected right away, so mail which could only ever bounce
+// is refused while the client still waits for the result.
+func (self *MailSubmissionService) enqueue(msg *mailpump.MailMessage,
+	ret *mailpump.MailSubmissionResult) {
+	var routes []*deliveryRoute
+	var route *deliveryRoute
+	var failed []*mailpump.RecipientStatus
+	var recipients []string
+	var code int32
+	var text, id string
+	var err error
+
+	routes, failed = self.routeMessage(msg,
+		self.getRecipients().expandEnvelope(msg))
+	for _, route = range routes {
+		recipients = append(recipients, route.recipients...)
+	}
+	recordDelivery(msg, failed)
+	ret.RecipientStatus = failed
+
+	if len(recipients) == 0 {
+		if len(failed) == 0 {
+			fillSmtpError(ret, smtpump.SMTP_BAD_SEQUENCE, "No recipients.")
+		} else {
+			code, text = summarizeDelivery(failed)
+			fillSmtpError(ret, code, text)
+		}
+		return
+	}
+
+	id, err = self.queue.Enqueue(msg, recipients)
+	if err != nil {
+		log.Print("Error queueing message ", msg.GetMsgidHdr(), ": ", err)
+		ret.RecipientStatus = nil
+		fillSmtpError(ret, smtpump.SMTP_LOCALERR,
+			"Unable to queue the message, please try again later.")
+		return
+	}
+	fillSmtpError(ret, smtpump.SMTP_COMPLETED, "Ok, queued as "+id+".")
+
+	// The message was accepted for the other recipients, so the sender
+	// has to learn about the ones which were rejected.
+	self.notifySender(msg, failed, time.Now(), time.Time{})
+}
+
+// Submit a message which hasn't previously been checked for validity.
+// This will run SPAM and SPF filter as well as policies before
+// attempting to deliver the mail, or putting it into the delivery queue
+// if there is one. Mail submitted by authenticated users is relayed
+// without being checked for SPAM. Rejected mail which the client already
+// accepted is returned to its sender.
+func (self *MailSubmissionService) Send(
+	msg mailpump.MailMessage, ret *mailpump.MailSubmissionResult) error {
+	var total_start time.Time = time.Now()
+
+	defer send_duration.ObserveSince(total_start)
+	defer func() {
 		total_num_messages.Add(1)
 		total_timing.Add(time.Now().Sub(total_start).Seconds())
+	}()
+
+	if msg.MimeStructure == nil {
+		// Older clients and spooled mail don't carry the MIME structure.
+		msg.MimeStructure = mailpump.ParseMimeStructure(msg.RawBytes(),
+			mailpump.DefaultMimeLimits)
+	}
+	if self.filterContent(&msg, ret) {
+		self.returnToSender(&msg, ret)
 		return nil
 	}
-	log.Print("Result: ", msg.String())
+	if len(msg.GetAuthenticatedUser()) == 0 && self.checkSpam(&msg, ret) {
+		if ret.GetErrorCode() >= 500 && msg.GetAlreadyAccepted() {
+			// Returning SPAM would only send it on to forged senders.
+			dsn_suppressed.Add("spam", 1)
+			return nil
+		}
+		self.returnToSender(&msg, ret)
+		return nil
+	}
+	log.Print("Accepted message ", msg.GetMsgidHdr(), " from <",
+		msg.GetSmtpFrom(), "> (", msg.GetSmtpPeer(), ") to ", msg.SmtpTo)
+
+	if self.queue == nil {
+		self.deliver(&msg, ret)
+	} else {
+		self.enqueue(&msg, ret)
+	}
+	self.returnToSender(&msg, ret)
+	return nil
+}
+
+// Report that the service is alive. This is used by clients to check
+// the health of their connections.
+func (self *MailSubmissionService) Ping(
+	req mailpump.PingRequest, ret *mailpump.PingResponse) error {
+	ret.Version = new(string)
+	*ret.Version = mailpump.MAILPUMP_VERSION
+	return nil
+}
+
+// Determine whether mail to the recipient in "req" would be accepted, so
+// unknown recipients can be rejected during the SMTP dialog already.
+func (self *MailSubmissionService) ValidateRecipient(
+	req mailpump.RecipientValidationRequest,
+	ret *mailpump.MailSubmissionResult) error {
+	var code int32
+	var text string
 
-	fillSmtpError(ret, smtpump.SMTP_UNAVAIL,
-		"Hello from MailSubmissionService!")
-	total_num_messages.Add(1)
-	total_timing.Add(time.Now().Sub(total_start).Seconds())
+	code, text = self.getRecipients().validate(req.GetRecipient())
+	recipient_validations.Add(strconv.Itoa(int(code)), 1)
+	ret.ErrorCode = &code
+	ret.ErrorText = &text
 	return nil
 }
@@ -0,0 +1,242 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+var maildir_errors = expvar.NewMap("maildir-errors")
+var maildir_folder_deliveries = expvar.NewInt("maildir-folder-deliveries")
+var maildir_created = expvar.NewInt("maildir-created")
+
+// Counter making the names of the files delivered by this process unique.
+var maildir_counter uint64
+
+// Subdirectories every maildir (and every folder of it) consists of.
+var maildirSubdirs = []string{"tmp", "new", "cur"}
+
+// Determine whether "name" can be used as a file name below a maildir
+// without escaping it.
+func validMaildirName(name string) bool {
+	return len(name) > 0 && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// Generate a unique name for a file of "size" bytes to be delivered into
+// a maildir, following the conventions of Maildir++.
+func maildirFilename(size int) string {
+	var now time.Time = time.Now()
+	var host string
+	var err error
+
+	if host, err = os.Hostname(); err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(host, "/", "\\057", -1)
+	host = strings.Replace(host, ":", "\\072", -1)
+
+	return strconv.FormatInt(now.Unix(), 10) + ".M" +
+		strconv.Itoa(now.Nanosecond()/1000) + "P" +
+		strconv.Itoa(os.Getpid()) + "Q" +
+		strconv.FormatUint(atomic.AddUint64(&maildir_counter, 1), 10) +
+		"." + host + ",S=" + strconv.Itoa(size)
+}
+
+// Determine the folder of the maildir "maildir" mail for the subaddress
+// "detail" goes to. Without a folder of that name, it's the inbox.
+func maildirFolder(maildir, detail string) string {
+	var folder string
+	var fi os.FileInfo
+	var err error
+
+	if !validMaildirName(detail) || strings.Contains(detail, "..") {
+		return maildir
+	}
+
+	folder = filepath.Join(maildir, "."+detail)
+	if fi, err = os.Stat(filepath.Join(folder, "new")); err != nil ||
+		!fi.IsDir() {
+		return maildir
+	}
+	maildir_folder_deliveries.Add(1)
+	return folder
+}
+
+// Write "data" into a new file in the maildir folder "folder". The file
+// is written to tmp and only renamed into new once it's on disk, so
+// readers never see incomplete messages.
+func writeMaildir(folder string, data []byte) error {
+	var name string = maildirFilename(len(data))
+	var tmpname string = filepath.Join(folder, "tmp", name)
+	var f *os.File
+	var err error
+
+	f, err = os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		maildir_errors.Add("create", 1)
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		maildir_errors.Add("write", 1)
+		os.Remove(tmpname)
+		return err
+	}
+
+	if err = os.Rename(tmpname, filepath.Join(folder, "new", name)); err != nil {
+		maildir_errors.Add("rename", 1)
+		os.Remove(tmpname)
+		return err
+	}
+
+	// Flush the directory entry so the rename survives a crash.
+	if f, err = os.Open(filepath.Join(folder, "new")); err != nil {
+		maildir_errors.Add("sync", 1)
+		return err
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		maildir_errors.Add("sync", 1)
+	}
+	return err
+}
+
+// Create the maildir "maildir" if it doesn't exist yet.
+func createMaildir(maildir string) error {
+	var sub string
+	var err error
+
+	for _, sub = range maildirSubdirs {
+		if err = os.MkdirAll(filepath.Join(maildir, sub), 0700); err != nil {
+			maildir_errors.Add("mkdir", 1)
+			return err
+		}
+	}
+	maildir_created.Add(1)
+	return nil
+}
+
+// Deliver "msg" to the recipient "rcpt" into its maildir below
+// "route.maildirRoot".
+func deliverMaildirRecipient(route *deliveryRoute, msg *mailpump.MailMessage,
+	rcpt string, contents []byte) *mailpump.RecipientStatus {
+	var localpart, user, detail, maildir string
+	var buf bytes.Buffer
+	var pos int
+	var err error
+
+	localpart, _, err = splitAddress(rcpt)
+	if err != nil {
+		return newRecipientStatus(rcpt, smtpump.SMTP_PARAMETER_ERROR,
+			err.Error(), "")
+	}
+
+	user = strings.ToLower(localpart)
+	if pos = strings.Index(localpart, "+"); pos > 0 {
+		user = strings.ToLower(localpart[:pos])
+		detail = localpart[pos+1:]
+	}
+	if !validMaildirName(user) {
+		return newRecipientStatus(rcpt, smtpump.SMTP_ILLEGAL_MAILBOX_NAME,
+			"Invalid mailbox name.", "")
+	}
+
+	maildir = filepath.Join(route.maildirRoot, user)
+	if _, err = os.Stat(filepath.Join(maildir, "new")); os.IsNotExist(err) {
+		if !route.maildirCreate {
+			return newRecipientStatus(rcpt,
+				smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl,
+				"Mailbox unavailable.", "")
+		}
+		err = createMaildir(maildir)
+	}
+	if err != nil {
+		log.Print("Unable to access maildir ", maildir, ": ", err)
+		return newRecipientStatus(rcpt, smtpump.SMTP_LOCALERR,
+			"Unable to access the mailbox, please try again later.", "")
+	}
+
+	// Local delivery is where the envelope is written into the message
+	// (RFC 5321, section 4.4).
+	buf.WriteString("Return-Path: <" + msg.GetSmtpFrom() + ">\n")
+	buf.WriteString("Delivered-To: " + rcpt + "\n")
+	buf.Write(contents)
+
+	err = writeMaildir(maildirFolder(maildir, detail), buf.Bytes())
+	if err != nil {
+		log.Print("Unable to deliver to maildir ", maildir, ": ", err)
+		return newRecipientStatus(rcpt, smtpump.SMTP_LOCALERR,
+			"Unable to write to the mailbox, please try again later.", "")
+	}
+	return newRecipientStatus(rcpt, smtpump.SMTP_COMPLETED,
+		"Delivered to maildir.", "")
+}
+
+// Deliver "msg" into the maildirs of the recipients of "route".
+func deliverMaildir(route *deliveryRoute,
+	msg *mailpump.MailMessage) (ret []*mailpump.RecipientStatus) {
+	// Files in maildirs conventionally use plain line feeds.
+	var contents []byte = bytes.Replace(msg.RawBytes(), []byte("\r\n"),
+		[]byte("\n"), -1)
+	var rcpt string
+
+	if len(route.maildirRoot) == 0 {
+		log.Print("No maildir_root configured for ", route.domain)
+		return failAll(route.recipients, smtpump.SMTP_LOCALERR,
+			"Mailbox storage not configured.", "")
+	}
+
+	for _, rcpt = range route.recipients {
+		ret = append(ret, deliverMaildirRecipient(route, msg, rcpt,
+			contents))
+	}
+	return
+}
@@ -33,41 +33,37 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"time"
 
 	"ancient-solutions.com/doozer/exportedservice"
 	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/certmanager"
+	_ "ancient-solutions.com/mailpump/metrics"
 	"code.google.com/p/goprotobuf/proto"
 )
 
-func main() {
-	var service *MailSubmissionService
+// Read and parse the mailstream configuration from "configpath".
+func readConfig(configpath string) (*mailpump.MailPumpConfiguration, error) {
 	var conf *mailpump.MailPumpConfiguration
-	var l net.Listener
 	var config_contents []byte
-	var configpath string
 	var err error
 
-	flag.StringVar(&configpath, "config-path", "mailstream.cfg",
-		"Path to the mailstream configuration file "+
-			"(an ascii protocol buffer).")
-	flag.Parse()
-
 	config_contents, err = ioutil.ReadFile(configpath)
 	if err != nil {
-		log.Fatal("Unable to read ", configpath, ": ", err)
+		return nil, err
 	}
 
 	conf = new(mailpump.MailPumpConfiguration)
 	err = proto.UnmarshalText(string(config_contents), conf)
 	if err != nil {
-		log.Fatal("Error parsing ", configpath, ": ", err)
+		return nil, err
 	}
 
 	if conf.DoozerUri == nil && len(os.Getenv("DOOZER_URI")) > 0 {
@@ -80,33 +76,74 @@ func main() {
 		*conf.DoozerBootUri = os.Getenv("DOOZER_BOOT_URI")
 	}
 
-	if conf.GetInsecure() {
-		l, err = net.Listen("tcp", conf.GetBindTo())
-	} else {
-		var tlscert tls.Certificate
-		var config *tls.Config = new(tls.Config)
-		var certdata []byte
+	return conf, nil
+}
+
+// Reread the configuration from "configpath" and put it into use in
+// "service". Listener related settings only take effect after a restart.
+func reloadConfig(service *MailSubmissionService, configpath string) {
+	var conf *mailpump.MailPumpConfiguration
+	var err error
+
+	conf, err = readConfig(configpath)
+	if err != nil {
+		log.Print("Error reloading ", configpath,
+			", keeping the old configuration: ", err)
+		return
+	}
+
+	service.SetConfig(conf)
+	log.Print("Reloaded configuration from ", configpath)
+}
+
+func main() {
+	var service *MailSubmissionService
+	var conf *mailpump.MailPumpConfiguration
+	var certs *certmanager.CertificateManager
+	var l net.Listener
+	var configpath string
+	var cert_check_interval time.Duration
+	var err error
+
+	flag.StringVar(&configpath, "config-path", "mailstream.cfg",
+		"Path to the mailstream configuration file "+
+			"(an ascii protocol buffer).")
+	flag.DurationVar(&cert_check_interval, "cert-check-interval",
+		time.Minute, "Interval in which the X.509 certificate files are "+
+			"checked for changes.")
+	flag.Parse()
+
+	conf, err = readConfig(configpath)
+	if err != nil {
+		log.Fatal("Error reading ", configpath, ": ", err)
+	}
 
-		config.ClientAuth = tls.VerifyClientCertIfGiven
-		config.MinVersion = tls.VersionTLS12
+	// Create server-side service object and register with the HTTP server.
+	service = NewMailSubmissionService(conf)
+
+	if conf.Queue != nil {
+		var queue *DiskQueue
 
-		tlscert, err = tls.LoadX509KeyPair(conf.GetX509Cert(),
-			conf.GetX509Key())
+		queue, err = NewDiskQueue(conf.GetQueue().GetDirectory(), service)
 		if err != nil {
-			log.Fatal("Unable to load X.509 key pair: ", err)
+			log.Fatal("Error opening the delivery queue: ", err)
 		}
-		config.Certificates = append(config.Certificates, tlscert)
-		config.BuildNameToCertificate()
+		service.queue = queue
+		go queue.Run()
+	}
+
+	if conf.GetInsecure() {
+		l, err = net.Listen("tcp", conf.GetBindTo())
+	} else {
+		var config *tls.Config
 
-		config.ClientCAs = x509.NewCertPool()
-		certdata, err = ioutil.ReadFile(conf.GetX509CaCert())
+		certs, err = certmanager.NewCertificateManager(conf.GetX509Cert(),
+			conf.GetX509Key(), conf.GetX509CaCert())
 		if err != nil {
-			log.Fatal("Error reading ", conf.GetX509CaCert(), ": ", err)
-		}
-		if !config.ClientCAs.AppendCertsFromPEM(certdata) {
-			log.Fatal("Unable to load the X.509 certificates from ",
-				conf.GetX509CaCert())
+			log.Fatal(err)
 		}
+		certs.WatchFiles(cert_check_interval)
+		config = certs.ServerConfig(tls.VerifyClientCertIfGiven)
 
 		if conf.DoozerUri != nil && len(conf.GetDoozerUri()) > 0 {
 			var exporter *exportedservice.ServiceExporter
@@ -129,15 +166,23 @@ func main() {
 		}
 	}
 
-	// Create server-side service object and register with the HTTP server.
-	service = &MailSubmissionService{
-		config: conf,
+	if certs != nil {
+		certs.ReloadOnSignal(func() { reloadConfig(service, configpath) })
+	} else {
+		certmanager.OnSignal(func() { reloadConfig(service, configpath) })
 	}
 
 	if err = rpc.Register(service); err != nil {
 		log.Fatal("Unable to register RPC handler: ", err)
 	}
 
+	if len(conf.GetWebPort()) > 0 {
+		go func() {
+			log.Print("Web server exited: ",
+				http.ListenAndServe(conf.GetWebPort(), nil))
+		}()
+	}
+
 	log.Print("Listening on ", l.Addr())
 	rpc.Accept(l)
 }
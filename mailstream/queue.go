@@ -0,0 +1,580 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var queue_depth = expvar.NewInt("queue-depth")
+var queue_oldest_age = expvar.NewInt("queue-oldest-age")
+var queue_messages_queued = expvar.NewInt("queue-messages-queued")
+var queue_messages_completed = expvar.NewInt("queue-messages-completed")
+var queue_messages_expired = expvar.NewInt("queue-messages-expired")
+var queue_delivery_attempts = expvar.NewInt("queue-delivery-attempts")
+var queue_active_deliveries = expvar.NewInt("queue-active-deliveries")
+var queue_concurrency_limited = expvar.NewInt("queue-concurrency-limited")
+var queue_errors = expvar.NewMap("queue-errors")
+
+// Directories of the queue holding the contents of the messages, their
+// delivery state, and files which are still being written.
+const queueMessageDir = "msg"
+const queueStateDir = "state"
+const queueTmpDir = "tmp"
+
+// Scheduling information about a queued message, kept in memory.
+type queueItem struct {
+	id          string
+	queuedAt    time.Time
+	nextAttempt time.Time
+
+	// Domains of the recipients which are still pending.
+	domains map[string]bool
+
+	// Set while a delivery attempt is in progress.
+	busy bool
+}
+
+// Queue of mail waiting to be delivered, kept on local disk. Every
+// message consists of a file in the "msg" directory holding its contents
+// and one in the "state" directory holding the envelope and the delivery
+// state; a message is queued as long as its state file exists.
+type DiskQueue struct {
+	dir     string
+	service *MailSubmissionService
+
+	items   map[string]*queueItem
+	active  map[string]int
+	counter uint64
+	wakeup  chan bool
+	mtx     sync.Mutex
+}
+
+// Open the queue in the directory "dir", delivering messages through
+// "service". Messages left over from previous runs are picked up again.
+func NewDiskQueue(dir string, service *MailSubmissionService) (
+	*DiskQueue, error) {
+	var ret = &DiskQueue{
+		dir:     dir,
+		service: service,
+		items:   make(map[string]*queueItem),
+		active:  make(map[string]int),
+		wakeup:  make(chan bool, 1),
+	}
+	var entries []os.FileInfo
+	var fi os.FileInfo
+	var sub string
+	var err error
+
+	for _, sub = range []string{queueMessageDir, queueStateDir,
+		queueTmpDir} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	// Files in tmp belong to messages which were never queued.
+	entries, err = ioutil.ReadDir(filepath.Join(dir, queueTmpDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi = range entries {
+		os.Remove(filepath.Join(dir, queueTmpDir, fi.Name()))
+	}
+
+	entries, err = ioutil.ReadDir(filepath.Join(dir, queueStateDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi = range entries {
+		var entry *mailpump.QueueEntry
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		entry, err = ret.readState(fi.Name())
+		if err != nil {
+			log.Print("Skipping unreadable queue entry ", fi.Name(), ": ",
+				err)
+			queue_errors.Add("read-state", 1)
+			continue
+		}
+		ret.items[fi.Name()] = newQueueItem(fi.Name(), entry)
+	}
+
+	// Message files without a state file are left over from crashes
+	// while queueing or removing a message.
+	entries, err = ioutil.ReadDir(filepath.Join(dir, queueMessageDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi = range entries {
+		if _, err = os.Stat(filepath.Join(dir, queueStateDir,
+			fi.Name())); os.IsNotExist(err) {
+			os.Remove(filepath.Join(dir, queueMessageDir, fi.Name()))
+		}
+	}
+
+	queue_depth.Set(int64(len(ret.items)))
+	return ret, nil
+}
+
+// Create the scheduling information for the message "id" in the state
+// "entry".
+func newQueueItem(id string, entry *mailpump.QueueEntry) *queueItem {
+	var ret = &queueItem{
+		id:          id,
+		queuedAt:    time.Unix(entry.GetQueuedAt(), 0),
+		nextAttempt: time.Unix(entry.GetNextAttempt(), 0),
+	}
+	ret.setRecipients(entry.PendingRecipients)
+	return ret
+}
+
+// Record the domains of the pending "recipients".
+func (self *queueItem) setRecipients(recipients []string) {
+	var rcpt, domain string
+	var err error
+
+	self.domains = make(map[string]bool)
+	for _, rcpt = range recipients {
+		if _, domain, err = splitAddress(rcpt); err == nil {
+			self.domains[domain] = true
+		}
+	}
+}
+
+// Retrieve the settings of the queue from the active configuration.
+func (self *DiskQueue) config() *mailpump.QueueConfiguration {
+	return self.service.GetConfig().GetQueue()
+}
+
+// Write "data" to the file "name" in the subdirectory "sub" of the
+// queue. The file is written to tmp first and then renamed into place,
+// so it's replaced atomically; once this returns, it's on disk.
+func (self *DiskQueue) writeFile(sub, name string, data []byte) error {
+	var tmpname string = filepath.Join(self.dir, queueTmpDir, name+"."+sub)
+	var f *os.File
+	var err error
+
+	f, err = os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filepath.Join(self.dir, sub, name))
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// Flush the directory entry so the rename survives a crash.
+	if f, err = os.Open(filepath.Join(self.dir, sub)); err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Read the delivery state of the message "id".
+func (self *DiskQueue) readState(id string) (*mailpump.QueueEntry, error) {
+	var entry = new(mailpump.QueueEntry)
+	var data []byte
+	var err error
+
+	data, err = ioutil.ReadFile(filepath.Join(self.dir, queueStateDir, id))
+	if err != nil {
+		return nil, err
+	}
+	if err = proto.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	if entry.Message == nil {
+		return nil, errors.New("Queue entry " + id + " lacks a message")
+	}
+	return entry, nil
+}
+
+// Write the delivery state "entry" of the message "id" to disk.
+func (self *DiskQueue) writeState(id string,
+	entry *mailpump.QueueEntry) error {
+	var data []byte
+	var err error
+
+	if data, err = proto.Marshal(entry); err != nil {
+		return err
+	}
+	return self.writeFile(queueStateDir, id, data)
+}
+
+// Put "msg" into the queue, to be delivered to "recipients". These are
+// expected to be expanded already. The message is only queued if no
+// error is returned; it's identified by the returned ID from then on.
+func (self *DiskQueue) Enqueue(msg *mailpump.MailMessage,
+	recipients []string) (string, error) {
+	var now time.Time = time.Now()
+	var entry = new(mailpump.QueueEntry)
+	var envelope mailpump.MailMessage = *msg
+	var id string
+	var err error
+
+	id = strconv.FormatInt(now.UnixNano(), 36) + "." +
+		strconv.FormatUint(atomic.AddUint64(&self.counter, 1), 36)
+
+	// The contents go into a file of their own, so only the state needs
+	// to be rewritten after each attempt.
+	envelope.RawMessage = nil
+	envelope.Body = nil
+	entry.Message = &envelope
+	entry.PendingRecipients = recipients
+	entry.QueuedAt = new(int64)
+	*entry.QueuedAt = now.Unix()
+	entry.NextAttempt = new(int64)
+	*entry.NextAttempt = now.Unix()
+
+	err = self.writeFile(queueMessageDir, id, msg.RawBytes())
+	if err == nil {
+		err = self.writeState(id, entry)
+		if err != nil {
+			os.Remove(filepath.Join(self.dir, queueMessageDir, id))
+		}
+	}
+	if err != nil {
+		queue_errors.Add("enqueue", 1)
+		return "", err
+	}
+
+	self.mtx.Lock()
+	self.items[id] = newQueueItem(id, entry)
+	queue_depth.Set(int64(len(self.items)))
+	self.mtx.Unlock()
+
+	queue_messages_queued.Add(1)
+	self.wake()
+	return id, nil
+}
+
+// Make the scheduler look for due messages right away.
+func (self *DiskQueue) wake() {
+	select {
+	case self.wakeup <- true:
+	default:
+	}
+}
+
+// Retry delivery of all queued mail for "domain" right away. Returns the
+// number of messages affected.
+func (self *DiskQueue) Flush(domain string) (int, error) {
+	var item *queueItem
+	var now time.Time = time.Now()
+	var num int
+
+	self.mtx.Lock()
+	for _, item = range self.items {
+		if item.domains[strings.ToLower(domain)] {
+			if item.nextAttempt.After(now) {
+				item.nextAttempt = now
+			}
+			num++
+		}
+	}
+	self.mtx.Unlock()
+
+	self.wake()
+	return num, nil
+}
+
+// Determine the time to wait before the next attempt after "attempts"
+// failed attempts.
+func retryInterval(config *mailpump.QueueConfiguration,
+	attempts int32) time.Duration {
+	var interval float64 = float64(config.GetInitialRetryInterval()) *
+		math.Pow(config.GetBackoffFactor(), float64(attempts-1))
+
+	if interval > float64(config.GetMaxRetryInterval()) {
+		interval = float64(config.GetMaxRetryInterval())
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// Reserve a delivery slot for the destination "target". Returns false if
+// all slots are taken.
+func (self *DiskQueue) acquire(target string) bool {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	if self.active[target] >= int(self.config().
+		GetMaxConcurrencyPerDestination()) {
+		queue_concurrency_limited.Add(1)
+		return false
+	}
+	self.active[target]++
+	queue_active_deliveries.Add(1)
+	return true
+}
+
+// Release a delivery slot reserved for "target".
+func (self *DiskQueue) release(target string) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	self.active[target]--
+	if self.active[target] <= 0 {
+		delete(self.active, target)
+	}
+	queue_active_deliveries.Add(-1)
+}
+
+// Remove the message "id" from the queue once it has been dealt with.
+func (self *DiskQueue) remove(id string) {
+	var err error
+
+	// Without the state file, the message is no longer queued.
+	err = os.Remove(filepath.Join(self.dir, queueStateDir, id))
+	if err != nil {
+		log.Print("Error removing queue entry ", id, ": ", err)
+		queue_errors.Add("remove", 1)
+	}
+	os.Remove(filepath.Join(self.dir, queueMessageDir, id))
+
+	self.mtx.Lock()
+	delete(self.items, id)
+	queue_depth.Set(int64(len(self.items)))
+	self.mtx.Unlock()
+}
+
+// Give up on delivering to the recipients of "entry" which are still
+// pending, reporting the last problem encountered with each of them.
+// Returns the resulting statuses.
+func expireRecipients(entry *mailpump.QueueEntry, lifetime time.Duration) (
+	expired []*mailpump.RecipientStatus) {
+	var last = make(map[string]*mailpump.RecipientStatus)
+	var status *mailpump.RecipientStatus
+	var rcpt, text string
+
+	for _, status = range entry.LastStatus {
+		last[status.GetRecipient()] = status
+	}
+
+	for _, rcpt = range entry.PendingRecipients {
+		text = "Unable to deliver for " + lifetime.String()
+		if status = last[rcpt]; status != nil {
+			text += ": " + status.GetText()
+		}
+		expired = append(expired, newRecipientStatus(rcpt,
+			smtpump.SMTP_TRANSACTION_FAILED, text, status.GetRemoteHost()))
+	}
+	entry.FinalStatus = append(entry.FinalStatus, expired...)
+	entry.PendingRecipients = nil
+	entry.LastStatus = nil
+	return
+}
+
+// Try to deliver the message of "item" to its pending recipients and
+// record the outcome.
+func (self *DiskQueue) attempt(item *queueItem) {
+	var config *mailpump.QueueConfiguration = self.config()
+	var lifetime = time.Duration(config.GetMaxLifetime()) * time.Second
+	var delayWarning = time.Duration(config.GetDelayWarningInterval()) *
+		time.Second
+	var now time.Time = time.Now()
+	var entry *mailpump.QueueEntry
+	var msg mailpump.MailMessage
+	var routes []*deliveryRoute
+	var route *deliveryRoute
+	var statuses, final []*mailpump.RecipientStatus
+	var status *mailpump.RecipientStatus
+	var postponed []string
+	var next time.Time
+	var err error
+
+	defer func() {
+		self.mtx.Lock()
+		item.busy = false
+		if entry != nil {
+			item.setRecipients(entry.PendingRecipients)
+		}
+		item.nextAttempt = next
+		self.mtx.Unlock()
+	}()
+	next = now.Add(retryInterval(config, 1))
+
+	entry, err = self.readState(item.id)
+	if err == nil {
+		msg = *entry.Message
+		msg.RawMessage, err = ioutil.ReadFile(
+			filepath.Join(self.dir, queueMessageDir, item.id))
+	}
+	if err != nil {
+		log.Print("Error reading queued message ", item.id, ": ", err)
+		queue_errors.Add("read", 1)
+		entry = nil
+		return
+	}
+
+	routes, statuses = self.service.routeMessage(&msg,
+		entry.PendingRecipients)
+	for _, route = range routes {
+		if !self.acquire(route.target()) {
+			postponed = append(postponed, route.recipients...)
+			continue
+		}
+		statuses = append(statuses, self.service.deliverRoute(route, &msg)...)
+		self.release(route.target())
+	}
+	queue_delivery_attempts.Add(1)
+	recordDelivery(&msg, statuses)
+
+	entry.PendingRecipients = postponed
+	entry.LastStatus = nil
+	for _, status = range statuses {
+		if status.GetCode() >= 400 && status.GetCode() < 500 {
+			entry.PendingRecipients = append(entry.PendingRecipients,
+				status.GetRecipient())
+			entry.LastStatus = append(entry.LastStatus, status)
+		} else {
+			entry.FinalStatus = append(entry.FinalStatus, status)
+			final = append(final, status)
+		}
+	}
+	if len(statuses) > 0 {
+		var attempts int32 = entry.GetAttempts() + 1
+		entry.Attempts = &attempts
+	}
+
+	if len(entry.PendingRecipients) > 0 && now.Sub(item.queuedAt) > lifetime {
+		log.Print("Giving up on queued message ", item.id, " after ",
+			lifetime)
+		queue_messages_expired.Add(1)
+		final = append(final, expireRecipients(entry, lifetime)...)
+	}
+	self.service.notifySender(&msg, final, item.queuedAt, time.Time{})
+
+	if len(entry.LastStatus) > 0 && !entry.GetDelayNotified() &&
+		now.Sub(item.queuedAt) >= delayWarning {
+		var notified bool = true
+
+		self.service.notifySender(&msg, entry.LastStatus, item.queuedAt,
+			item.queuedAt.Add(lifetime))
+		entry.DelayNotified = &notified
+	}
+
+	if len(entry.PendingRecipients) == 0 {
+		queue_messages_completed.Add(1)
+		self.remove(item.id)
+		return
+	}
+
+	if len(entry.LastStatus) > 0 {
+		next = now.Add(retryInterval(config, entry.GetAttempts()))
+	} else {
+		// Only postponed due to the concurrency limits.
+		next = now.Add(time.Duration(config.GetScanInterval()) * time.Second)
+	}
+	entry.NextAttempt = new(int64)
+	*entry.NextAttempt = next.Unix()
+	if err = self.writeState(item.id, entry); err != nil {
+		log.Print("Error updating queue entry ", item.id, ": ", err)
+		queue_errors.Add("write-state", 1)
+	}
+}
+
+// Start delivery attempts for all messages which are due and update the
+// statistics. Returns the time the next message becomes due.
+func (self *DiskQueue) schedule() time.Time {
+	var now time.Time = time.Now()
+	var next time.Time = now.Add(
+		time.Duration(self.config().GetScanInterval()) * time.Second)
+	var oldest time.Time = now
+	var item *queueItem
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	for _, item = range self.items {
+		if item.queuedAt.Before(oldest) {
+			oldest = item.queuedAt
+		}
+		if item.busy {
+			continue
+		}
+		if !item.nextAttempt.After(now) {
+			item.busy = true
+			go self.attempt(item)
+		} else if item.nextAttempt.Before(next) {
+			next = item.nextAttempt
+		}
+	}
+
+	queue_oldest_age.Set(int64(now.Sub(oldest).Seconds()))
+	return next
+}
+
+// Deliver the queued messages as they become due. This will block
+// forever, so run it in a goroutine.
+func (self *DiskQueue) Run() {
+	for {
+		var timer *time.Timer = time.NewTimer(
+			self.schedule().Sub(time.Now()))
+
+		select {
+		case <-timer.C:
+		case <-self.wakeup:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,278 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Recipients accepted for a single domain.
+type domainRecipients struct {
+	config *mailpump.DomainDeliveryConfiguration
+
+	// Mailboxes and aliases of the domain, by lower case local part.
+	// If nil, any local part is accepted.
+	mailboxes map[string]bool
+	aliases   map[string][]string
+
+	// Set if the recipient table of the domain couldn't be loaded.
+	err error
+}
+
+// Table of all recipients mailstream accepts mail for, built from the
+// domain configurations.
+type recipientTable struct {
+	domains map[string]*domainRecipients
+}
+
+// Build the recipient table for all domains configured in "conf".
+// Problems reading the recipient table of a domain are recorded with the
+// domain so recipients there can be rejected temporarily.
+func newRecipientTable(conf *mailpump.MailPumpConfiguration) (
+	ret *recipientTable) {
+	var dc *mailpump.DomainDeliveryConfiguration
+
+	ret = &recipientTable{
+		domains: make(map[string]*domainRecipients),
+	}
+	for _, dc = range conf.DomainConfigs {
+		var dr = &domainRecipients{
+			config: dc,
+		}
+		var mailbox string
+
+		if len(dc.Mailboxes) > 0 || dc.RecipientTable != nil {
+			dr.mailboxes = make(map[string]bool)
+			dr.aliases = make(map[string][]string)
+		}
+		for _, mailbox = range dc.Mailboxes {
+			dr.mailboxes[strings.ToLower(mailbox)] = true
+		}
+		if dc.RecipientTable != nil {
+			dr.err = dr.readTable(dc.GetRecipientTable())
+		}
+
+		ret.domains[strings.ToLower(dc.GetDomainName())] = dr
+	}
+
+	return
+}
+
+// Read the recipient table at "path" into the domain data. Empty lines
+// and lines starting with # are ignored.
+func (self *domainRecipients) readTable(path string) error {
+	var f *os.File
+	var scanner *bufio.Scanner
+	var err error
+
+	f, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line string = strings.TrimSpace(scanner.Text())
+		var parts []string
+		var alias, target string
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		parts = strings.SplitN(line, ":", 2)
+		if len(parts) == 1 {
+			self.mailboxes[strings.ToLower(line)] = true
+			continue
+		}
+
+		alias = strings.ToLower(strings.TrimSpace(parts[0]))
+		for _, target = range strings.Split(parts[1], ",") {
+			target = strings.TrimSpace(target)
+			if len(target) > 0 {
+				self.aliases[alias] = append(self.aliases[alias], target)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Split "addr" into its local part and lower case domain.
+func splitAddress(addr string) (localpart, domain string, err error) {
+	var pos int = strings.LastIndex(addr, "@")
+
+	if pos <= 0 || pos == len(addr)-1 {
+		err = errors.New("Address " + addr + " lacks a domain")
+		return
+	}
+
+	localpart = addr[:pos]
+	domain = strings.ToLower(addr[pos+1:])
+	return
+}
+
+// Determine whether the local part "localpart" exists in the domain.
+// Subaddresses (user+detail) are accepted if the user exists.
+func (self *domainRecipients) hasRecipient(localpart string) bool {
+	var pos int
+
+	if self.mailboxes == nil {
+		return true
+	}
+
+	localpart = strings.ToLower(localpart)
+	if self.mailboxes[localpart] || len(self.aliases[localpart]) > 0 {
+		return true
+	}
+
+	pos = strings.Index(localpart, "+")
+	if pos > 0 {
+		return self.hasRecipient(localpart[:pos])
+	}
+	return false
+}
+
+// Look up the configuration of the domain of "addr". Returns nil if mail
+// for the domain isn't accepted.
+func (self *recipientTable) lookupDomain(addr string) *domainRecipients {
+	var domain string
+	var err error
+
+	_, domain, err = splitAddress(addr)
+	if err != nil {
+		return nil
+	}
+	return self.domains[domain]
+}
+
+// Determine the addresses mail to "addr" has to be delivered to, which
+// are the targets if "addr" is an alias. Targets without a domain are in
+// the domain of the alias.
+func (self *recipientTable) expand(addr string) []string {
+	var localpart, domain, target string
+	var dr *domainRecipients
+	var ret []string
+	var err error
+
+	localpart, domain, err = splitAddress(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	dr = self.domains[domain]
+	if dr == nil || len(dr.aliases[strings.ToLower(localpart)]) == 0 {
+		return []string{addr}
+	}
+
+	for _, target = range dr.aliases[strings.ToLower(localpart)] {
+		if !strings.Contains(target, "@") {
+			target += "@" + domain
+		}
+		ret = append(ret, target)
+	}
+	return ret
+}
+
+// Expand all recipients of "msg" and drop the duplicates among the
+// results. The DSN parameters of aliases are passed on to their targets,
+// with the alias as the original recipient unless one was given.
+func (self *recipientTable) expandEnvelope(
+	msg *mailpump.MailMessage) []string {
+	var seen = make(map[string]bool)
+	var ret []string
+	var rcpt, target string
+
+	for _, rcpt = range msg.SmtpTo {
+		var dsn *mailpump.DsnRecipientParameters = dsnParameters(msg, rcpt)
+
+		for _, target = range self.expand(rcpt) {
+			if seen[strings.ToLower(target)] {
+				continue
+			}
+			seen[strings.ToLower(target)] = true
+			ret = append(ret, target)
+
+			if target != rcpt {
+				var expanded = new(mailpump.DsnRecipientParameters)
+				var orcpt string = "rfc822;" + rcpt
+
+				if dsn != nil && dsn.OriginalRecipient != nil {
+					orcpt = dsn.GetOriginalRecipient()
+				}
+				expanded.Recipient = new(string)
+				*expanded.Recipient = target
+				expanded.Notify = dsn.GetNotify()
+				expanded.OriginalRecipient = &orcpt
+				msg.DsnRecipients = append(msg.DsnRecipients, expanded)
+			}
+		}
+	}
+	return ret
+}
+
+// Determine whether mail to "addr" should be accepted. Returns the SMTP
+// code and text to respond with.
+func (self *recipientTable) validate(addr string) (int32, string) {
+	var localpart string
+	var dr *domainRecipients
+	var err error
+
+	localpart, _, err = splitAddress(addr)
+	if err != nil {
+		return smtpump.SMTP_PARAMETER_ERROR, err.Error()
+	}
+
+	dr = self.lookupDomain(addr)
+	if dr == nil {
+		return smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl,
+			"Relaying denied."
+	}
+
+	if dr.err != nil {
+		return smtpump.SMTP_MAILBOX_UNAVAIL,
+			"Unable to verify recipient, try again later."
+	}
+
+	if !dr.hasRecipient(localpart) {
+		return smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl,
+			"No such user here."
+	}
+
+	return smtpump.SMTP_COMPLETED, "Ok."
+}
@@ -0,0 +1,149 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"expvar"
+	"net"
+	"strconv"
+	"strings"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Counts the results of sender checks.
+var sender_checks = expvar.NewMap("sender-checks")
+var spf_results = expvar.NewMap("spf-results")
+
+// Determine whether "addr" is matched by any of the "patterns". Patterns
+// starting with @ match the entire domain.
+func addressMatches(addr string, patterns []string) bool {
+	var pattern string
+
+	addr = strings.ToLower(addr)
+	for _, pattern = range patterns {
+		pattern = strings.ToLower(pattern)
+		if addr == pattern {
+			return true
+		}
+		if strings.HasPrefix(pattern, "@") &&
+			strings.HasSuffix(addr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether "ip" is contained in any of the "networks", given in
+// CIDR notation. Unparseable networks are ignored.
+func ipInNetworks(ip net.IP, networks []string) bool {
+	var network string
+
+	for _, network = range networks {
+		var ipnet *net.IPNet
+		var err error
+
+		_, ipnet, err = net.ParseCIDR(network)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the configured sender policies against the peer and sender in
+// "req", so mail can be refused before its content is transmitted.
+// Verdicts reached on the way are returned along with the result.
+func (self *MailSubmissionService) CheckSender(
+	req mailpump.SenderCheckRequest,
+	ret *mailpump.MailSubmissionResult) error {
+	var policy *mailpump.SenderPolicy = self.GetConfig().GetSenderPolicy()
+	var sender string = req.GetSmtpFrom()
+	var ip net.IP = net.ParseIP(req.GetSmtpPeer())
+	var code int32 = smtpump.SMTP_COMPLETED
+	var text string = "Ok."
+
+	defer func() {
+		sender_checks.Add(strconv.Itoa(int(code)), 1)
+		ret.ErrorCode = &code
+		ret.ErrorText = &text
+	}()
+
+	if ip != nil && ipInNetworks(ip, policy.GetBlockedNetworks()) {
+		code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+		text = "Access denied for " + ip.String() + "."
+		return nil
+	}
+
+	if len(sender) > 0 &&
+		addressMatches(sender, policy.GetBlockedSenders()) {
+		code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+		text = "Sender address rejected."
+		return nil
+	}
+
+	if len(req.GetAuthenticatedUser()) > 0 {
+		// Authenticated users are trusted to send as whoever they like
+		// from wherever they are.
+		return nil
+	}
+
+	if policy.GetRequireAuthForLocalSenders() && len(sender) > 0 &&
+		self.getRecipients().lookupDomain(sender) != nil {
+		code = smtpump.SMTP_ACCESS_DENIED
+		text = "Authentication required to send as " + sender + "."
+		return nil
+	}
+
+	if ip != nil {
+		var result string = checkSPF(self.getResolver(), ip,
+			req.GetSmtpHelo(), sender)
+		var verdict = mailpump.QualityVerdict_OK
+
+		spf_results.Add(result, 1)
+		if result == SPF_FAIL {
+			verdict = mailpump.QualityVerdict_SPAM
+		}
+		ret.Verdicts = append(ret.Verdicts, mailpump.NewVerdict("SPF",
+			verdict, "SPF result for "+ip.String()+": "+result))
+
+		if result == SPF_FAIL && policy.GetRejectSpfFail() {
+			code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+			text = "SPF policy of the sender domain doesn't permit " +
+				"mail from " + ip.String() + "."
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/resolver"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Error indicating that the destination can't receive mail at all.
+type permanentError struct {
+	text string
+}
+
+func (self *permanentError) Error() string {
+	return self.text
+}
+
+// Error indicating that STARTTLS failed on the connection, so another
+// attempt without TLS might succeed.
+type startTLSError struct {
+	err error
+}
+
+func (self *startTLSError) Error() string {
+	return "STARTTLS failed: " + self.err.Error()
+}
+
+// Determine the hosts to deliver mail for "route" to, in the order they
+// should be tried. These are host:port pairs.
+func smtpHosts(res resolver.Resolver, route *deliveryRoute,
+	timeout time.Duration) ([]string, error) {
+	var ctx, cancel = resolver.WithTimeout(timeout)
+	var mxs []*net.MX
+	var mx *net.MX
+	var ret []string
+	var err error
+
+	defer cancel()
+
+	if len(route.destination) > 0 {
+		if _, _, err = net.SplitHostPort(route.destination); err == nil {
+			return []string{route.destination}, nil
+		}
+		return []string{net.JoinHostPort(route.destination, "25")}, nil
+	}
+
+	mxs, err = res.LookupMX(ctx, route.domain)
+	if resolver.IsNotFound(err) || (err == nil && len(mxs) == 0) {
+		// Without MX records, the domain itself receives the mail
+		// (RFC 5321, section 5.1). Resolvers don't tell a name without
+		// MX records apart from one which doesn't exist, so check
+		// whether it has any addresses; if not, it never will accept
+		// mail from us.
+		_, err = res.LookupHost(ctx, route.domain)
+		if resolver.IsNotFound(err) {
+			return nil, &permanentError{
+				"Domain " + route.domain + " doesn't exist."}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []string{net.JoinHostPort(route.domain, "25")}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mx = range mxs {
+		var host string = strings.TrimSuffix(mx.Host, ".")
+
+		if len(host) == 0 {
+			// Null MX (RFC 7505): the domain doesn't accept mail.
+			return nil, &permanentError{
+				"Domain " + route.domain + " doesn't accept mail."}
+		}
+		ret = append(ret, net.JoinHostPort(host, "25"))
+	}
+	return ret, nil
+}
+
+// Connect to the SMTP server at "hostport", using "res" to resolve
+// its name. All addresses of the host are tried in turn.
+func dialSMTP(res resolver.Resolver, hostport string,
+	timeout time.Duration) (net.Conn, error) {
+	var ctx, cancel = resolver.WithTimeout(timeout)
+	var host, port, addr string
+	var addrs []string
+	var conn net.Conn
+	var err error
+
+	defer cancel()
+
+	host, port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		addrs = []string{host}
+	} else if addrs, err = res.LookupHost(ctx, host); err != nil {
+		return nil, err
+	}
+
+	for _, addr = range addrs {
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(addr, port),
+			timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("No addresses found for " + host)
+	}
+	return nil, err
+}
+
+// Determine the SMTP code and text of the error "err" returned by the
+// server "host". Errors which aren't SMTP replies are temporary.
+func smtpErrorStatus(err error, host string) (int32, string) {
+	var perr *permanentError
+	var tperr *textproto.Error
+	var ok bool
+
+	if perr, ok = err.(*permanentError); ok {
+		return smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl, perr.text
+	}
+	if tperr, ok = err.(*textproto.Error); ok {
+		// Replies spanning several lines are joined by line breaks.
+		return int32(tperr.Code), host + " said: " +
+			strings.Replace(tperr.Msg, "\n", " ", -1)
+	}
+	if len(host) > 0 {
+		return smtpump.SMTP_LOCALERR, "Error talking to " + host + ": " +
+			err.Error()
+	}
+	return smtpump.SMTP_LOCALERR, err.Error()
+}
+
+// Retrieve the name to introduce ourselves with in HELO.
+func (self *MailSubmissionService) heloName() string {
+	var name string = self.GetConfig().GetHeloName()
+	var err error
+
+	if len(name) > 0 {
+		return name
+	}
+	if name, err = os.Hostname(); err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// Transmit "msg" to the recipients of "route" over an SMTP session with
+// "hostport". Unless "plaintext" is set, STARTTLS is used if the server
+// offers it. Returns the status of each recipient, or an error if the
+// session failed before any recipient could be dealt with.
+func (self *MailSubmissionService) smtpSession(hostport string,
+	route *deliveryRoute, msg *mailpump.MailMessage,
+	timeout time.Duration, plaintext bool) (
+	[]*mailpump.RecipientStatus, error) {
+	var host string
+	var conn net.Conn
+	var client *smtp.Client
+	var statuses []*mailpump.RecipientStatus
+	var accepted []*mailpump.RecipientStatus
+	var status *mailpump.RecipientStatus
+	var rcpt string
+	var w io.WriteCloser
+	var err error
+
+	host, _, _ = net.SplitHostPort(hostport)
+	conn, err = dialSMTP(self.getResolver(), hostport, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err = smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer client.Close()
+
+	if err = client.Hello(self.heloName()); err != nil {
+		return nil, err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !plaintext {
+		var config = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: !route.requireTls,
+		}
+		if err = client.StartTLS(config); err != nil {
+			return nil, &startTLSError{err}
+		}
+	} else if route.requireTls {
+		delivery_errors.Add("tls-unavailable", 1)
+		return nil, errors.New(host + " doesn't offer STARTTLS")
+	}
+
+	if err = client.Mail(msg.GetSmtpFrom()); err != nil {
+		return nil, err
+	}
+
+	for _, rcpt = range route.recipients {
+		if err = client.Rcpt(rcpt); err != nil {
+			var code int32
+			var text string
+
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			code, text = smtpErrorStatus(err, host)
+			statuses = append(statuses,
+				newRecipientStatus(rcpt, code, text, host))
+			continue
+		}
+		accepted = append(accepted, newRecipientStatus(rcpt,
+			smtpump.SMTP_COMPLETED, "", host))
+	}
+
+	if len(accepted) == 0 {
+		client.Quit()
+		return statuses, nil
+	}
+
+	if w, err = client.Data(); err == nil {
+		if _, err = w.Write(msg.RawBytes()); err == nil {
+			err = w.Close()
+		}
+	}
+	for _, status = range accepted {
+		if err != nil {
+			*status.Code, *status.Text = smtpErrorStatus(err, host)
+		} else {
+			*status.Text = host + " accepted the message."
+		}
+	}
+	if err == nil {
+		client.Quit()
+	}
+	return append(statuses, accepted...), nil
+}
+
+// Deliver "msg" via SMTP to the recipients of "route". The hosts are
+// tried in turn until one of them accepts or rejects the message
+// permanently.
+func (self *MailSubmissionService) deliverSMTP(route *deliveryRoute,
+	msg *mailpump.MailMessage) []*mailpump.RecipientStatus {
+	var timeout = time.Duration(self.GetConfig().GetDeliveryTimeout()) *
+		time.Second
+	var hosts []string
+	var hostport string
+	var code int32
+	var text, host string
+	var err error
+
+	hosts, err = smtpHosts(self.getResolver(), route, timeout)
+	if err != nil {
+		delivery_errors.Add("lookup", 1)
+		code, text = smtpErrorStatus(err, "")
+		return failAll(route.recipients, code, text, "")
+	}
+
+	for _, hostport = range hosts {
+		var statuses []*mailpump.RecipientStatus
+
+		host, _, _ = net.SplitHostPort(hostport)
+		statuses, err = self.smtpSession(hostport, route, msg, timeout,
+			false)
+		if _, ok := err.(*startTLSError); ok && !route.requireTls {
+			// Plain text is better than not delivering at all.
+			delivery_errors.Add("tls-failed", 1)
+			log.Print("Retrying delivery to ", hostport,
+				" without TLS: ", err)
+			statuses, err = self.smtpSession(hostport, route, msg,
+				timeout, true)
+		}
+		if err == nil {
+			return statuses
+		}
+
+		code, text = smtpErrorStatus(err, host)
+		if _, ok := err.(*textproto.Error); ok {
+			delivery_errors.Add("smtp-"+strconv.Itoa(int(code)), 1)
+		} else {
+			delivery_errors.Add("connection", 1)
+		}
+		if code >= 500 {
+			break
+		}
+	}
+
+	return failAll(route.recipients, code, text, host)
+}
@@ -0,0 +1,603 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump/resolver"
+)
+
+// Results of an SPF evaluation as defined in RFC 7208, section 2.6.
+const (
+	SPF_NONE      = "none"
+	SPF_NEUTRAL   = "neutral"
+	SPF_PASS      = "pass"
+	SPF_FAIL      = "fail"
+	SPF_SOFTFAIL  = "softfail"
+	SPF_TEMPERROR = "temperror"
+	SPF_PERMERROR = "permerror"
+)
+
+// Maximum number of mechanisms and modifiers causing DNS lookups which
+// may be evaluated for a single check (RFC 7208, section 4.6.4).
+const spfMaxLookups = 10
+
+// Maximum number of DNS lookups returning no records.
+const spfMaxVoidLookups = 2
+
+// Maximum time to spend on a single SPF evaluation (RFC 7208, section
+// 4.6.4 suggests at least 20 seconds).
+const spfTimeout = 20 * time.Second
+
+var errSPFPermError = errors.New(SPF_PERMERROR)
+var errSPFTempError = errors.New(SPF_TEMPERROR)
+
+// State of a single SPF evaluation.
+type spfCheck struct {
+	ip       net.IP
+	helo     string
+	sender   string
+	resolver resolver.Resolver
+	ctx      context.Context
+
+	lookups     int
+	voidLookups int
+}
+
+// Evaluate the SPF policy of the domain of "sender" for mail from "ip".
+// If the sender is empty (bounces), the HELO name is checked instead.
+// All lookups are done through "res".
+func checkSPF(res resolver.Resolver, ip net.IP, helo, sender string) string {
+	var check *spfCheck
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var domain string
+	var pos int
+
+	if len(sender) == 0 {
+		sender = "postmaster@" + helo
+	}
+	pos = strings.LastIndex(sender, "@")
+	if pos < 0 {
+		sender = "postmaster@" + sender
+		pos = strings.LastIndex(sender, "@")
+	}
+	domain = strings.ToLower(sender[pos+1:])
+
+	ctx, cancel = resolver.WithTimeout(spfTimeout)
+	defer cancel()
+
+	check = &spfCheck{
+		ip:       ip,
+		helo:     helo,
+		sender:   sender,
+		resolver: res,
+		ctx:      ctx,
+	}
+	return check.checkHost(domain)
+}
+
+// Fetch the SPF record of "domain". Returns an empty string if there is
+// none.
+func (self *spfCheck) getRecord(domain string) (string, error) {
+	var txts []string
+	var txt, record string
+	var err error
+
+	txts, err = self.resolver.LookupTXT(self.ctx, domain)
+	if resolver.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errSPFTempError
+	}
+
+	for _, txt = range txts {
+		if txt == "v=spf1" || strings.HasPrefix(txt, "v=spf1 ") {
+			if len(record) > 0 {
+				// Multiple records are an error (section 4.5).
+				return "", errSPFPermError
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// The check_host() function of RFC 7208, section 4.
+func (self *spfCheck) checkHost(domain string) string {
+	var record, term, redirect string
+	var terms []string
+	var err error
+
+	record, err = self.getRecord(domain)
+	if err != nil {
+		return err.Error()
+	}
+	if len(record) == 0 {
+		return SPF_NONE
+	}
+
+	terms = strings.Fields(record)[1:]
+	for _, term = range terms {
+		var qualifier byte = '+'
+		var name, arg string
+		var match bool
+		var pos int
+
+		// Modifiers are processed after all mechanisms.
+		pos = strings.Index(term, "=")
+		if pos > 0 && !strings.ContainsAny(term[:pos], ":/") {
+			if strings.ToLower(term[:pos]) == "redirect" {
+				if len(redirect) > 0 {
+					return SPF_PERMERROR
+				}
+				redirect = term[pos+1:]
+			}
+			continue
+		}
+
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier = term[0]
+			term = term[1:]
+		}
+
+		name = term
+		pos = strings.IndexAny(term, ":/")
+		if pos >= 0 {
+			name = term[:pos]
+			arg = term[pos:]
+		}
+
+		match, err = self.matchMechanism(strings.ToLower(name), arg, domain)
+		if err != nil {
+			return err.Error()
+		}
+		if match {
+			switch qualifier {
+			case '-':
+				return SPF_FAIL
+			case '~':
+				return SPF_SOFTFAIL
+			case '?':
+				return SPF_NEUTRAL
+			default:
+				return SPF_PASS
+			}
+		}
+	}
+
+	if len(redirect) > 0 {
+		var target string
+		var result string
+
+		if err = self.countLookup(); err != nil {
+			return err.Error()
+		}
+		target, err = self.expand(redirect, domain)
+		if err != nil {
+			return err.Error()
+		}
+		result = self.checkHost(target)
+		if result == SPF_NONE {
+			return SPF_PERMERROR
+		}
+		return result
+	}
+
+	return SPF_NEUTRAL
+}
+
+// Account for a term requiring DNS lookups.
+func (self *spfCheck) countLookup() error {
+	self.lookups++
+	if self.lookups > spfMaxLookups {
+		return errSPFPermError
+	}
+	return nil
+}
+
+// Account for a DNS lookup which returned no records.
+func (self *spfCheck) countVoidLookup() error {
+	self.voidLookups++
+	if self.voidLookups > spfMaxVoidLookups {
+		return errSPFPermError
+	}
+	return nil
+}
+
+// Split the argument of a mechanism into the domain spec and the CIDR
+// prefix lengths for IPv4 and IPv6.
+func (self *spfCheck) parseDomainCIDR(arg, domain string) (
+	target string, v4len, v6len int, err error) {
+	var cidr string
+	var pos int
+
+	v4len = 32
+	v6len = 128
+	target = domain
+
+	pos = strings.Index(arg, "/")
+	if pos >= 0 {
+		cidr = arg[pos:]
+		arg = arg[:pos]
+	}
+	if strings.HasPrefix(arg, ":") {
+		target, err = self.expand(arg[1:], domain)
+		if err != nil {
+			return
+		}
+	} else if len(arg) > 0 {
+		err = errSPFPermError
+		return
+	}
+
+	if len(cidr) > 0 {
+		var parts []string = strings.Split(cidr[1:], "/")
+		if len(parts[0]) > 0 {
+			v4len, err = strconv.Atoi(parts[0])
+			if err != nil || v4len < 0 || v4len > 32 {
+				err = errSPFPermError
+				return
+			}
+		}
+		if len(parts) > 2 || (len(parts) == 2 && len(parts[1]) > 0) {
+			if len(parts) > 2 {
+				err = errSPFPermError
+				return
+			}
+			v6len, err = strconv.Atoi(parts[1])
+			if err != nil || v6len < 0 || v6len > 128 {
+				err = errSPFPermError
+				return
+			}
+		}
+	}
+	return
+}
+
+// Determine whether "ip" is within "prefix" of "other".
+func (self *spfCheck) ipMatches(other net.IP, v4len, v6len int) bool {
+	var mask net.IPMask
+
+	if self.ip.To4() != nil {
+		if other.To4() == nil {
+			return false
+		}
+		mask = net.CIDRMask(v4len, 32)
+		return self.ip.To4().Mask(mask).Equal(other.To4().Mask(mask))
+	}
+	if other.To4() != nil {
+		return false
+	}
+	mask = net.CIDRMask(v6len, 128)
+	return self.ip.Mask(mask).Equal(other.Mask(mask))
+}
+
+// Look up the addresses of "host" and match them against the peer.
+func (self *spfCheck) matchHost(host string, v4len, v6len int) (
+	bool, error) {
+	var addrs []string
+	var addr string
+	var err error
+
+	addrs, err = self.resolver.LookupHost(self.ctx, host)
+	if resolver.IsNotFound(err) {
+		return false, self.countVoidLookup()
+	} else if err != nil {
+		return false, errSPFTempError
+	}
+
+	for _, addr = range addrs {
+		var ip net.IP = net.ParseIP(addr)
+		if ip != nil && self.ipMatches(ip, v4len, v6len) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Determine whether the mechanism "name" with the argument "arg"
+// matches the peer.
+func (self *spfCheck) matchMechanism(name, arg, domain string) (
+	bool, error) {
+	var target string
+	var v4len, v6len int
+	var err error
+
+	switch name {
+	case "all":
+		if len(arg) > 0 {
+			return false, errSPFPermError
+		}
+		return true, nil
+	case "include":
+		var result string
+
+		if err = self.countLookup(); err != nil {
+			return false, err
+		}
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPermError
+		}
+		target, err = self.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		result = self.checkHost(target)
+		switch result {
+		case SPF_PASS:
+			return true, nil
+		case SPF_TEMPERROR:
+			return false, errSPFTempError
+		case SPF_PERMERROR, SPF_NONE:
+			return false, errSPFPermError
+		}
+		return false, nil
+	case "a":
+		if err = self.countLookup(); err != nil {
+			return false, err
+		}
+		target, v4len, v6len, err = self.parseDomainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		return self.matchHost(target, v4len, v6len)
+	case "mx":
+		var mxs []*net.MX
+		var mx *net.MX
+
+		if err = self.countLookup(); err != nil {
+			return false, err
+		}
+		target, v4len, v6len, err = self.parseDomainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err = self.resolver.LookupMX(self.ctx, target)
+		if resolver.IsNotFound(err) {
+			return false, self.countVoidLookup()
+		} else if err != nil {
+			return false, errSPFTempError
+		}
+		if len(mxs) > spfMaxLookups {
+			return false, errSPFPermError
+		}
+		for _, mx = range mxs {
+			var match bool
+			match, err = self.matchHost(mx.Host, v4len, v6len)
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		var names []string
+		var ptrname string
+
+		if err = self.countLookup(); err != nil {
+			return false, err
+		}
+		target, _, _, err = self.parseDomainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		names, _ = self.resolver.LookupAddr(self.ctx, self.ip.String())
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for _, ptrname = range names {
+			var match bool
+			ptrname = strings.ToLower(strings.TrimSuffix(ptrname, "."))
+			if ptrname != target &&
+				!strings.HasSuffix(ptrname, "."+target) {
+				continue
+			}
+			match, err = self.matchHost(ptrname, 32, 128)
+			if err == nil && match {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ip4", "ip6":
+		var network *net.IPNet
+		var ip net.IP
+
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPermError
+		}
+		arg = arg[1:]
+		if !strings.Contains(arg, "/") {
+			ip = net.ParseIP(arg)
+			if ip == nil {
+				return false, errSPFPermError
+			}
+			return self.ip.Equal(ip), nil
+		}
+		_, network, err = net.ParseCIDR(arg)
+		if err != nil {
+			return false, errSPFPermError
+		}
+		return network.Contains(self.ip), nil
+	case "exists":
+		var addrs []string
+
+		if err = self.countLookup(); err != nil {
+			return false, err
+		}
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPermError
+		}
+		target, err = self.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err = self.resolver.LookupHost(self.ctx, target)
+		if resolver.IsNotFound(err) {
+			return false, self.countVoidLookup()
+		} else if err != nil {
+			return false, errSPFTempError
+		}
+		return len(addrs) > 0, nil
+	}
+
+	return false, errSPFPermError
+}
+
+// Expand the macros in "spec" (RFC 7208, section 7).
+func (self *spfCheck) expand(spec, domain string) (string, error) {
+	var ret []byte
+	var i int
+
+	for i = 0; i < len(spec); i++ {
+		var end int
+		var value string
+
+		if spec[i] != '%' {
+			ret = append(ret, spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPermError
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			ret = append(ret, '%')
+			continue
+		case '_':
+			ret = append(ret, ' ')
+			continue
+		case '-':
+			ret = append(ret, "%20"...)
+			continue
+		case '{':
+		default:
+			return "", errSPFPermError
+		}
+
+		end = strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPermError
+		}
+		value = self.expandMacro(spec[i+1:i+end], domain)
+		if len(value) == 0 && spec[i+1] != 'v' {
+			return "", errSPFPermError
+		}
+		ret = append(ret, value...)
+		i += end
+	}
+
+	return string(ret), nil
+}
+
+// Expand a single macro, e.g. "ir" or "d2".
+func (self *spfCheck) expandMacro(macro, domain string) string {
+	var value string
+	var parts []string
+	var num, pos int
+	var reverse bool
+	var delims string = "."
+
+	switch macro[0] {
+	case 's', 'S':
+		value = self.sender
+	case 'l', 'L':
+		pos = strings.LastIndex(self.sender, "@")
+		value = self.sender[:pos]
+	case 'o', 'O':
+		pos = strings.LastIndex(self.sender, "@")
+		value = self.sender[pos+1:]
+	case 'd', 'D':
+		value = domain
+	case 'h', 'H':
+		value = self.helo
+	case 'v', 'V':
+		if self.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case 'i', 'I':
+		if self.ip.To4() != nil {
+			value = self.ip.To4().String()
+		} else {
+			value = nibbles(self.ip)
+		}
+	default:
+		return ""
+	}
+
+	macro = macro[1:]
+	for len(macro) > 0 && macro[0] >= '0' && macro[0] <= '9' {
+		num = num*10 + int(macro[0]-'0')
+		macro = macro[1:]
+	}
+	if len(macro) > 0 && (macro[0] == 'r' || macro[0] == 'R') {
+		reverse = true
+		macro = macro[1:]
+	}
+	if len(macro) > 0 {
+		delims = macro
+	}
+
+	parts = strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		var i int
+		for i = 0; i < len(parts)/2; i++ {
+			parts[i], parts[len(parts)-1-i] = parts[len(parts)-1-i],
+				parts[i]
+		}
+	}
+	if num > 0 && num < len(parts) {
+		parts = parts[len(parts)-num:]
+	}
+	return strings.Join(parts, ".")
+}
+
+// Convert an IPv6 address into dot separated nibbles, as used in
+// ip6.arpa names (without reversing them).
+func nibbles(ip net.IP) string {
+	var ret []string
+	var b byte
+	const hex = "0123456789abcdef"
+
+	for _, b = range ip.To16() {
+		ret = append(ret, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(ret, ".")
+}
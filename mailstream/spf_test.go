@@ -0,0 +1,162 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"ancient-solutions.com/mailpump/resolver"
+)
+
+// Zone holding the SPF policies used by the tests below.
+func spfTestZone() *resolver.Zone {
+	var zone *resolver.Zone = resolver.NewZone()
+
+	zone.AddTXT("example.com", "v=spf1 ip4:192.0.2.0/24 -all")
+	zone.AddTXT("example.com", "some other text record")
+	zone.AddTXT("a.example", "v=spf1 a -all")
+	zone.AddHost("a.example", "192.0.2.10")
+	zone.AddTXT("mx.example", "v=spf1 mx ~all")
+	zone.AddMX("mx.example", "mail.mx.example.", 10)
+	zone.AddHost("mail.mx.example", "198.51.100.20")
+	zone.AddTXT("include.example", "v=spf1 include:example.com ?all")
+	zone.AddTXT("redirect.example", "v=spf1 redirect=example.com")
+	zone.AddTXT("ip6.example", "v=spf1 ip6:2001:db8::/32 -all")
+	zone.AddTXT("twice.example", "v=spf1 -all")
+	zone.AddTXT("twice.example", "v=spf1 +all")
+	zone.AddTXT("loop.example", "v=spf1 include:loop.example -all")
+	zone.AddTXT("void.example", "v=spf1 a:n1.void.example "+
+		"a:n2.void.example a:n3.void.example -all")
+	zone.AddTXT("exists.example", "v=spf1 exists:%{i}.list.example -all")
+	zone.AddHost("192.0.2.7.list.example", "127.0.0.2")
+	zone.AddTXT("unknown.example", "v=spf1 frobnicate -all")
+	zone.AddTXT("broken.example", "v=spf1 include:down.example -all")
+	zone.SetError("down.example", errors.New("server failure"))
+	zone.SetError("timeout.example", errors.New("server failure"))
+	return zone
+}
+
+func TestCheckSPF(t *testing.T) {
+	var zone *resolver.Zone = spfTestZone()
+	var tests = []struct {
+		ip, helo, sender string
+		expected         string
+	}{
+		{"192.0.2.5", "mx.example.com", "user@example.com", SPF_PASS},
+		{"198.51.100.1", "mx.example.com", "user@example.com", SPF_FAIL},
+		{"192.0.2.5", "mx.example.com", "user@none.example", SPF_NONE},
+		{"192.0.2.10", "a.example", "user@a.example", SPF_PASS},
+		{"192.0.2.11", "a.example", "user@a.example", SPF_FAIL},
+		{"198.51.100.20", "mx.example", "user@mx.example", SPF_PASS},
+		{"198.51.100.21", "mx.example", "user@mx.example", SPF_SOFTFAIL},
+		{"192.0.2.5", "x", "user@include.example", SPF_PASS},
+		{"198.51.100.1", "x", "user@include.example", SPF_NEUTRAL},
+		{"198.51.100.1", "x", "user@redirect.example", SPF_FAIL},
+		{"2001:db8::1", "x", "user@ip6.example", SPF_PASS},
+		{"2001:db9::1", "x", "user@ip6.example", SPF_FAIL},
+		{"192.0.2.5", "x", "user@ip6.example", SPF_FAIL},
+		{"192.0.2.7", "x", "user@exists.example", SPF_PASS},
+		{"192.0.2.8", "x", "user@exists.example", SPF_FAIL},
+		// Bounces are checked against the HELO name.
+		{"192.0.2.5", "example.com", "", SPF_PASS},
+		{"198.51.100.1", "example.com", "", SPF_FAIL},
+		// Errors.
+		{"192.0.2.5", "x", "user@twice.example", SPF_PERMERROR},
+		{"192.0.2.5", "x", "user@loop.example", SPF_PERMERROR},
+		{"192.0.2.5", "x", "user@void.example", SPF_PERMERROR},
+		{"192.0.2.5", "x", "user@unknown.example", SPF_PERMERROR},
+		{"192.0.2.5", "x", "user@broken.example", SPF_TEMPERROR},
+		{"192.0.2.5", "x", "user@timeout.example", SPF_TEMPERROR},
+	}
+	var i int
+
+	for i = range tests {
+		var result string = checkSPF(zone, net.ParseIP(tests[i].ip),
+			tests[i].helo, tests[i].sender)
+		if result != tests[i].expected {
+			t.Errorf("checkSPF(%s, %s, %q) = %s, expected %s",
+				tests[i].ip, tests[i].helo, tests[i].sender, result,
+				tests[i].expected)
+		}
+	}
+}
+
+func TestExpandSPFMacros(t *testing.T) {
+	var check = &spfCheck{
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mail.example.org",
+		sender: "strong-bad@email.example.com",
+	}
+	var tests = []struct {
+		spec, expected string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{h}", "mail.example.org"},
+		{"%%%_%-", "% %20"},
+	}
+	var spec string
+	var i int
+	var err error
+
+	for i = range tests {
+		var result string
+
+		result, err = check.expand(tests[i].spec, "email.example.com")
+		if err != nil {
+			t.Errorf("expand(%q) failed: %v", tests[i].spec, err)
+		} else if result != tests[i].expected {
+			t.Errorf("expand(%q) = %q, expected %q", tests[i].spec,
+				result, tests[i].expected)
+		}
+	}
+
+	for _, spec = range []string{"%", "%x", "%{", "%{}", "%{q}"} {
+		if _, err = check.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("expand(%q) succeeded unexpectedly", spec)
+		}
+	}
+}
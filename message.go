@@ -0,0 +1,125 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailpump
+
+import (
+	"bytes"
+)
+
+// Split the header block off the raw message "raw". Returns the headers
+// in the order they appear, with folded values unfolded, and the offset
+// at which the body starts. Lines in the header block which aren't
+// headers are skipped.
+func SplitHeaders(raw []byte) ([]*MailMessage_MailHeader, int) {
+	var headers []*MailMessage_MailHeader
+	var current *MailMessage_MailHeader
+	var offset int
+
+	for offset < len(raw) {
+		var line []byte
+		var end int = bytes.IndexByte(raw[offset:], '\n')
+		var colon int
+
+		if end < 0 {
+			line = raw[offset:]
+			end = len(raw)
+		} else {
+			end += offset + 1
+			line = raw[offset:end]
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		if len(line) == 0 {
+			// Empty line: the body starts after it.
+			return headers, end
+		}
+		offset = end
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of the previous header.
+			if current != nil {
+				current.Value[0] += string(line)
+			}
+			continue
+		}
+
+		colon = bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			current = nil
+			continue
+		}
+		current = new(MailMessage_MailHeader)
+		current.Name = new(string)
+		*current.Name = string(bytes.TrimRight(line[:colon], " \t"))
+		current.Value = []string{
+			string(bytes.TrimLeft(line[colon+1:], " \t"))}
+		headers = append(headers, current)
+	}
+
+	return headers, len(raw)
+}
+
+// Retrieve the body of the message, whether it was transmitted raw or
+// separately.
+func (self *MailMessage) BodyBytes() []byte {
+	var offset int64 = self.GetBodyOffset()
+
+	if self.RawMessage == nil {
+		return self.Body
+	}
+	if offset < 0 || offset > int64(len(self.RawMessage)) {
+		return nil
+	}
+	return self.RawMessage[offset:]
+}
+
+// Retrieve the message as it was sent by the client. For messages
+// without raw_message, an approximation is built from the headers and
+// the body.
+func (self *MailMessage) RawBytes() []byte {
+	var buf bytes.Buffer
+	var hdr *MailMessage_MailHeader
+	var value string
+
+	if self.RawMessage != nil {
+		return self.RawMessage
+	}
+
+	for _, hdr = range self.Headers {
+		for _, value = range hdr.Value {
+			buf.WriteString(hdr.GetName() + ": " + value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(self.Body)
+	return buf.Bytes()
+}
@@ -0,0 +1,289 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Export of expvar counters and latency histograms in the Prometheus text
+// exposition format. Importing this package registers the handler under
+// /metrics of the default HTTP server, just like expvar does for
+// /debug/vars.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket boundaries (in seconds) suitable for most request latencies.
+var DefaultBuckets = []float64{
+	.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// Observations of a histogram for one label value.
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram of observed values, optionally split up by the value of a
+// single label.
+type Histogram struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mtx     sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+var histograms_mtx sync.Mutex
+var histograms = make(map[string]*Histogram)
+
+// Create a new histogram named "name" which is exported under /metrics.
+// "buckets" are the upper bounds of the buckets, in ascending order.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, "", buckets)
+}
+
+// Create a new histogram named "name" whose observations are split up by
+// the value of the label "label".
+func NewHistogramVec(name, help, label string,
+	buckets []float64) *Histogram {
+	var ret = &Histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+
+	histograms_mtx.Lock()
+	defer histograms_mtx.Unlock()
+	if _, ok := histograms[name]; ok {
+		panic("Reuse of histogram name " + name)
+	}
+	histograms[name] = ret
+	return ret
+}
+
+// Record the value "v".
+func (self *Histogram) Observe(v float64) {
+	self.ObserveWithLabel("", v)
+}
+
+// Record the value "v" for the label value "value".
+func (self *Histogram) ObserveWithLabel(value string, v float64) {
+	var series *histogramSeries
+	var i int
+	var ok bool
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	if series, ok = self.series[value]; !ok {
+		series = &histogramSeries{counts: make([]uint64, len(self.buckets))}
+		self.series[value] = series
+	}
+
+	i = sort.SearchFloat64s(self.buckets, v)
+	if i < len(self.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += v
+}
+
+// Record the time passed since "start", in seconds.
+func (self *Histogram) ObserveSince(start time.Time) {
+	self.Observe(time.Now().Sub(start).Seconds())
+}
+
+// Record the time passed since "start", in seconds, for the label value
+// "value".
+func (self *Histogram) ObserveSinceWithLabel(value string, start time.Time) {
+	self.ObserveWithLabel(value, time.Now().Sub(start).Seconds())
+}
+
+// Write all observations in the text exposition format to "w".
+func (self *Histogram) write(w *bufio.Writer) {
+	var values []string
+	var value string
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", self.name, escapeHelp(self.help))
+	fmt.Fprintf(w, "# TYPE %s histogram\n", self.name)
+
+	for value = range self.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value = range values {
+		var series *histogramSeries = self.series[value]
+		var labels string
+		var cumulative uint64
+		var i int
+
+		if len(self.label) > 0 {
+			labels = self.label + "=\"" + escapeLabel(value) + "\","
+		}
+
+		for i = range self.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", self.name, labels,
+				formatFloat(self.buckets[i]), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", self.name, labels,
+			series.count)
+
+		labels = strings.TrimSuffix(labels, ",")
+		if len(labels) > 0 {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", self.name, labels,
+			formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", self.name, labels, series.count)
+	}
+}
+
+// Convert an expvar name into a valid metric name.
+func metricName(name string) string {
+	var ret = []byte(name)
+	var i int
+
+	for i = range ret {
+		var c byte = ret[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+			!(c >= '0' && c <= '9' && i > 0) && c != '_' && c != ':' {
+			ret[i] = '_'
+		}
+	}
+	return string(ret)
+}
+
+// Escape the value of a label in the text exposition format.
+func escapeLabel(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+// Escape the help text of a metric in the text exposition format.
+func escapeHelp(help string) string {
+	help = strings.Replace(help, "\\", "\\\\", -1)
+	return strings.Replace(help, "\n", "\\n", -1)
+}
+
+// Format a floating point number the way Prometheus expects it.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write the expvar variable "kv" in the text exposition format, if it
+// has a representation there. Integers and floats are exported as
+// untyped values since expvar doesn't tell counters and gauges apart;
+// maps are exported with their keys in the label "key".
+func writeExpvar(w *bufio.Writer, kv expvar.KeyValue) {
+	var name string = metricName(kv.Key)
+
+	switch v := kv.Value.(type) {
+	case *expvar.Int, *expvar.Float:
+		fmt.Fprintf(w, "# TYPE %s untyped\n", name)
+		fmt.Fprintf(w, "%s %s\n", name, v.String())
+	case *expvar.Map:
+		var header bool
+
+		v.Do(func(entry expvar.KeyValue) {
+			switch entry.Value.(type) {
+			case *expvar.Int, *expvar.Float:
+				if !header {
+					fmt.Fprintf(w, "# TYPE %s untyped\n", name)
+					header = true
+				}
+				fmt.Fprintf(w, "%s{key=\"%s\"} %s\n", name,
+					escapeLabel(entry.Key), entry.Value.String())
+			}
+		})
+	}
+}
+
+// Write all expvar variables and histograms in the Prometheus text
+// exposition format.
+func ServeMetrics(rw http.ResponseWriter, req *http.Request) {
+	var w *bufio.Writer = bufio.NewWriter(rw)
+	var names []string
+	var name string
+	var sorted []*Histogram
+	var h *Histogram
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		writeExpvar(w, kv)
+	})
+
+	histograms_mtx.Lock()
+	for name = range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name = range names {
+		sorted = append(sorted, histograms[name])
+	}
+	histograms_mtx.Unlock()
+
+	for _, h = range sorted {
+		h.write(w)
+	}
+
+	w.Flush()
+}
+
+func init() {
+	http.HandleFunc("/metrics", ServeMetrics)
+}
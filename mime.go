@@ -0,0 +1,365 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailpump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Limits protecting the MIME parser against messages built to exhaust
+// its resources, such as deeply nested multiparts.
+type MimeLimits struct {
+	// Maximum nesting depth of multiparts and encapsulated messages.
+	// Deeper parts are not analyzed any further.
+	MaxDepth int
+
+	// Maximum number of parts to analyze in total.
+	MaxParts int
+}
+
+// Limits which are sufficient for any legitimate message.
+var DefaultMimeLimits = MimeLimits{
+	MaxDepth: 16,
+	MaxParts: 1000,
+}
+
+// State of the analysis of a single message.
+type mimeParser struct {
+	raw    []byte
+	limits MimeLimits
+	parts  int
+}
+
+// Determine the MIME structure of the raw message "raw", as far as
+// "limits" permit. Malformed parts are analyzed as well as possible and
+// the problems are recorded in their errors.
+func ParseMimeStructure(raw []byte, limits MimeLimits) *MimePart {
+	var parser = &mimeParser{
+		raw:    raw,
+		limits: limits,
+	}
+	return parser.parsePart(0, len(raw), 0, "text/plain")
+}
+
+// Allocate a new int64 with the value "v".
+func int64p(v int) *int64 {
+	var ret = new(int64)
+	*ret = int64(v)
+	return ret
+}
+
+// Allocate a new string with the value "v".
+func stringp(v string) *string {
+	var ret = new(string)
+	*ret = v
+	return ret
+}
+
+// Record the problem "problem" with "part", unless it's already known.
+func addMimeError(part *MimePart, problem string) {
+	var known string
+
+	for _, known = range part.Errors {
+		if known == problem {
+			return
+		}
+	}
+	part.Errors = append(part.Errors, problem)
+}
+
+// Retrieve the value of the first header named "name" in "headers".
+func findHeader(headers []*MailMessage_MailHeader, name string) (
+	string, bool) {
+	var hdr *MailMessage_MailHeader
+
+	for _, hdr = range headers {
+		if strings.EqualFold(hdr.GetName(), name) && len(hdr.Value) > 0 {
+			return strings.TrimSpace(hdr.Value[0]), true
+		}
+	}
+	return "", false
+}
+
+// Parse a Content-Type or Content-Disposition header value. Values
+// which mime.ParseMediaType rejects are split up as well as possible.
+func parseMediaHeader(value string) (string, map[string]string, error) {
+	var mediatype string
+	var params map[string]string
+	var fields []string
+	var field string
+	var err error
+
+	mediatype, params, err = mime.ParseMediaType(value)
+	if err == nil {
+		return mediatype, params, nil
+	}
+
+	fields = strings.Split(value, ";")
+	mediatype = strings.ToLower(strings.TrimSpace(fields[0]))
+	params = make(map[string]string)
+	for _, field = range fields[1:] {
+		var kv []string = strings.SplitN(field, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] =
+			strings.Trim(strings.TrimSpace(kv[1]), "\"")
+	}
+	return mediatype, params, err
+}
+
+// Remove the transfer encoding "encoding" from "body". As much data as
+// could be decoded is returned along with any error.
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "base64":
+		var clean, ret []byte
+		var c byte
+		var n int
+		var err error
+
+		clean = make([]byte, 0, len(body))
+		for _, c = range body {
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				clean = append(clean, c)
+			}
+		}
+		ret = make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err = base64.StdEncoding.Decode(ret, clean)
+		return ret[:n], err
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(
+			bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// Retrieve the body of "part" of the raw message "raw", with the transfer
+// encoding removed.
+func DecodePartBody(raw []byte, part *MimePart) ([]byte, error) {
+	var start int64 = part.GetBodyOffset()
+	var end int64 = part.GetOffset() + part.GetLength()
+
+	if start < 0 || start > end || end > int64(len(raw)) {
+		return nil, errors.New("MIME part out of range")
+	}
+	return decodeBody(raw[start:end], part.GetTransferEncoding())
+}
+
+// Record the size and hash of the (decoded) contents "body" in "part".
+func describeContents(part *MimePart, body []byte) {
+	var sum [sha256.Size]byte = sha256.Sum256(body)
+
+	part.Size = int64p(len(body))
+	part.Sha256 = new(string)
+	*part.Sha256 = hex.EncodeToString(sum[:])
+}
+
+// Analyze the part found between "start" and "end" of the raw message.
+// "depth" is the nesting level of the part; "defaultType" the content
+// type to assume if the part doesn't specify one.
+func (self *mimeParser) parsePart(start, end, depth int,
+	defaultType string) *MimePart {
+	var part = new(MimePart)
+	var headers []*MailMessage_MailHeader
+	var params map[string]string
+	var value, ctype, encoding string
+	var hdrlen, bodyStart int
+	var ok bool
+	var err error
+
+	self.parts++
+	part.Offset = int64p(start)
+	part.Length = int64p(end - start)
+
+	headers, hdrlen = SplitHeaders(self.raw[start:end])
+	bodyStart = start + hdrlen
+	part.BodyOffset = int64p(bodyStart)
+
+	ctype = defaultType
+	if value, ok = findHeader(headers, "Content-Type"); ok {
+		ctype, params, err = parseMediaHeader(value)
+		if err != nil {
+			addMimeError(part, "Invalid Content-Type: "+err.Error())
+		}
+		if !strings.Contains(ctype, "/") {
+			ctype = defaultType
+		}
+	}
+	part.ContentType = stringp(ctype)
+	if value, ok = params["charset"]; ok {
+		part.Charset = stringp(value)
+	}
+
+	if value, ok = findHeader(headers, "Content-Disposition"); ok {
+		var disposition string
+		var dparams map[string]string
+
+		disposition, dparams, err = parseMediaHeader(value)
+		if err != nil {
+			addMimeError(part,
+				"Invalid Content-Disposition: "+err.Error())
+		}
+		part.Disposition = stringp(disposition)
+		if value, ok = dparams["filename"]; ok {
+			part.Filename = stringp(value)
+		}
+	}
+	if value, ok = params["name"]; ok && part.Filename == nil {
+		part.Filename = stringp(value)
+	}
+	if part.Filename != nil {
+		var decoder mime.WordDecoder
+		if value, err = decoder.DecodeHeader(*part.Filename); err == nil {
+			*part.Filename = value
+		}
+	}
+
+	encoding = "7bit"
+	if value, ok = findHeader(headers, "Content-Transfer-Encoding"); ok {
+		encoding = strings.ToLower(value)
+	}
+	part.TransferEncoding = stringp(encoding)
+
+	switch {
+	case strings.HasPrefix(ctype, "multipart/"):
+		var childType string = "text/plain"
+
+		part.Size = int64p(end - bodyStart)
+		if ctype == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		if len(params["boundary"]) == 0 {
+			addMimeError(part, "Multipart without boundary")
+		} else if depth >= self.limits.MaxDepth {
+			addMimeError(part, "Nesting too deep")
+		} else {
+			self.parseMultipart(part, bodyStart, end, params["boundary"],
+				depth+1, childType)
+		}
+	case ctype == "message/rfc822" && (encoding == "7bit" ||
+		encoding == "8bit" || encoding == "binary"):
+		describeContents(part, self.raw[bodyStart:end])
+		if depth >= self.limits.MaxDepth {
+			addMimeError(part, "Nesting too deep")
+		} else if self.parts >= self.limits.MaxParts {
+			addMimeError(part, "Too many parts")
+		} else {
+			part.Parts = append(part.Parts,
+				self.parsePart(bodyStart, end, depth+1, "text/plain"))
+		}
+	default:
+		var body []byte
+
+		body, err = decodeBody(self.raw[bodyStart:end], encoding)
+		if err != nil {
+			addMimeError(part,
+				"Unable to decode "+encoding+" content: "+err.Error())
+		}
+		describeContents(part, body)
+	}
+
+	return part
+}
+
+// Split the body of the multipart "part" between "start" and "end" of
+// the raw message into its parts, separated by "boundary". The parts
+// are analyzed at nesting level "depth", assuming "childType" as their
+// default content type.
+func (self *mimeParser) parseMultipart(part *MimePart, start, end int,
+	boundary string, depth int, childType string) {
+	var delimiter []byte = []byte("--" + boundary)
+	var pos int = start
+	var partStart int = -1
+	var closed bool
+
+	for pos < end && !closed {
+		var lineEnd int = bytes.IndexByte(self.raw[pos:end], '\n')
+		var line, rest []byte
+
+		if lineEnd < 0 {
+			lineEnd = end
+		} else {
+			lineEnd += pos + 1
+		}
+		line = self.raw[pos:lineEnd]
+
+		if bytes.HasPrefix(line, delimiter) {
+			rest = bytes.TrimRight(line[len(delimiter):], " \t\r\n")
+			closed = bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closed {
+				if partStart >= 0 {
+					self.addPart(part, partStart, pos, depth, childType)
+				}
+				partStart = lineEnd
+			}
+		}
+		pos = lineEnd
+	}
+
+	if partStart < 0 {
+		addMimeError(part, "Boundary not found")
+		return
+	}
+	if !closed {
+		addMimeError(part, "Missing closing boundary")
+		self.addPart(part, partStart, end, depth, childType)
+	}
+}
+
+// Add the part between "start" and "end" of the raw message to the
+// multipart "part", unless the limit of parts has been reached. The
+// line break before the delimiter at "end" belongs to the delimiter.
+func (self *mimeParser) addPart(part *MimePart, start, end, depth int,
+	childType string) {
+	if end > start && self.raw[end-1] == '\n' {
+		end--
+		if end > start && self.raw[end-1] == '\r' {
+			end--
+		}
+	}
+
+	if self.parts >= self.limits.MaxParts {
+		addMimeError(part, "Too many parts")
+		return
+	}
+	part.Parts = append(part.Parts,
+		self.parsePart(start, end, depth, childType))
+}
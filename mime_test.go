@@ -0,0 +1,194 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailpump
+
+import (
+	"strings"
+	"testing"
+)
+
+// Describe the tree of "part" as content types, with the errors of each
+// part in brackets and the children in parentheses.
+func describeMimeTree(part *MimePart) string {
+	var ret string = part.GetContentType()
+	var children []string
+	var child *MimePart
+
+	if len(part.Errors) > 0 {
+		ret += " [" + strings.Join(part.Errors, "; ") + "]"
+	}
+	for _, child = range part.Parts {
+		children = append(children, describeMimeTree(child))
+	}
+	if len(children) > 0 {
+		ret += " (" + strings.Join(children, ", ") + ")"
+	}
+	return ret
+}
+
+// Build a message consisting of "depth" multiparts nested in each other.
+func nestedMultipart(depth int) string {
+	var ret string = "Content-Type: text/plain\r\n\r\ninnermost\r\n"
+	var i int
+
+	for i = depth; i > 0; i-- {
+		var boundary string = "b" + strings.Repeat("x", i)
+
+		ret = "Content-Type: multipart/mixed; boundary=" + boundary +
+			"\r\n\r\n--" + boundary + "\r\n" + ret + "\r\n--" + boundary +
+			"--\r\n"
+	}
+	return ret
+}
+
+func TestParseMimeStructure(t *testing.T) {
+	var manyParts string = "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" + strings.Repeat("--b\r\n\r\npart\r\n", 5) + "--b--\r\n"
+	var tests = []struct {
+		name     string
+		raw      string
+		limits   MimeLimits
+		expected string
+	}{
+		{"plain", "Subject: hi\r\n\r\nHello\r\n", DefaultMimeLimits,
+			"text/plain"},
+		{"multipart",
+			"Content-Type: multipart/alternative; boundary=\"b1\"\r\n\r\n" +
+				"preamble\r\n--b1\r\nContent-Type: text/plain\r\n\r\n" +
+				"Hello\r\n--b1\r\nContent-Type: text/html\r\n\r\n" +
+				"<p>Hello</p>\r\n--b1--\r\nepilogue\r\n",
+			DefaultMimeLimits,
+			"multipart/alternative (text/plain, text/html)"},
+		{"missing closing boundary",
+			"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\n\r\none\r\n--b1\r\n\r\ntwo\r\n",
+			DefaultMimeLimits,
+			"multipart/mixed [Missing closing boundary] " +
+				"(text/plain, text/plain)"},
+		{"boundary not found",
+			"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b2\r\n\r\none\r\n--b2--\r\n",
+			DefaultMimeLimits,
+			"multipart/mixed [Boundary not found]"},
+		{"no boundary",
+			"Content-Type: multipart/mixed\r\n\r\n--b1\r\n\r\none\r\n",
+			DefaultMimeLimits,
+			"multipart/mixed [Multipart without boundary]"},
+		{"boundary prefix",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\n\r\n--bb is not a delimiter\r\n--b--\r\n",
+			DefaultMimeLimits,
+			"multipart/mixed (text/plain)"},
+		{"digest", "Content-Type: multipart/digest; boundary=b\r\n\r\n" +
+			"--b\r\n\r\nSubject: inner\r\n\r\nbody\r\n--b--\r\n",
+			DefaultMimeLimits,
+			"multipart/digest (message/rfc822 (text/plain))"},
+		{"depth limit", nestedMultipart(3), MimeLimits{2, 100},
+			"multipart/mixed (multipart/mixed (multipart/mixed " +
+				"[Nesting too deep]))"},
+		{"within depth limit", nestedMultipart(2), MimeLimits{2, 100},
+			"multipart/mixed (multipart/mixed (text/plain))"},
+		{"encapsulated depth limit",
+			"Content-Type: message/rfc822\r\n\r\n" +
+				"Content-Type: message/rfc822\r\n\r\n" +
+				"Subject: inner\r\n\r\nbody\r\n",
+			MimeLimits{1, 100},
+			"message/rfc822 (message/rfc822 [Nesting too deep])"},
+		{"part limit", manyParts, MimeLimits{16, 3},
+			"multipart/mixed [Too many parts] (text/plain, text/plain)"},
+		{"invalid base64",
+			"Content-Type: application/octet-stream\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n!!!!\r\n",
+			DefaultMimeLimits,
+			"application/octet-stream [Unable to decode base64 content: " +
+				"illegal base64 data at input byte 0]"},
+		{"overlong lines",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\n" +
+				strings.Repeat("x", 100000) + "\r\n--b\r\n\r\n" +
+				strings.Repeat("y", 100000) + "\r\n--b--\r\n",
+			DefaultMimeLimits,
+			"multipart/mixed (text/plain, text/plain)"},
+		{"unterminated last line",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\n\r\none\r\n--b--",
+			DefaultMimeLimits,
+			"multipart/mixed (text/plain)"},
+	}
+	var i int
+
+	for i = range tests {
+		var part *MimePart = ParseMimeStructure([]byte(tests[i].raw),
+			tests[i].limits)
+		var tree string = describeMimeTree(part)
+
+		if tree != tests[i].expected {
+			t.Errorf("%s: got %q, expected %q", tests[i].name, tree,
+				tests[i].expected)
+		}
+	}
+}
+
+func TestParseMimeStructureOffsets(t *testing.T) {
+	var raw string = "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"a.txt\"\r\n\r\n" +
+		"SGVsbG8=\r\n--b--\r\n"
+	var part *MimePart = ParseMimeStructure([]byte(raw), DefaultMimeLimits)
+	var child *MimePart
+	var start, end int
+	var body []byte
+	var err error
+
+	if len(part.Parts) != 1 {
+		t.Fatalf("Expected 1 part, got %s", describeMimeTree(part))
+	}
+	child = part.Parts[0]
+
+	start = int(child.GetOffset())
+	end = start + int(child.GetLength())
+	if start != strings.Index(raw, "Content-Type: text/plain") ||
+		end != strings.LastIndex(raw, "\r\n--b--") {
+		t.Errorf("Part spans %q", raw[start:end])
+	}
+	if child.GetFilename() != "a.txt" ||
+		child.GetDisposition() != "attachment" {
+		t.Errorf("Unexpected disposition %s, file name %s",
+			child.GetDisposition(), child.GetFilename())
+	}
+	if body, err = DecodePartBody([]byte(raw), child); err != nil {
+		t.Fatal("DecodePartBody: ", err)
+	}
+	if string(body) != "Hello" || child.GetSize() != 5 {
+		t.Errorf("Decoded body %q, size %d", body, child.GetSize())
+	}
+}
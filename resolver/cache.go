@@ -0,0 +1,180 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package resolver
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+var resolver_cache_hits = expvar.NewMap("resolver-cache-hits")
+var resolver_cache_misses = expvar.NewMap("resolver-cache-misses")
+var resolver_errors = expvar.NewMap("resolver-errors")
+
+// Cached answer to a single query.
+type cacheEntry struct {
+	answer  interface{}
+	err     error
+	expires time.Time
+}
+
+// Resolver remembering the answers of an upstream resolver for a while.
+// Names which don't exist are remembered as well; temporary errors are
+// not.
+type CachingResolver struct {
+	upstream    Resolver
+	ttl         time.Duration
+	negativeTtl time.Duration
+	mtx         sync.Mutex
+	cache       map[string]*cacheEntry
+}
+
+// Create a new resolver caching the answers of "upstream" for "ttl",
+// and the nonexistence of names for "negativeTtl".
+func NewCachingResolver(upstream Resolver, ttl,
+	negativeTtl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		upstream:    upstream,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		cache:       make(map[string]*cacheEntry),
+	}
+}
+
+// Answer the query "qtype" for "name" from the cache if possible, or
+// run "lookup" and remember the result.
+func (self *CachingResolver) query(qtype, name string,
+	lookup func() (interface{}, error)) (interface{}, error) {
+	var key string = qtype + "|" + name
+	var entry *cacheEntry
+	var answer interface{}
+	var ok bool
+	var err error
+
+	self.mtx.Lock()
+	entry, ok = self.cache[key]
+	self.mtx.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		resolver_cache_hits.Add(qtype, 1)
+		return entry.answer, entry.err
+	}
+	resolver_cache_misses.Add(qtype, 1)
+
+	answer, err = lookup()
+	if err != nil && !IsNotFound(err) {
+		resolver_errors.Add(qtype, 1)
+		return answer, err
+	}
+
+	entry = &cacheEntry{answer: answer, err: err}
+	if err != nil {
+		entry.expires = time.Now().Add(self.negativeTtl)
+	} else {
+		entry.expires = time.Now().Add(self.ttl)
+	}
+	self.mtx.Lock()
+	self.cache[key] = entry
+	self.mtx.Unlock()
+	return answer, err
+}
+
+// Look up the names pointing to "addr", using the cache.
+func (self *CachingResolver) LookupAddr(ctx context.Context, addr string) (
+	[]string, error) {
+	var answer interface{}
+	var err error
+
+	answer, err = self.query("PTR", addr, func() (interface{}, error) {
+		return self.upstream.LookupAddr(ctx, addr)
+	})
+	return answer.([]string), err
+}
+
+// Look up the addresses of "host", using the cache.
+func (self *CachingResolver) LookupHost(ctx context.Context, host string) (
+	[]string, error) {
+	var answer interface{}
+	var err error
+
+	answer, err = self.query("A", host, func() (interface{}, error) {
+		return self.upstream.LookupHost(ctx, host)
+	})
+	return answer.([]string), err
+}
+
+// Look up the mail exchangers of "name", using the cache.
+func (self *CachingResolver) LookupMX(ctx context.Context, name string) (
+	[]*net.MX, error) {
+	var answer interface{}
+	var err error
+
+	answer, err = self.query("MX", name, func() (interface{}, error) {
+		return self.upstream.LookupMX(ctx, name)
+	})
+	return answer.([]*net.MX), err
+}
+
+// Look up the text records of "name", using the cache.
+func (self *CachingResolver) LookupTXT(ctx context.Context, name string) (
+	[]string, error) {
+	var answer interface{}
+	var err error
+
+	answer, err = self.query("TXT", name, func() (interface{}, error) {
+		return self.upstream.LookupTXT(ctx, name)
+	})
+	return answer.([]string), err
+}
+
+// Periodically remove expired answers from the cache. Should be run in
+// a separate goroutine.
+func (self *CachingResolver) ExpireCache(interval time.Duration) {
+	for {
+		var key string
+		var entry *cacheEntry
+		var now time.Time
+
+		time.Sleep(interval)
+		now = time.Now()
+
+		self.mtx.Lock()
+		for key, entry = range self.cache {
+			if now.After(entry.expires) {
+				delete(self.cache, key)
+			}
+		}
+		self.mtx.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// DNS lookups used throughout mailpump. Everything which needs to talk to
+// DNS goes through the Resolver interface, so lookups can be cached,
+// directed at a specific server or answered from an in-memory zone.
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DNS lookups required by mailpump. *net.Resolver implements this
+// interface.
+type Resolver interface {
+	// Look up the names pointing to the address "addr" (PTR).
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+
+	// Look up the IPv4 and IPv6 addresses of "host" (A/AAAA).
+	LookupHost(ctx context.Context, host string) ([]string, error)
+
+	// Look up the mail exchangers of "name", sorted by preference (MX).
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+
+	// Look up the text records of "name" (TXT).
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Create a resolver sending all queries to the DNS server at "server"
+// (host:port). If "server" is empty, the system resolver is used.
+func NewUpstream(server string) Resolver {
+	var dialer net.Dialer
+
+	if len(server) == 0 {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (
+			net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Determine whether "err" indicates that the name looked up doesn't
+// exist or has no records of the requested type.
+func IsNotFound(err error) bool {
+	var dnserr *net.DNSError
+	var ok bool
+
+	if err == nil {
+		return false
+	}
+	dnserr, ok = err.(*net.DNSError)
+	return ok && dnserr.IsNotFound
+}
+
+// Create an error indicating that "name" doesn't exist.
+func NotFoundError(name string) error {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       name,
+		IsNotFound: true,
+	}
+}
+
+// Create a context for a lookup which will be abandoned after "timeout".
+// A timeout of 0 means no limit.
+func WithTimeout(timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,177 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Resolver answering queries from records held in memory, e.g. for
+// tests or for running without network access. Names are matched case
+// insensitively and with or without a trailing dot.
+type Zone struct {
+	mtx    sync.RWMutex
+	ptr    map[string][]string
+	hosts  map[string][]string
+	mx     map[string][]*net.MX
+	txt    map[string][]string
+	errors map[string]error
+}
+
+// Create a new, empty zone.
+func NewZone() *Zone {
+	return &Zone{
+		ptr:    make(map[string][]string),
+		hosts:  make(map[string][]string),
+		mx:     make(map[string][]*net.MX),
+		txt:    make(map[string][]string),
+		errors: make(map[string]error),
+	}
+}
+
+// Bring "name" into the form used as key in the zone.
+func zoneKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Add the address "addr" to "host". The reverse mapping is not added
+// automatically; use AddPTR for that.
+func (self *Zone) AddHost(host, addr string) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.hosts[zoneKey(host)] = append(self.hosts[zoneKey(host)], addr)
+}
+
+// Make the address "addr" point to "name".
+func (self *Zone) AddPTR(addr, name string) {
+	var ip net.IP = net.ParseIP(addr)
+
+	if ip != nil {
+		addr = ip.String()
+	}
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.ptr[addr] = append(self.ptr[addr], name)
+}
+
+// Add the mail exchanger "host" with the preference "pref" to "name".
+func (self *Zone) AddMX(name, host string, pref uint16) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.mx[zoneKey(name)] = append(self.mx[zoneKey(name)],
+		&net.MX{Host: host, Pref: pref})
+}
+
+// Add the text record "txt" to "name".
+func (self *Zone) AddTXT(name, txt string) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.txt[zoneKey(name)] = append(self.txt[zoneKey(name)], txt)
+}
+
+// Make all lookups of "name" (or of the address "name") fail with
+// "err", e.g. to simulate a server failure.
+func (self *Zone) SetError(name string, err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.errors[zoneKey(name)] = err
+}
+
+// Look up the records of "name" in "records".
+func (self *Zone) lookup(records map[string][]string, name string) (
+	[]string, error) {
+	var ret []string
+	var err error
+	var ok bool
+
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+
+	if err, ok = self.errors[zoneKey(name)]; ok {
+		return nil, err
+	}
+	if ret, ok = records[zoneKey(name)]; !ok || len(ret) == 0 {
+		return nil, NotFoundError(name)
+	}
+	return append([]string(nil), ret...), nil
+}
+
+// Look up the names "addr" points to.
+func (self *Zone) LookupAddr(ctx context.Context, addr string) (
+	[]string, error) {
+	var ip net.IP = net.ParseIP(addr)
+
+	if ip != nil {
+		addr = ip.String()
+	}
+	return self.lookup(self.ptr, addr)
+}
+
+// Look up the addresses of "host".
+func (self *Zone) LookupHost(ctx context.Context, host string) (
+	[]string, error) {
+	return self.lookup(self.hosts, host)
+}
+
+// Look up the mail exchangers of "name", sorted by preference.
+func (self *Zone) LookupMX(ctx context.Context, name string) (
+	[]*net.MX, error) {
+	var ret []*net.MX
+	var err error
+	var ok bool
+
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+
+	if err, ok = self.errors[zoneKey(name)]; ok {
+		return nil, err
+	}
+	if len(self.mx[zoneKey(name)]) == 0 {
+		return nil, NotFoundError(name)
+	}
+	ret = append(ret, self.mx[zoneKey(name)]...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Pref < ret[j].Pref
+	})
+	return ret, nil
+}
+
+// Look up the text records of "name".
+func (self *Zone) LookupTXT(ctx context.Context, name string) (
+	[]string, error) {
+	return self.lookup(self.txt, name)
+}
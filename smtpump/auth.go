@@ -0,0 +1,227 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package smtpump
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SASL mechanisms understood by ReadCredentials, for advertising them in
+// the EHLO response.
+var AuthMechanisms = []string{"PLAIN", "LOGIN"}
+
+// Returned by readAuthResponse if the client cancelled the exchange.
+var errAuthCancelled = errors.New("Authentication cancelled")
+
+// Determine whether the connection is encrypted using TLS.
+func (self *SmtpConnection) IsTls() bool {
+	var ok bool
+	_, ok = self.origconn.(*tls.Conn)
+	return ok
+}
+
+// Determine whether the client could switch to TLS using STARTTLS.
+func (self *SmtpConnection) CanStartTls() bool {
+	return self.tlsConf != nil && !self.IsTls()
+}
+
+// Switch the connection to TLS in response to a STARTTLS command with
+// the parameters "params" (RFC 3207).
+func (self *SmtpConnection) startTls(params string) (ret SmtpReturnCode) {
+	var tlsconn *tls.Conn
+	var err error
+
+	if len(params) > 0 {
+		ret.Code = SMTP_PARAMETER_ERROR
+		ret.Message = "STARTTLS doesn't take parameters"
+		return
+	}
+	if self.tlsConf == nil {
+		ret.Code = SMTP_NOT_IMPLEMENTED
+		ret.Message = "STARTTLS is not available."
+		return
+	}
+	if self.IsTls() {
+		ret.Code = SMTP_BAD_SEQUENCE
+		ret.Message = "TLS is already active."
+		return
+	}
+
+	// Anything sent after STARTTLS but before the handshake would be
+	// treated as if it had been received over TLS.
+	if self.conn.R.Buffered() > 0 {
+		smtp_dialog_errors.Add("starttls-pipelining", 1)
+		ret.Code = SMTP_BAD_SEQUENCE
+		ret.Message = "Commands pipelined after STARTTLS; goodbye."
+		ret.Terminate = true
+		return
+	}
+
+	self.Respond(SMTP_READY, false, "Ready to start TLS")
+	tlsconn = tls.Server(self.origconn, self.tlsConf)
+	tlsconn.SetDeadline(time.Now().Add(time.Minute))
+	err = tlsconn.Handshake()
+	if err != nil {
+		smtp_dialog_errors.Add("tls-handshake-failed", 1)
+		log.Print("TLS handshake with ", self.origconn.RemoteAddr(),
+			" failed: ", err)
+		ret.Terminate = true
+		return
+	}
+	// The zero time clears the deadline; nulldeadline would expire it.
+	tlsconn.SetDeadline(time.Time{})
+
+	self.state.mtx.Lock()
+	self.origconn = tlsconn
+	self.conn = textproto.NewConn(tlsconn)
+	self.state.status.Helo = ""
+	self.state.status.Sender = ""
+	self.state.status.Recipients = 0
+	self.state.status.AuthenticatedUser = ""
+	self.state.mtx.Unlock()
+
+	self.cb.TlsStarted(self)
+	return
+}
+
+// Send the base64 encoded "challenge" to the client and read its
+// response, as part of an AUTH exchange.
+func (self *SmtpConnection) readAuthResponse(challenge string) (
+	[]byte, error) {
+	var line string
+	var err error
+
+	self.Respond(SMTP_AUTH_CONTINUE, false,
+		base64.StdEncoding.EncodeToString([]byte(challenge)))
+	self.origconn.SetReadDeadline(time.Now().Add(time.Minute))
+	line, err = self.conn.ReadLine()
+	self.origconn.SetReadDeadline(nulldeadline)
+	self.countBytesIn(int64(len(line)))
+	if err != nil {
+		return nil, err
+	}
+	if line == "*" {
+		return nil, errAuthCancelled
+	}
+	return base64.StdEncoding.DecodeString(line)
+}
+
+// Decode the initial response "resp" given along with the AUTH command.
+// A single "=" stands for an empty response (RFC 4954, section 4).
+func decodeInitialResponse(resp string) ([]byte, error) {
+	if resp == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(resp)
+}
+
+// Run the SASL exchange for the AUTH command with the parameters
+// "params" and return the user name and password sent by the client.
+// If the exchange fails, the returned code is set to the response the
+// client should get. The credentials still need to be verified.
+func (self *SmtpConnection) ReadCredentials(params string) (
+	user, password string, ret SmtpReturnCode) {
+	var fields []string = strings.Fields(params)
+	var data [][]byte
+	var resp []byte
+	var err error
+
+	if len(fields) < 1 || len(fields) > 2 {
+		ret.Code = SMTP_PARAMETER_ERROR
+		ret.Message = "Syntax: AUTH mechanism [initial-response]"
+		return
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		if len(fields) > 1 {
+			resp, err = decodeInitialResponse(fields[1])
+		} else {
+			resp, err = self.readAuthResponse("")
+		}
+		if err != nil {
+			break
+		}
+		data = bytes.Split(resp, []byte{0})
+		if len(data) != 3 {
+			err = errors.New("Malformed PLAIN response")
+			break
+		}
+		user, password = string(data[1]), string(data[2])
+		if len(data[0]) > 0 && string(data[0]) != user {
+			ret.Code = SMTP_BAD_AUTH
+			ret.Message = "Acting as another user is not supported."
+			return
+		}
+	case "LOGIN":
+		if len(fields) > 1 {
+			resp, err = decodeInitialResponse(fields[1])
+		} else {
+			resp, err = self.readAuthResponse("Username:")
+		}
+		if err != nil {
+			break
+		}
+		user = string(resp)
+		resp, err = self.readAuthResponse("Password:")
+		password = string(resp)
+	default:
+		ret.Code = SMTP_PARAMETER_NOT_IMPLEMENTED
+		ret.Message = "Unrecognized authentication type."
+		return
+	}
+
+	if err == errAuthCancelled {
+		ret.Code = SMTP_PARAMETER_ERROR
+		ret.Message = "Authentication cancelled."
+	} else if err != nil {
+		smtp_dialog_errors.Add("auth-malformed", 1)
+		ret.Code = SMTP_PARAMETER_ERROR
+		ret.Message = "Unable to decode authentication data."
+	}
+	return
+}
+
+// Record that the client has authenticated as "user", for the purpose
+// of inspecting the session.
+func (self *SmtpConnection) SetAuthenticatedUser(user string) {
+	self.state.mtx.Lock()
+	defer self.state.mtx.Unlock()
+	self.state.status.AuthenticatedUser = user
+}
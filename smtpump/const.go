@@ -36,13 +36,16 @@ const (
 	SMTP_HELP                      = 214
 	SMTP_READY                     = 220
 	SMTP_CLOSING                   = 221
+	SMTP_AUTH_SUCCEEDED            = 235
 	SMTP_COMPLETED                 = 250
 	SMTP_NONLOCAL_USER             = 251
+	SMTP_AUTH_CONTINUE             = 334
 	SMTP_PROCEED                   = 354
 	SMTP_UNAVAIL                   = 421
 	SMTP_MAILBOX_UNAVAIL           = 450
 	SMTP_LOCALERR                  = 451
 	SMTP_SERVER_FULL               = 452
+	SMTP_TEMPORARY_FAILURE         = 454
 	SMTP_SYNTAX_ERROR              = 500
 	SMTP_PARAMETER_ERROR           = 501
 	SMTP_NOT_IMPLEMENTED           = 502
@@ -56,4 +59,15 @@ const (
 	SMTP_MESSAGE_TOO_BIG           = 552
 	SMTP_ILLEGAL_MAILBOX_NAME      = 553
 	SMTP_TRANSACTION_FAILED        = 554
+	SMTP_PARAMETERS_UNKNOWN        = 555
+)
+
+// Responses to ETRN, see RFC 1985, section 5.
+const (
+	SMTP_ETRN_STARTED          = 250
+	SMTP_ETRN_NO_MESSAGES      = 251
+	SMTP_ETRN_PENDING_STARTED  = 252
+	SMTP_ETRN_MESSAGES_STARTED = 253
+	SMTP_ETRN_UNABLE_TO_QUEUE  = 458
+	SMTP_ETRN_NOT_ALLOWED      = 459
 )
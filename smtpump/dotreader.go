@@ -0,0 +1,122 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package smtpump
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Reader for the contents of a DATA command which removes the dot
+// stuffing (RFC 5321, section 4.5.2) but otherwise returns the bytes
+// exactly as sent by the client, including their line endings.
+type rawDotReader struct {
+	r       *bufio.Reader
+	line    []byte
+	midline bool
+	done    bool
+	err     error
+}
+
+// Read the next line of the message into the buffer. Reaching the
+// terminating "." line results in io.EOF.
+func (self *rawDotReader) fill() error {
+	var line []byte
+	var err error
+
+	line, err = self.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || (err == io.EOF && len(line) > 0) {
+		// Overlong or unterminated line; hand out what we have. Dots
+		// only have a special meaning at the start of a line.
+		if !self.midline && line[0] == '.' {
+			line = line[1:]
+		}
+		self.line = line
+		self.midline = true
+		return nil
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	if self.midline {
+		self.line = line
+		self.midline = false
+		return nil
+	}
+	if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+		self.done = true
+		return io.EOF
+	}
+	if line[0] == '.' {
+		line = line[1:]
+	}
+	self.line = line
+	return nil
+}
+
+// Read the unstuffed message contents into "p".
+func (self *rawDotReader) Read(p []byte) (int, error) {
+	var n int
+
+	for n < len(p) {
+		if len(self.line) == 0 {
+			if self.done {
+				return n, io.EOF
+			}
+			if self.err != nil {
+				return n, self.err
+			}
+			if self.err = self.fill(); self.err != nil {
+				if self.err == io.EOF {
+					self.done = true
+				}
+				continue
+			}
+		}
+		var copied int = copy(p[n:], self.line)
+		self.line = self.line[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// Build and return a reader for the contents of a DATA command which
+// keeps the message exactly as it was sent by the client, including
+// CRLF line endings. Only dot stuffing is removed.
+func (self *SmtpConnection) GetRawDotReader() io.Reader {
+	return &rawDotReader{r: self.conn.R}
+}
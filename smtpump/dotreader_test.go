@@ -0,0 +1,106 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package smtpump
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRawDotReader(t *testing.T) {
+	var tests = []struct {
+		name, input, expected, rest string
+		err                         error
+	}{
+		{"empty", ".\r\n", "", "", nil},
+		{"crlf", "Subject: hi\r\n\r\nbody\r\n.\r\n",
+			"Subject: hi\r\n\r\nbody\r\n", "", nil},
+		{"bare lf", "a\nb\r\n.\n", "a\nb\r\n", "", nil},
+		{"stuffed dot", "..\r\n.\r\n", ".\r\n", "", nil},
+		{"stuffed dots", "...\r\n..x\r\n.\r\n", "..\r\n.x\r\n", "", nil},
+		{"unstuffed dot", ".x\r\n.\r\n", "x\r\n", "", nil},
+		{"dot mid line", "a.\r\n. \r\n.\r\n", "a.\r\n \r\n", "", nil},
+		{"overlong line",
+			"..0123456789abcdef0123456789\r\n.\r\n",
+			".0123456789abcdef0123456789\r\n", "", nil},
+		{"dot after buffer boundary",
+			"0123456789abcdef.\r\n.\r\n", "0123456789abcdef.\r\n", "",
+			nil},
+		{"following commands", "a\r\n.\r\nQUIT\r\n", "a\r\n",
+			"QUIT\r\n", nil},
+		{"missing terminator", "a\r\n", "a\r\n", "",
+			io.ErrUnexpectedEOF},
+		{"unterminated line", "a\r\n.", "a\r\n", "",
+			io.ErrUnexpectedEOF},
+	}
+	var i int
+
+	for i = range tests {
+		var r *bufio.Reader = bufio.NewReaderSize(
+			strings.NewReader(tests[i].input), 16)
+		var data, rest []byte
+		var err error
+
+		data, err = ioutil.ReadAll(&rawDotReader{r: r})
+		if err != tests[i].err {
+			t.Errorf("%s: got error %v, expected %v", tests[i].name, err,
+				tests[i].err)
+		}
+		if string(data) != tests[i].expected {
+			t.Errorf("%s: got %q, expected %q", tests[i].name, data,
+				tests[i].expected)
+		}
+		if rest, _ = ioutil.ReadAll(r); string(rest) != tests[i].rest {
+			t.Errorf("%s: left %q unread, expected %q", tests[i].name,
+				rest, tests[i].rest)
+		}
+	}
+}
+
+func TestRawDotReaderSmallReads(t *testing.T) {
+	var input string = "..a\r\nb\r\n.\r\n"
+	var r *bufio.Reader = bufio.NewReader(strings.NewReader(input))
+	var data []byte
+	var err error
+
+	data, err = ioutil.ReadAll(iotest.OneByteReader(&rawDotReader{r: r}))
+	if err != nil {
+		t.Fatal("ReadAll: ", err)
+	}
+	if string(data) != ".a\r\nb\r\n" {
+		t.Errorf("Got %q, expected %q", data, ".a\r\nb\r\n")
+	}
+}
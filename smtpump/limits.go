@@ -0,0 +1,144 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Limits on the resources a single SMTP session may consume.
+package smtpump
+
+import (
+	"expvar"
+)
+
+var smtp_session_limits_hit = expvar.NewMap("smtp-session-limits-hit")
+
+// Caps on what a single client may do within one SMTP session. A value
+// of 0 means that the respective limit is not enforced.
+type SessionLimits struct {
+	// Number of commands which were answered with a permanent error
+	// before the connection is terminated with a 421.
+	MaxErrors int
+
+	// Total number of commands accepted during the session before it is
+	// terminated with a 421.
+	MaxCommands int
+
+	// Number of recipients accepted within a single mail transaction.
+	// Further recipients are rejected with a 452.
+	MaxRecipients int
+
+	// Number of mail transactions started during the session before it
+	// is terminated with a 421.
+	MaxTransactions int
+}
+
+// Per-session counters for the limits.
+type sessionCounters struct {
+	errors       int
+	commands     int
+	recipients   int
+	transactions int
+}
+
+// Determine whether the command "cmd" may be executed within the limits
+// of the session. If it may not, the response to send is returned along
+// with false.
+func (self *SmtpConnection) checkLimits(cmd string) (
+	ret SmtpReturnCode, ok bool) {
+	self.counters.commands++
+	if self.limits.MaxCommands > 0 &&
+		self.counters.commands > self.limits.MaxCommands {
+		smtp_session_limits_hit.Add("commands", 1)
+		ret.Code = SMTP_UNAVAIL
+		ret.Message = "Too many commands, closing connection."
+		ret.Terminate = true
+		return
+	}
+
+	switch cmd {
+	case "MAIL":
+		if self.limits.MaxTransactions > 0 &&
+			self.counters.transactions >= self.limits.MaxTransactions {
+			smtp_session_limits_hit.Add("transactions", 1)
+			ret.Code = SMTP_UNAVAIL
+			ret.Message = "Too many transactions, closing connection."
+			ret.Terminate = true
+			return
+		}
+	case "RCPT":
+		if self.limits.MaxRecipients > 0 &&
+			self.counters.recipients >= self.limits.MaxRecipients {
+			smtp_session_limits_hit.Add("recipients", 1)
+			ret.Code = SMTP_SERVER_FULL
+			ret.Message = "Too many recipients."
+			return
+		}
+	}
+
+	ok = true
+	return
+}
+
+// Update the session counters with the result "ret" of the command
+// "cmd". If the session exceeded its error budget, the result is sent
+// to the client and "ret" is replaced with a 421 which terminates the
+// connection.
+func (self *SmtpConnection) accountCommand(cmd string,
+	ret *SmtpReturnCode) {
+	var success bool = ret.Code >= 200 && ret.Code < 300
+
+	switch cmd {
+	case "HELO", "EHLO", "RSET", "DATA":
+		// All of these end the current transaction, if any.
+		self.counters.recipients = 0
+	case "MAIL":
+		if success {
+			self.counters.transactions++
+			self.counters.recipients = 0
+		}
+	case "RCPT":
+		if success {
+			self.counters.recipients++
+		}
+	}
+
+	if ret.Code < 500 {
+		return
+	}
+
+	self.counters.errors++
+	if self.limits.MaxErrors > 0 &&
+		self.counters.errors > self.limits.MaxErrors && !ret.Terminate {
+		smtp_session_limits_hit.Add("errors", 1)
+		self.RespondWithRCode(ret)
+		ret.Code = SMTP_UNAVAIL
+		ret.Message = "Too many errors, closing connection."
+		ret.Terminate = true
+	}
+}
@@ -33,52 +33,149 @@
 package smtpump
 
 import (
+	"crypto/tls"
 	"expvar"
 	"net"
+	"os"
+	"sync"
 )
 
 var smtp_num_accepts = expvar.NewInt("smtp-num-accepts")
 var smtp_accept_errors = expvar.NewMap("smtp-accept-errors")
 var smtp_recent_accept_errors = expvar.NewInt("smtp-recent-accept-errors")
+var smtp_num_listeners = expvar.NewInt("smtp-num-listeners")
 
 // Structure to hold all data required for an active server.
 type SMTPServer struct {
-	callback SmtpReceiver
-	listener net.Listener
+	callback  SmtpReceiver
+	listeners []net.Listener
+	limits    SessionLimits
+	tlsConf   *tls.Config
+	sessions  sessionRegistry
+	mtx       sync.Mutex
 }
 
 // Create a new SMTP server listening on the address "laddr" with the
 // protocol "net". Any callbacks will be done on "callback".
 func NewSMTPServer(netname, laddr string, callback SmtpReceiver) (
 	*SMTPServer, error) {
-	var srv *SMTPServer
-	var l net.Listener
+	var srv *SMTPServer = NewSMTPServerWithoutListeners(callback)
 	var err error
 
-	l, err = net.Listen(netname, laddr)
+	err = srv.Listen(netname, laddr, "")
 	if err != nil {
 		return nil, err
 	}
-	srv = &SMTPServer{
+
+	return srv, nil
+}
+
+// Create a new SMTP server which doesn't listen anywhere yet. Use Listen
+// or Serve to make it accept connections. Any callbacks will be done on
+// "callback".
+func NewSMTPServerWithoutListeners(callback SmtpReceiver) *SMTPServer {
+	return &SMTPServer{
 		callback: callback,
-		listener: l,
 	}
+}
 
-	go srv.waitForConnections()
-	return srv, nil
+// Start listening on the address "laddr" with the protocol "net" in
+// addition to all other listeners of the server. Connections accepted
+// on the new listener will report "policy" from their GetPolicy method.
+//
+// For unix sockets, a stale socket left behind by a previous instance
+// will be removed before binding.
+func (self *SMTPServer) Listen(netname, laddr, policy string) error {
+	var l net.Listener
+	var err error
+
+	if netname == "unix" {
+		var fi os.FileInfo
+		fi, err = os.Lstat(laddr)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(laddr)
+		}
+	}
+
+	l, err = net.Listen(netname, laddr)
+	if err != nil {
+		return err
+	}
+
+	self.Serve(l, policy)
+	return nil
+}
+
+// Start accepting SMTP connections on the already established listener
+// "l". Connections accepted on it will report "policy" from their
+// GetPolicy method.
+func (self *SMTPServer) Serve(l net.Listener, policy string) {
+	self.mtx.Lock()
+	self.listeners = append(self.listeners, l)
+	self.mtx.Unlock()
+
+	smtp_num_listeners.Add(1)
+	go self.waitForConnections(l, policy)
+}
+
+// Set the limits which will be enforced on all SMTP sessions accepted
+// from now on.
+func (self *SMTPServer) SetSessionLimits(limits SessionLimits) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.limits = limits
+}
+
+// Retrieve the limits enforced on newly accepted SMTP sessions.
+func (self *SMTPServer) GetSessionLimits() SessionLimits {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.limits
+}
+
+// Set the TLS configuration offered to clients via STARTTLS on all SMTP
+// sessions accepted from now on. A nil configuration disables STARTTLS.
+func (self *SMTPServer) SetTLSConfig(config *tls.Config) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.tlsConf = config
+}
+
+// Retrieve the TLS configuration offered to newly accepted SMTP sessions.
+func (self *SMTPServer) GetTLSConfig() *tls.Config {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.tlsConf
+}
+
+// Retrieve the addresses of all listeners the server is accepting
+// connections on.
+func (self *SMTPServer) Addrs() []net.Addr {
+	var ret []net.Addr
+	var l net.Listener
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	for _, l = range self.listeners {
+		ret = append(ret, l.Addr())
+	}
+	return ret
 }
 
-// Accept new connections and start processing input on them.
-func (self *SMTPServer) waitForConnections() {
+// Accept new connections on "l" and start processing input on them.
+func (self *SMTPServer) waitForConnections(l net.Listener, policy string) {
 	for {
 		var c net.Conn
 		var err error
 
-		c, err = self.listener.Accept()
+		c, err = l.Accept()
 		if err == nil {
 			smtp_num_accepts.Add(1)
 			smtp_recent_accept_errors.Set(0)
-			newSmtpConnection(c, self.callback)
+			newSmtpConnection(c, self.callback, policy,
+				self.GetSessionLimits(), self.GetTLSConfig(),
+				&self.sessions)
 		} else {
 			smtp_accept_errors.Add(err.Error(), 1)
 			smtp_recent_accept_errors.Add(1)
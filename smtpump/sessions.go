@@ -0,0 +1,277 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package smtpump
+
+import (
+	"crypto/tls"
+	"expvar"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var smtp_sessions_closed = expvar.NewInt("smtp-sessions-force-closed")
+
+// Snapshot of the state of an SMTP session, for inspecting it while it
+// is running.
+type SessionStatus struct {
+	// Unique identifier of the session within the server.
+	Id uint64
+
+	// Policy tag of the listener the session was accepted on.
+	Policy string
+
+	// Address of the peer and of the local end of the connection.
+	Peer      string
+	LocalAddr string
+
+	// Name of the peer as determined by the SMTP receiver, if any.
+	PeerName string
+
+	// Hostname the peer gave in its most recent HELO or EHLO.
+	Helo string
+
+	// Identity the peer has authenticated as, if any.
+	AuthenticatedUser string
+
+	// Whether the connection is encrypted, and the negotiated TLS
+	// version and cipher suite if it is.
+	Tls        bool
+	TlsVersion uint16
+	TlsCipher  uint16
+
+	// Command currently being processed, or empty if the session is
+	// waiting for the peer.
+	CurrentCommand string
+
+	// Envelope sender and number of accepted recipients of the current
+	// transaction.
+	Sender     string
+	Recipients int
+
+	// Number of bytes received from and sent to the peer.
+	BytesIn  int64
+	BytesOut int64
+
+	// Time the session was established.
+	Started time.Time
+}
+
+// Mutable, inspectable part of the state of an SMTP connection.
+type sessionState struct {
+	mtx    sync.Mutex
+	status SessionStatus
+}
+
+// Set of all currently active SMTP sessions of a server.
+type sessionRegistry struct {
+	mtx      sync.Mutex
+	nextId   uint64
+	sessions map[uint64]*SmtpConnection
+}
+
+// Add "conn" to the set of active sessions and assign it an identifier.
+func (self *sessionRegistry) add(conn *SmtpConnection) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	if self.sessions == nil {
+		self.sessions = make(map[uint64]*SmtpConnection)
+	}
+	self.nextId++
+	conn.state.status.Id = self.nextId
+	self.sessions[self.nextId] = conn
+}
+
+// Remove "conn" from the set of active sessions.
+func (self *sessionRegistry) remove(conn *SmtpConnection) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	delete(self.sessions, conn.state.status.Id)
+}
+
+// Retrieve all currently active sessions of the server, oldest first.
+func (self *SMTPServer) Sessions() []*SmtpConnection {
+	var ret []*SmtpConnection
+	var conn *SmtpConnection
+
+	self.sessions.mtx.Lock()
+	for _, conn = range self.sessions.sessions {
+		ret = append(ret, conn)
+	}
+	self.sessions.mtx.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id() < ret[j].Id()
+	})
+	return ret
+}
+
+// Retrieve the active session with the identifier "id", or nil if there
+// is no such session.
+func (self *SMTPServer) GetSession(id uint64) *SmtpConnection {
+	self.sessions.mtx.Lock()
+	defer self.sessions.mtx.Unlock()
+	return self.sessions.sessions[id]
+}
+
+// Retrieve the identifier of the session within its server.
+func (self *SmtpConnection) Id() uint64 {
+	// The identifier is assigned before the session starts and never
+	// changes afterwards.
+	return self.state.status.Id
+}
+
+// Retrieve a snapshot of the current state of the session.
+func (self *SmtpConnection) Status() SessionStatus {
+	var ret SessionStatus
+	var tlsconn *tls.Conn
+	var ok bool
+
+	// The connection is replaced when switching to TLS.
+	self.state.mtx.Lock()
+	ret = self.state.status
+	tlsconn, ok = self.origconn.(*tls.Conn)
+	ret.Peer = self.origconn.RemoteAddr().String()
+	ret.LocalAddr = self.origconn.LocalAddr().String()
+	self.state.mtx.Unlock()
+
+	ret.Policy = self.policy
+	if ok {
+		var cs tls.ConnectionState = tlsconn.ConnectionState()
+		ret.Tls = cs.HandshakeComplete
+		ret.TlsVersion = cs.Version
+		ret.TlsCipher = cs.CipherSuite
+	}
+	return ret
+}
+
+// Record the name of the peer, e.g. as determined by a reverse lookup,
+// for the purpose of inspecting the session.
+func (self *SmtpConnection) SetPeerName(name string) {
+	self.state.mtx.Lock()
+	defer self.state.mtx.Unlock()
+	self.state.status.PeerName = name
+}
+
+// Forcibly terminate the session without any further SMTP dialog. The
+// connection will be cleaned up as usual.
+func (self *SmtpConnection) Close() error {
+	var conn net.Conn
+
+	self.state.mtx.Lock()
+	conn = self.origconn
+	self.state.mtx.Unlock()
+
+	smtp_sessions_closed.Add(1)
+	log.Print("Forcibly closing SMTP session ", self.Id(), " from ",
+		conn.RemoteAddr())
+	return conn.Close()
+}
+
+// Count "length" bytes as received from the peer.
+func (self *SmtpConnection) countBytesIn(length int64) {
+	smtp_bytes_in.Add(length)
+	self.state.mtx.Lock()
+	self.state.status.BytesIn += length
+	self.state.mtx.Unlock()
+}
+
+// Count "length" bytes as sent to the peer.
+func (self *SmtpConnection) countBytesOut(length int64) {
+	smtp_bytes_out.Add(length)
+	self.state.mtx.Lock()
+	self.state.status.BytesOut += length
+	self.state.mtx.Unlock()
+}
+
+// Record that the command "cmd" is now being processed.
+func (self *SmtpConnection) startCommand(cmd string) {
+	self.state.mtx.Lock()
+	defer self.state.mtx.Unlock()
+	self.state.status.CurrentCommand = cmd
+}
+
+// Extract the address from the parameters "params" of a MAIL or RCPT
+// command, e.g. "FROM:<foo@example.com> SIZE=100".
+func commandAddress(params string) string {
+	var parts []string = strings.SplitN(params, ":", 2)
+
+	if len(parts) < 2 {
+		return ""
+	}
+	parts = strings.Fields(parts[1])
+	if len(parts) < 1 {
+		return ""
+	}
+	return parts[0]
+}
+
+// Update the envelope state of the session after the command "cmd" with
+// the parameters "params" has been answered with "ret".
+func (self *SmtpConnection) finishCommand(cmd, params string,
+	ret *SmtpReturnCode) {
+	// A code of 0 means the receiver has already responded by itself.
+	var success bool = ret.Code == 0 || (ret.Code >= 200 && ret.Code < 300)
+
+	self.state.mtx.Lock()
+	defer self.state.mtx.Unlock()
+
+	self.state.status.CurrentCommand = ""
+	switch cmd {
+	case "HELO", "EHLO":
+		if success {
+			self.state.status.Helo = params
+			self.state.status.Sender = ""
+			self.state.status.Recipients = 0
+		}
+	case "MAIL":
+		if success {
+			self.state.status.Sender = commandAddress(params)
+			self.state.status.Recipients = 0
+		}
+	case "RCPT":
+		if success {
+			self.state.status.Recipients++
+		}
+	case "DATA", "RSET":
+		if ret.Code == SMTP_BAD_SEQUENCE || ret.Code == SMTP_PARAMETER_ERROR {
+			// The transaction hasn't been touched.
+			break
+		}
+		self.state.status.Sender = ""
+		self.state.status.Recipients = 0
+	}
+}
@@ -33,6 +33,7 @@
 package smtpump
 
 import (
+	"crypto/tls"
 	"expvar"
 	"io"
 	"log"
@@ -42,6 +43,7 @@ import (
 	"time"
 
 	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/metrics"
 )
 
 var smtp_dialog_errors = expvar.NewMap("smtp-dialog-errors")
@@ -51,6 +53,28 @@ var smtp_bytes_out = expvar.NewInt("smtp-bytes-out")
 var smtp_active_connections = expvar.NewInt("smtp-active-connections")
 var nulldeadline time.Time = time.Unix(0, 0)
 
+// Time spent handling SMTP commands, including the callbacks.
+var smtp_command_duration = metrics.NewHistogramVec(
+	"smtp_command_duration_seconds",
+	"Time spent handling SMTP commands, by command.", "command",
+	metrics.DefaultBuckets)
+
+// Commands which are recorded under their own name in
+// smtp_command_duration; everything else is counted as "unknown".
+var smtp_known_commands = map[string]bool{
+	"HELO": true, "EHLO": true, "MAIL": true, "RCPT": true, "DATA": true,
+	"ETRN": true, "RSET": true, "QUIT": true, "STARTTLS": true,
+	"AUTH": true,
+}
+
+// Record the time it took to handle the command "cmd".
+func observeCommand(cmd string, start time.Time) {
+	if !smtp_known_commands[cmd] {
+		cmd = "unknown"
+	}
+	smtp_command_duration.ObserveSinceWithLabel(cmd, start)
+}
+
 // Generic SMTP return code; indicates what the server should respond
 // to the client.
 type SmtpReturnCode struct {
@@ -82,9 +106,19 @@ type SmtpReceiver interface {
 	RcptTo(conn *SmtpConnection, recipient string) SmtpReturnCode
 
 	// Invoked when a DATA command is received. Should invoke
-	// GetDotReader on the connection if it is considered appropriate.
+	// GetDotReader or GetRawDotReader on the connection if it is
+	// considered appropriate.
 	Data(conn *SmtpConnection) SmtpReturnCode
 
+	// Invoked when an AUTH command was received. Should invoke
+	// ReadCredentials on the connection if authentication is permitted.
+	Auth(conn *SmtpConnection, params string) SmtpReturnCode
+
+	// Invoked after TLS has been negotiated following a STARTTLS
+	// command. Everything learned from the client before, such as the
+	// HELO name, must be forgotten (RFC 3207, section 4.2).
+	TlsStarted(conn *SmtpConnection)
+
 	// Invoked when an ETRN command was received.
 	Etrn(conn *SmtpConnection, domain string) SmtpReturnCode
 
@@ -101,20 +135,36 @@ type SmtpConnection struct {
 	cb       SmtpReceiver
 	conn     *textproto.Conn
 	origconn net.Conn
+	policy   string
+	limits   SessionLimits
+	tlsConf  *tls.Config
+	counters sessionCounters
+	state    sessionState
+	registry *sessionRegistry
 	userdata interface{}
 }
 
 // Create a new SMTP connection by doing the SMTP server-side handshake
 // on the socket given as conn. This will spawn a new thread which will
-// handle any callbacks to "cb".
-func newSmtpConnection(conn net.Conn, cb SmtpReceiver) {
+// handle any callbacks to "cb". "policy" is the tag of the listener
+// the connection was accepted on; "limits" are enforced on the session.
+// If "tlsConf" is not nil, clients can switch to TLS using STARTTLS.
+// The session is listed in "registry" while it is active.
+func newSmtpConnection(conn net.Conn, cb SmtpReceiver, policy string,
+	limits SessionLimits, tlsConf *tls.Config, registry *sessionRegistry) {
 	var txt = textproto.NewConn(conn)
-	var ret = SmtpConnection{
+	var ret = &SmtpConnection{
 		active:   true,
 		cb:       cb,
 		conn:     txt,
 		origconn: conn,
+		policy:   policy,
+		limits:   limits,
+		tlsConf:  tlsConf,
+		registry: registry,
 	}
+	ret.state.status.Started = time.Now()
+	registry.add(ret)
 	go ret.handle()
 }
 
@@ -144,7 +194,7 @@ func (self *SmtpConnection) Respond(code int, continued bool, text string) {
 			self.conn.PrintfLine("%03d%s%s", code, sep, line)
 		}
 	}
-	smtp_bytes_out.Add(int64(len(text) + 6))
+	self.countBytesOut(int64(len(text) + 6))
 }
 
 // Send the given SMTP return code back to the client. This will NOT
@@ -156,9 +206,12 @@ func (self *SmtpConnection) RespondWithRCode(code *SmtpReturnCode) {
 
 // Parse a line as a command and run the appropriate handlers.
 // This will block until all appropriate handlers have finished.
-func (self *SmtpConnection) handleCommand(command string) SmtpReturnCode {
+func (self *SmtpConnection) handleCommand(command string) (
+	ret SmtpReturnCode) {
 	var cmd, params string
 	var splitdata []string = strings.SplitN(command, " ", 2)
+	var start time.Time = time.Now()
+	var ok bool
 
 	if len(splitdata) < 1 {
 		smtp_dialog_errors.Add("empty-command", 1)
@@ -170,6 +223,14 @@ func (self *SmtpConnection) handleCommand(command string) SmtpReturnCode {
 		params = ""
 	}
 
+	if ret, ok = self.checkLimits(cmd); !ok {
+		return
+	}
+	defer self.accountCommand(cmd, &ret)
+	defer observeCommand(cmd, start)
+	self.startCommand(cmd)
+	defer self.finishCommand(cmd, params, &ret)
+
 	switch cmd {
 	case "HELO":
 		{
@@ -211,6 +272,14 @@ func (self *SmtpConnection) handleCommand(command string) SmtpReturnCode {
 			self.origconn.SetDeadline(time.Now().Add(10 * time.Minute))
 			return self.cb.Data(self)
 		}
+	case "STARTTLS":
+		{
+			return self.startTls(params)
+		}
+	case "AUTH":
+		{
+			return self.cb.Auth(self, params)
+		}
 	case "ETRN":
 		{
 			return self.cb.Etrn(self, params)
@@ -264,6 +333,7 @@ func (self *SmtpConnection) handle() {
 	defer self.setInactive()
 	defer self.cb.ConnectionClosed(self)
 	defer smtp_active_connections.Add(-1)
+	defer self.registry.remove(self)
 
 	self.origconn.SetReadDeadline(deadline)
 	for time.Now().Before(deadline) {
@@ -273,7 +343,7 @@ func (self *SmtpConnection) handle() {
 			self.RespondWithError(SMTP_CLOSING,
 				"I can break rules, too. Goodbye.")
 			smtp_dialog_errors.Add("unauth-pipelining", 1)
-			smtp_bytes_in.Add(int64(len(cmd)))
+			self.countBytesIn(int64(len(cmd)))
 			return
 		} else if err != nil {
 			var neterr net.Error
@@ -307,7 +377,7 @@ func (self *SmtpConnection) handle() {
 		self.origconn.SetReadDeadline(deadline)
 		cmd, err = self.conn.ReadLine()
 		self.origconn.SetReadDeadline(nulldeadline)
-		smtp_bytes_in.Add(int64(len(cmd)))
+		self.countBytesIn(int64(len(cmd)))
 		if err != nil {
 			var neterr net.Error
 			var ok bool
@@ -359,6 +429,16 @@ func (self *SmtpConnection) GetUserdata() interface{} {
 	return self.userdata
 }
 
+// Retrieve the policy tag of the listener this connection was accepted on.
+func (self *SmtpConnection) GetPolicy() string {
+	return self.policy
+}
+
+// Retrieve the local address the connection was accepted on.
+func (self *SmtpConnection) LocalAddr() net.Addr {
+	return self.origconn.LocalAddr()
+}
+
 // Build and return a dotreader for the connection.
 func (self *SmtpConnection) GetDotReader() io.Reader {
 	return self.conn.DotReader()
@@ -366,10 +446,10 @@ func (self *SmtpConnection) GetDotReader() io.Reader {
 
 // Report the number of bytes read from the peer during the connection.
 func (self *SmtpConnection) ReportBytesRead(length int64) {
-	smtp_bytes_in.Add(length)
+	self.countBytesIn(length)
 }
 
 // Report the number of bytes written to the peer during the connection.
 func (self *SmtpConnection) ReportBytesWritten(length int64) {
-	smtp_bytes_out.Add(length)
+	self.countBytesOut(length)
 }
@@ -0,0 +1,146 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Configuration handling of smtpump-server.
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Read and parse the smtpump-server configuration from "path".
+func readConfig(path string) (*mailpump.SmtpumpConfiguration, error) {
+	var conf = new(mailpump.SmtpumpConfiguration)
+	var contents []byte
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = proto.UnmarshalText(string(contents), conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// Parse a comma separated list of listener specifications of the form
+// policy=network:address (e.g. "mx=tcp:[::]:25,local=unix:/run/smtp").
+func parseListenerSpecs(specs string) ([]*mailpump.SmtpListener, error) {
+	var ret []*mailpump.SmtpListener
+	var spec string
+
+	for _, spec = range strings.Split(specs, ",") {
+		var listener *mailpump.SmtpListener
+		var parts []string
+
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+
+		parts = strings.SplitN(spec, "=", 2)
+		if len(parts) < 2 {
+			return nil, errors.New("Listener specification " + spec +
+				" lacks a policy tag")
+		}
+		listener = new(mailpump.SmtpListener)
+		listener.Policy = new(string)
+		*listener.Policy = parts[0]
+
+		parts = strings.SplitN(parts[1], ":", 2)
+		if len(parts) < 2 {
+			return nil, errors.New("Listener specification " + spec +
+				" lacks a network type")
+		}
+		listener.Network = new(string)
+		*listener.Network = parts[0]
+		listener.Address = new(string)
+		*listener.Address = parts[1]
+
+		ret = append(ret, listener)
+	}
+
+	return ret, nil
+}
+
+// Split a comma separated list, dropping empty elements.
+func splitList(list string) []string {
+	var ret []string
+	var elem string
+
+	for _, elem = range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if len(elem) > 0 {
+			ret = append(ret, elem)
+		}
+	}
+	return ret
+}
+
+// Convert a number of seconds from the configuration into a duration.
+func seconds(secs int64) time.Duration {
+	return time.Duration(secs) * time.Second
+}
+
+// Convert a duration into a number of seconds for the configuration.
+func toSeconds(d time.Duration) *int64 {
+	var ret = new(int64)
+	*ret = int64(d / time.Second)
+	return ret
+}
+
+// Allocate a new int32 with the value "v".
+func int32p(v int) *int32 {
+	var ret = new(int32)
+	*ret = int32(v)
+	return ret
+}
+
+// Determine the names of all flags which were given on the command line.
+func explicitFlags() map[string]bool {
+	var ret = make(map[string]bool)
+
+	flag.Visit(func(f *flag.Flag) {
+		ret[f.Name] = true
+	})
+	return ret
+}
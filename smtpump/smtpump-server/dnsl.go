@@ -0,0 +1,365 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// DNS based block and allow lists for SMTP peers.
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/resolver"
+)
+
+var dnsl_queries = expvar.NewMap("dnsl-queries")
+var dnsl_hits = expvar.NewMap("dnsl-hits")
+var dnsl_errors = expvar.NewMap("dnsl-errors")
+var dnsl_cache_hits = expvar.NewInt("dnsl-cache-hits")
+
+// Actions to take when a peer is listed in a DNS list.
+const (
+	// Refuse the connection.
+	DNSL_REJECT = "reject"
+
+	// Record a SPAM verdict with the configured score.
+	DNSL_SCORE = "score"
+
+	// Exempt the peer from rejections and further checks.
+	DNSL_ALLOW = "allow"
+)
+
+// Configuration of a single DNS list zone.
+type DNSListZone struct {
+	// Name of the zone to query, e.g. zen.spamhaus.org.
+	Zone string
+
+	// Actions to take for specific return codes (e.g. "127.0.0.2"). Codes
+	// not listed here use DefaultAction.
+	Actions map[string]string
+
+	// Action for return codes without a specific action. If empty, such
+	// codes are ignored.
+	DefaultAction string
+
+	// Score to record with DNSL_SCORE verdicts.
+	Score float64
+}
+
+// A listing of a peer in a DNS list.
+type DNSListHit struct {
+	Zone   string
+	Code   string
+	Action string
+	Score  float64
+}
+
+// Cached result of a DNS list query.
+type dnslCacheEntry struct {
+	codes   []string
+	expires time.Time
+}
+
+// Queries DNS lists for SMTP peers and caches the results.
+type DNSListChecker struct {
+	zones    []*DNSListZone
+	resolver resolver.Resolver
+	ttl      time.Duration
+	timeout  time.Duration
+
+	mtx   sync.Mutex
+	cache map[string]dnslCacheEntry
+}
+
+// Create a new DNS list checker querying "zones" through "resolver".
+// Results are cached for "ttl"; queries taking longer than "timeout"
+// are treated as not listed.
+func NewDNSListChecker(zones []*DNSListZone, res resolver.Resolver,
+	ttl, timeout time.Duration) *DNSListChecker {
+	return &DNSListChecker{
+		zones:    zones,
+		resolver: res,
+		ttl:      ttl,
+		timeout:  timeout,
+		cache:    make(map[string]dnslCacheEntry),
+	}
+}
+
+// Build the runtime representation of the DNS list configured in
+// "conf".
+func NewDNSListZone(conf *mailpump.DnsListConfiguration) (
+	*DNSListZone, error) {
+	var ret = &DNSListZone{
+		Zone:          conf.GetZone(),
+		Actions:       make(map[string]string),
+		DefaultAction: conf.GetDefaultAction(),
+		Score:         conf.GetScore(),
+	}
+	var ca *mailpump.DnsListConfiguration_ReturnCodeAction
+	var err error
+
+	if err = checkDNSListAction(ret.DefaultAction, true); err != nil {
+		return nil, err
+	}
+	for _, ca = range conf.CodeActions {
+		if err = checkDNSListAction(ca.GetAction(), false); err != nil {
+			return nil, err
+		}
+		ret.Actions[ca.GetCode()] = ca.GetAction()
+	}
+
+	return ret, nil
+}
+
+// Ensure "action" is one of the known DNS list actions.
+func checkDNSListAction(action string, emptyOk bool) error {
+	if (emptyOk && len(action) == 0) || action == DNSL_REJECT ||
+		action == DNSL_SCORE || action == DNSL_ALLOW {
+		return nil
+	}
+	return errors.New("Unknown DNS list action " + action)
+}
+
+// Parse a comma separated list of zone specifications of the form
+// zone[/code]=action[:score], e.g.
+// "zen.spamhaus.org=reject,list.dnswl.org/127.0.10.0=allow,
+// bl.spamcop.net=score:2.5". Specifications for the same zone are merged.
+func ParseDNSListZones(specs string) (
+	[]*mailpump.DnsListConfiguration, error) {
+	var ret []*mailpump.DnsListConfiguration
+	var byname = make(map[string]*mailpump.DnsListConfiguration)
+	var spec string
+
+	for _, spec = range strings.Split(specs, ",") {
+		var zone *mailpump.DnsListConfiguration
+		var name, code, action string
+		var score float64
+		var parts []string
+		var pos int
+		var err error
+
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+
+		parts = strings.SplitN(spec, "=", 2)
+		if len(parts) < 2 {
+			return nil, errors.New("DNS list " + spec + " lacks an action")
+		}
+		name = parts[0]
+		action = parts[1]
+
+		pos = strings.Index(name, "/")
+		if pos >= 0 {
+			code = name[pos+1:]
+			name = name[:pos]
+		}
+
+		pos = strings.Index(action, ":")
+		if pos >= 0 {
+			score, err = strconv.ParseFloat(action[pos+1:], 64)
+			if err != nil {
+				return nil, errors.New("Invalid score in DNS list " +
+					spec + ": " + err.Error())
+			}
+			action = action[:pos]
+		}
+
+		if err = checkDNSListAction(action, false); err != nil {
+			return nil, err
+		}
+
+		zone = byname[name]
+		if zone == nil {
+			zone = new(mailpump.DnsListConfiguration)
+			zone.Zone = new(string)
+			*zone.Zone = name
+			byname[name] = zone
+			ret = append(ret, zone)
+		}
+		if len(code) > 0 {
+			var ca = new(mailpump.DnsListConfiguration_ReturnCodeAction)
+			ca.Code = new(string)
+			*ca.Code = code
+			ca.Action = new(string)
+			*ca.Action = action
+			zone.CodeActions = append(zone.CodeActions, ca)
+		} else {
+			zone.DefaultAction = new(string)
+			*zone.DefaultAction = action
+		}
+		if score != 0 {
+			zone.Score = new(float64)
+			*zone.Score = score
+		}
+	}
+
+	return ret, nil
+}
+
+// Build the name to query in "zone" for "ip": the reversed octets for
+// IPv4 and the reversed nibbles for IPv6.
+func dnslQueryName(ip net.IP, zone string) string {
+	var parts []string
+	var i int
+
+	if ip.To4() != nil {
+		var ip4 net.IP = ip.To4()
+		for i = len(ip4) - 1; i >= 0; i-- {
+			parts = append(parts, strconv.Itoa(int(ip4[i])))
+		}
+	} else {
+		const hex = "0123456789abcdef"
+		var ip6 net.IP = ip.To16()
+		for i = len(ip6) - 1; i >= 0; i-- {
+			parts = append(parts, string(hex[ip6[i]&0xf]),
+				string(hex[ip6[i]>>4]))
+		}
+	}
+
+	return strings.Join(parts, ".") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// Look up "name", consulting the cache first.
+func (self *DNSListChecker) query(ctx context.Context, zone, name string) (
+	[]string, error) {
+	var entry dnslCacheEntry
+	var codes []string
+	var ok bool
+	var err error
+
+	self.mtx.Lock()
+	entry, ok = self.cache[name]
+	self.mtx.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		dnsl_cache_hits.Add(1)
+		return entry.codes, nil
+	}
+
+	dnsl_queries.Add(zone, 1)
+	codes, err = self.resolver.LookupHost(ctx, name)
+	if err != nil {
+		if !resolver.IsNotFound(err) {
+			dnsl_errors.Add(zone, 1)
+			return nil, err
+		}
+		// Not being listed is a perfectly cacheable result.
+		codes = nil
+	}
+
+	self.mtx.Lock()
+	self.cache[name] = dnslCacheEntry{
+		codes:   codes,
+		expires: time.Now().Add(self.ttl),
+	}
+	self.mtx.Unlock()
+	return codes, nil
+}
+
+// Remove all expired entries from the cache. This will block forever,
+// so run it in a goroutine.
+func (self *DNSListChecker) ExpireCache(interval time.Duration) {
+	for range time.Tick(interval) {
+		var name string
+		var entry dnslCacheEntry
+		var now time.Time = time.Now()
+
+		self.mtx.Lock()
+		for name, entry = range self.cache {
+			if now.After(entry.expires) {
+				delete(self.cache, name)
+			}
+		}
+		self.mtx.Unlock()
+	}
+}
+
+// Query all configured zones for "ip" in parallel and return the hits
+// which map to an action. Lookup errors are counted, but otherwise
+// treated as the peer not being listed.
+func (self *DNSListChecker) Check(ip net.IP) []DNSListHit {
+	var ret []DNSListHit
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var zone *DNSListZone
+
+	ctx, cancel = context.WithTimeout(context.Background(), self.timeout)
+	defer cancel()
+
+	for _, zone = range self.zones {
+		wg.Add(1)
+		go func(zone *DNSListZone) {
+			var codes []string
+			var code string
+			var err error
+
+			defer wg.Done()
+
+			codes, err = self.query(ctx, zone.Zone,
+				dnslQueryName(ip, zone.Zone))
+			if err != nil {
+				return
+			}
+
+			for _, code = range codes {
+				var action string = zone.Actions[code]
+				if len(action) == 0 {
+					action = zone.DefaultAction
+				}
+				if len(action) == 0 {
+					continue
+				}
+
+				dnsl_hits.Add(zone.Zone, 1)
+				mtx.Lock()
+				ret = append(ret, DNSListHit{
+					Zone:   zone.Zone,
+					Code:   code,
+					Action: action,
+					Score:  zone.Score,
+				})
+				mtx.Unlock()
+			}
+		}(zone)
+	}
+
+	wg.Wait()
+	return ret
+}
@@ -0,0 +1,231 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/resolver"
+)
+
+func TestDnslQueryName(t *testing.T) {
+	var tests = []struct {
+		ip, zone, expected string
+	}{
+		{"192.0.2.1", "bl.example", "1.2.0.192.bl.example"},
+		{"192.0.2.1", "bl.example.", "1.2.0.192.bl.example"},
+		{"::ffff:198.51.100.7", "bl.example", "7.100.51.198.bl.example"},
+		{"2001:db8::1", "bl.example",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0." +
+				"8.b.d.0.1.0.0.2.bl.example"},
+	}
+	var i int
+
+	for i = range tests {
+		var name string = dnslQueryName(net.ParseIP(tests[i].ip),
+			tests[i].zone)
+
+		if name != tests[i].expected {
+			t.Errorf("dnslQueryName(%s, %s) = %s, expected %s",
+				tests[i].ip, tests[i].zone, name, tests[i].expected)
+		}
+	}
+}
+
+func TestParseDNSListZones(t *testing.T) {
+	var tests = []struct {
+		specs    string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{"zen.example=reject", "zen.example reject 0 []", false},
+		{" zen.example=reject , bl.example=score:2.5",
+			"zen.example reject 0 []; bl.example score 2.5 []", false},
+		{"wl.example/127.0.10.0=allow,wl.example/127.0.10.1=score:-1",
+			"wl.example  -1 [127.0.10.0=allow 127.0.10.1=score]", false},
+		{"zen.example=reject,zen.example/127.0.0.10=score:1",
+			"zen.example reject 1 [127.0.0.10=score]", false},
+		{"zen.example", "", true},
+		{"zen.example=score:lots", "", true},
+		{"zen.example=ignore", "", true},
+		{"zen.example/127.0.0.2=", "", true},
+	}
+	var i int
+
+	for i = range tests {
+		var confs []*mailpump.DnsListConfiguration
+		var zones []*DNSListZone
+		var zone *DNSListZone
+		var descs []string
+		var j int
+		var err error
+
+		confs, err = ParseDNSListZones(tests[i].specs)
+		if tests[i].err {
+			if err == nil {
+				t.Errorf("ParseDNSListZones(%q) succeeded unexpectedly",
+					tests[i].specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDNSListZones(%q): %s", tests[i].specs, err)
+			continue
+		}
+
+		for j = range confs {
+			if zone, err = NewDNSListZone(confs[j]); err != nil {
+				t.Errorf("NewDNSListZone(%s): %s", confs[j].GetZone(), err)
+				continue
+			}
+			zones = append(zones, zone)
+		}
+		for _, zone = range zones {
+			var actions []string
+			var code, action string
+
+			for code, action = range zone.Actions {
+				actions = append(actions, code+"="+action)
+			}
+			sort.Strings(actions)
+			descs = append(descs, zone.Zone+" "+zone.DefaultAction+" "+
+				strconv.FormatFloat(zone.Score, 'g', -1, 64)+" ["+
+				strings.Join(actions, " ")+"]")
+		}
+		if strings.Join(descs, "; ") != tests[i].expected {
+			t.Errorf("ParseDNSListZones(%q) = %q, expected %q",
+				tests[i].specs, strings.Join(descs, "; "),
+				tests[i].expected)
+		}
+	}
+}
+
+func TestDNSListCheck(t *testing.T) {
+	var zone *resolver.Zone = resolver.NewZone()
+	var checker *DNSListChecker
+	var tests = []struct {
+		ip       string
+		expected []string
+	}{
+		// Listed in the blocklist.
+		{"192.0.2.2", []string{"bl.example 127.0.0.2 reject"}},
+		// Listed with a code which is only scored.
+		{"192.0.2.3", []string{"bl.example 127.0.0.3 score"}},
+		// Allowlisted and listed at the same time.
+		{"192.0.2.4", []string{"bl.example 127.0.0.2 reject",
+			"wl.example 127.0.10.1 allow"}},
+		// Listed in the allowlist with a code it doesn't act on.
+		{"192.0.2.5", nil},
+		// Not listed anywhere.
+		{"192.0.2.6", nil},
+		// Lookup errors count as not listed.
+		{"192.0.2.7", nil},
+		{"2001:db8::2", []string{"bl.example 127.0.0.2 reject"}},
+	}
+	var i int
+
+	zone.AddHost("2.2.0.192.bl.example", "127.0.0.2")
+	zone.AddHost("3.2.0.192.bl.example", "127.0.0.3")
+	zone.AddHost("4.2.0.192.bl.example", "127.0.0.2")
+	zone.AddHost("4.2.0.192.wl.example", "127.0.10.1")
+	zone.AddHost("5.2.0.192.wl.example", "127.0.10.2")
+	zone.SetError("7.2.0.192.bl.example", errors.New("server failure"))
+	zone.AddHost(dnslQueryName(net.ParseIP("2001:db8::2"), "bl.example"),
+		"127.0.0.2")
+
+	checker = NewDNSListChecker([]*DNSListZone{
+		&DNSListZone{
+			Zone:          "bl.example",
+			Actions:       map[string]string{"127.0.0.3": DNSL_SCORE},
+			DefaultAction: DNSL_REJECT,
+			Score:         1.5,
+		},
+		&DNSListZone{
+			Zone:    "wl.example",
+			Actions: map[string]string{"127.0.10.1": DNSL_ALLOW},
+		},
+	}, zone, time.Minute, time.Second)
+
+	for i = range tests {
+		var hits []DNSListHit = checker.Check(net.ParseIP(tests[i].ip))
+		var got []string
+		var hit DNSListHit
+
+		for _, hit = range hits {
+			got = append(got, hit.Zone+" "+hit.Code+" "+hit.Action)
+			if hit.Action == DNSL_SCORE && hit.Score != 1.5 {
+				t.Errorf("Check(%s): score %f, expected 1.5",
+					tests[i].ip, hit.Score)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ", ") != strings.Join(tests[i].expected, ", ") {
+			t.Errorf("Check(%s) = %v, expected %v", tests[i].ip, got,
+				tests[i].expected)
+		}
+	}
+}
+
+func TestDNSListCheckCachesResults(t *testing.T) {
+	var zone *resolver.Zone = resolver.NewZone()
+	var checker *DNSListChecker
+	var ip net.IP = net.ParseIP("192.0.2.2")
+	var hits []DNSListHit
+
+	checker = NewDNSListChecker([]*DNSListZone{
+		&DNSListZone{Zone: "bl.example", DefaultAction: DNSL_REJECT},
+	}, zone, time.Minute, time.Second)
+
+	if hits = checker.Check(ip); len(hits) != 0 {
+		t.Fatalf("Check(%s) = %v before listing", ip, hits)
+	}
+
+	// Not being listed is cached, so a new listing is only seen once
+	// the cache entry has expired.
+	zone.AddHost("2.2.0.192.bl.example", "127.0.0.2")
+	if hits = checker.Check(ip); len(hits) != 0 {
+		t.Errorf("Check(%s) = %v, expected the cached result", ip, hits)
+	}
+
+	checker = NewDNSListChecker(checker.zones, zone, 0, time.Second)
+	if hits = checker.Check(ip); len(hits) != 1 {
+		t.Errorf("Check(%s) = %v without caching", ip, hits)
+	}
+}
@@ -0,0 +1,216 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Greylisting of (peer network, sender, recipient) triplets.
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var greylist_results = expvar.NewMap("greylist-results")
+
+// State of a greylisting triplet, or of a peer network for the
+// auto-whitelist.
+type GreylistRecord struct {
+	// When the triplet was first seen (or last restarted).
+	FirstSeen time.Time
+
+	// When the triplet was last seen.
+	LastSeen time.Time
+
+	// Number of times the triplet has been let through.
+	Passes int
+}
+
+// Storage for greylisting records. Implementations must be safe for
+// concurrent use.
+type GreylistStore interface {
+	// Retrieve the record stored for "key". If there is none, false is
+	// returned.
+	Get(key string) (GreylistRecord, bool, error)
+
+	// Store "record" under "key", replacing any previous record.
+	Put(key string, record GreylistRecord) error
+
+	// Remove all records for which "expired" returns true.
+	Expire(expired func(record GreylistRecord) bool) error
+}
+
+// Decides which mails to defer based on whether we've seen the
+// combination of peer network, sender and recipient before.
+type Greylister struct {
+	store         GreylistStore
+	delay         time.Duration
+	retryWindow   time.Duration
+	lifetime      time.Duration
+	autoWhitelist int
+}
+
+// Create a new greylister keeping its records in "store". New triplets
+// are deferred until "delay" has passed; the sender has to retry within
+// "retryWindow" after that. Triplets which got through are remembered
+// for "lifetime" after they were last seen. Networks which have passed
+// greylisting "autoWhitelist" times aren't greylisted anymore (0 disables
+// this).
+func NewGreylister(store GreylistStore, delay, retryWindow,
+	lifetime time.Duration, autoWhitelist int) *Greylister {
+	return &Greylister{
+		store:         store,
+		delay:         delay,
+		retryWindow:   retryWindow,
+		lifetime:      lifetime,
+		autoWhitelist: autoWhitelist,
+	}
+}
+
+// Determine the network "ip" is in for greylisting purposes: the /24
+// for IPv4 and the /64 for IPv6 addresses, since large senders often
+// retry from a different host of the same network.
+func greylistNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Determine whether mail from "sender" at "ip" to "recipient" should be
+// accepted now. If not, the time the sender should wait before retrying
+// is returned. Storage errors are logged and let the mail through.
+func (self *Greylister) Check(ip net.IP, sender, recipient string) (
+	bool, time.Duration) {
+	var network string = greylistNetwork(ip)
+	var key string = network + "|" + strings.ToLower(sender) + "|" +
+		strings.ToLower(recipient)
+	var record, awl GreylistRecord
+	var now time.Time = time.Now()
+	var found bool
+	var err error
+
+	if self.autoWhitelist > 0 {
+		awl, found, err = self.store.Get("awl|" + network)
+		if err != nil {
+			return self.storeError(err)
+		}
+		if found && awl.Passes >= self.autoWhitelist {
+			awl.LastSeen = now
+			if err = self.store.Put("awl|"+network, awl); err != nil {
+				return self.storeError(err)
+			}
+			greylist_results.Add("whitelisted", 1)
+			return true, 0
+		}
+	}
+
+	record, found, err = self.store.Get(key)
+	if err != nil {
+		return self.storeError(err)
+	}
+
+	if !found || (record.Passes == 0 &&
+		now.Sub(record.FirstSeen) > self.delay+self.retryWindow) {
+		// Never seen before, or the sender took too long to retry.
+		if found {
+			greylist_results.Add("retry-too-late", 1)
+		} else {
+			greylist_results.Add("new", 1)
+		}
+		record = GreylistRecord{
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		if err = self.store.Put(key, record); err != nil {
+			return self.storeError(err)
+		}
+		return false, self.delay
+	}
+
+	record.LastSeen = now
+	if record.Passes == 0 && now.Sub(record.FirstSeen) < self.delay {
+		greylist_results.Add("retry-too-early", 1)
+		if err = self.store.Put(key, record); err != nil {
+			return self.storeError(err)
+		}
+		return false, self.delay - now.Sub(record.FirstSeen)
+	}
+
+	record.Passes++
+	if err = self.store.Put(key, record); err != nil {
+		return self.storeError(err)
+	}
+
+	if self.autoWhitelist > 0 {
+		if awl.FirstSeen.IsZero() {
+			awl.FirstSeen = now
+		}
+		awl.LastSeen = now
+		awl.Passes++
+		if err = self.store.Put("awl|"+network, awl); err != nil {
+			return self.storeError(err)
+		}
+	}
+
+	greylist_results.Add("passed", 1)
+	return true, 0
+}
+
+// Log a storage error and let the mail through.
+func (self *Greylister) storeError(err error) (bool, time.Duration) {
+	log.Print("Greylisting store error: ", err)
+	greylist_results.Add("errors", 1)
+	return true, 0
+}
+
+// Periodically remove records which are no longer relevant: triplets
+// which were never retried in time and everything which hasn't been seen
+// for longer than the lifetime. This will block forever, so run it in a
+// goroutine.
+func (self *Greylister) ExpireRecords(interval time.Duration) {
+	for range time.Tick(interval) {
+		var now time.Time = time.Now()
+		var err error
+
+		err = self.store.Expire(func(record GreylistRecord) bool {
+			if record.Passes == 0 {
+				return now.Sub(record.FirstSeen) >
+					self.delay+self.retryWindow
+			}
+			return now.Sub(record.LastSeen) > self.lifetime
+		})
+		if err != nil {
+			log.Print("Error expiring greylisting records: ", err)
+		}
+	}
+}
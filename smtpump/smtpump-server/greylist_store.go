@@ -0,0 +1,205 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Storage implementations for greylisting records.
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Greylisting store keeping all records in memory. Records are lost when
+// the process terminates.
+type MemoryGreylistStore struct {
+	mtx     sync.RWMutex
+	records map[string]GreylistRecord
+}
+
+// Create a new, empty in-memory greylisting store.
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{
+		records: make(map[string]GreylistRecord),
+	}
+}
+
+// Retrieve the record stored for "key".
+func (self *MemoryGreylistStore) Get(key string) (
+	GreylistRecord, bool, error) {
+	var record GreylistRecord
+	var ok bool
+
+	self.mtx.RLock()
+	defer self.mtx.RUnlock()
+	record, ok = self.records[key]
+	return record, ok, nil
+}
+
+// Store "record" under "key".
+func (self *MemoryGreylistStore) Put(key string,
+	record GreylistRecord) error {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.records[key] = record
+	return nil
+}
+
+// Remove all records for which "expired" returns true.
+func (self *MemoryGreylistStore) Expire(
+	expired func(record GreylistRecord) bool) error {
+	var key string
+	var record GreylistRecord
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for key, record = range self.records {
+		if expired(record) {
+			delete(self.records, key)
+		}
+	}
+	return nil
+}
+
+// Greylisting store for a single node which keeps its records in memory
+// and periodically writes them to a file on disk, from which they are
+// restored on startup.
+type FileGreylistStore struct {
+	MemoryGreylistStore
+	path  string
+	dirty bool
+	wmtx  sync.Mutex
+}
+
+// Create a new greylisting store backed by the file at "path", loading
+// any records previously saved there.
+func NewFileGreylistStore(path string) (*FileGreylistStore, error) {
+	var ret = &FileGreylistStore{
+		MemoryGreylistStore: MemoryGreylistStore{
+			records: make(map[string]GreylistRecord),
+		},
+		path: path,
+	}
+	var f *os.File
+	var err error
+
+	f, err = os.Open(path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&ret.records)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Store "record" under "key". It will be written to disk with the next
+// call to Sync.
+func (self *FileGreylistStore) Put(key string, record GreylistRecord) error {
+	self.MemoryGreylistStore.Put(key, record)
+	self.wmtx.Lock()
+	self.dirty = true
+	self.wmtx.Unlock()
+	return nil
+}
+
+// Remove all records for which "expired" returns true.
+func (self *FileGreylistStore) Expire(
+	expired func(record GreylistRecord) bool) error {
+	self.MemoryGreylistStore.Expire(expired)
+	self.wmtx.Lock()
+	self.dirty = true
+	self.wmtx.Unlock()
+	return nil
+}
+
+// Write all records to disk if they have changed since the last call.
+// The file is replaced atomically, so a crash will leave either the old
+// or the new version behind.
+func (self *FileGreylistStore) Sync() error {
+	var f *os.File
+	var err error
+
+	self.wmtx.Lock()
+	defer self.wmtx.Unlock()
+	if !self.dirty {
+		return nil
+	}
+
+	f, err = ioutil.TempFile(filepath.Dir(self.path),
+		"."+filepath.Base(self.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	self.mtx.RLock()
+	err = gob.NewEncoder(f).Encode(self.records)
+	self.mtx.RUnlock()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Name(), self.path); err != nil {
+		return err
+	}
+	self.dirty = false
+	return nil
+}
+
+// Write the records to disk every "interval". This will block forever,
+// so run it in a goroutine.
+func (self *FileGreylistStore) SyncPeriodically(interval time.Duration) {
+	var err error
+
+	for range time.Tick(interval) {
+		if err = self.Sync(); err != nil {
+			log.Print("Error writing greylisting records to ", self.path,
+				": ", err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Failover and load balancing across multiple mailstream backends.
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+var mailstream_backend_failures = expvar.NewMap(
+	"mailstream-backend-failures")
+var mailstream_backends_down = expvar.NewInt("mailstream-backends-down")
+var mailstream_failovers = expvar.NewInt("mailstream-failovers")
+
+// Returned when there is no mailstream backend left to try.
+var ErrNoMailstreamBackends = errors.New(
+	"No mailstream backends available")
+
+// Strategies for picking the backend to send a call to.
+const (
+	BALANCE_ROUND_ROBIN  = "round-robin"
+	BALANCE_LEAST_LOADED = "least-loaded"
+)
+
+// State of a single mailstream backend.
+type mailstreamBackend struct {
+	client    *MailstreamClient
+	failures  int
+	downUntil time.Time
+}
+
+// Set of mailstream backends which calls are distributed across. Backends
+// which fail repeatedly are taken out of rotation for a while.
+type MailstreamBackends struct {
+	backends    []*mailstreamBackend
+	strategy    string
+	maxFailures int
+	downTime    time.Duration
+
+	mtx  sync.Mutex
+	next int
+}
+
+// Distribute calls across all "clients" using "strategy" (one of the
+// BALANCE_* constants). A backend which failed "maxFailures" times in a
+// row is not used for "downTime".
+func NewMailstreamBackends(clients []*MailstreamClient, strategy string,
+	maxFailures int, downTime time.Duration) (*MailstreamBackends, error) {
+	var ret *MailstreamBackends
+	var client *MailstreamClient
+
+	if len(clients) == 0 {
+		return nil, errors.New("At least one mailstream backend is required")
+	}
+
+	if strategy != BALANCE_ROUND_ROBIN && strategy != BALANCE_LEAST_LOADED {
+		return nil, errors.New("Unknown balancing strategy " + strategy)
+	}
+
+	ret = &MailstreamBackends{
+		strategy:    strategy,
+		maxFailures: maxFailures,
+		downTime:    downTime,
+	}
+	for _, client = range clients {
+		ret.backends = append(ret.backends, &mailstreamBackend{
+			client: client,
+		})
+	}
+
+	return ret, nil
+}
+
+// Determine the order in which the backends should be tried for the
+// next call. Backends which are currently considered down are skipped.
+func (self *MailstreamBackends) pickOrder() []*mailstreamBackend {
+	var ret []*mailstreamBackend
+	var now time.Time = time.Now()
+	var i int
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	for i = range self.backends {
+		var backend *mailstreamBackend
+		backend = self.backends[(self.next+i)%len(self.backends)]
+		if now.Before(backend.downUntil) {
+			continue
+		}
+		ret = append(ret, backend)
+	}
+	self.next = (self.next + 1) % len(self.backends)
+
+	if self.strategy == BALANCE_LEAST_LOADED {
+		sort.SliceStable(ret, func(a, b int) bool {
+			return ret[a].client.Load() < ret[b].client.Load()
+		})
+	}
+
+	return ret
+}
+
+// Record the outcome "err" of a call to "backend".
+func (self *MailstreamBackends) recordResult(backend *mailstreamBackend,
+	err error) {
+	var ok bool
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	// Errors returned by the service itself mean it's alive and well.
+	_, ok = err.(rpc.ServerError)
+	if err == nil || ok {
+		if !backend.downUntil.IsZero() {
+			log.Print("mailstream backend ", backend.client.URI(),
+				" is back up")
+			mailstream_backends_down.Add(-1)
+			backend.downUntil = time.Time{}
+		}
+		backend.failures = 0
+		return
+	}
+
+	mailstream_backend_failures.Add(backend.client.URI(), 1)
+	backend.failures++
+	if backend.failures >= self.maxFailures {
+		if backend.downUntil.IsZero() {
+			log.Print("mailstream backend ", backend.client.URI(),
+				" failed ", backend.failures, " times, taking it out ",
+				"of rotation: ", err)
+			mailstream_backends_down.Add(1)
+		}
+		backend.downUntil = time.Now().Add(self.downTime)
+	}
+}
+
+// Invoke "method" on one of the backends. If the request could not be
+// sent to a backend, it is retried on the next one. Errors which occur
+// after the request may have reached a backend are returned to the caller
+// so that the request isn't processed twice. If no backend could be
+// reached, ErrNoMailstreamBackends is returned.
+func (self *MailstreamBackends) Call(method string, args interface{},
+	reply interface{}) error {
+	var backend *mailstreamBackend
+	var backends []*mailstreamBackend = self.pickOrder()
+	var i int
+	var err error
+
+	for i, backend = range backends {
+		if i > 0 {
+			mailstream_failovers.Add(1)
+		}
+		err = backend.client.Call(method, args, reply)
+		self.recordResult(backend, err)
+		if !isRetriableError(err) {
+			return err
+		}
+		log.Print("Unable to reach mailstream backend ",
+			backend.client.URI(), ": ", err)
+	}
+
+	return ErrNoMailstreamBackends
+}
+
+// Submit "msg" to one of the mailstream backends for delivery.
+func (self *MailstreamBackends) Send(msg *mailpump.MailMessage) (
+	*mailpump.MailSubmissionResult, error) {
+	var resp *mailpump.MailSubmissionResult
+	var err error
+
+	err = self.Call("MailSubmissionService.Send", *msg, &resp)
+	return resp, err
+}
+
+// Ranking of ETRN responses when combining the results of several
+// backends; higher ranks take precedence.
+var etrn_response_rank = map[int32]int{
+	smtpump.SMTP_ETRN_NOT_ALLOWED:      1,
+	smtpump.SMTP_ETRN_UNABLE_TO_QUEUE:  2,
+	smtpump.SMTP_ETRN_NO_MESSAGES:      3,
+	smtpump.SMTP_ETRN_STARTED:          4,
+	smtpump.SMTP_ETRN_PENDING_STARTED:  5,
+	smtpump.SMTP_ETRN_MESSAGES_STARTED: 6,
+}
+
+// Ask all reachable mailstream backends to deliver the mail they have
+// queued for the node in "req", since any of them may hold some. The
+// most favorable of their responses is returned.
+func (self *MailstreamBackends) StartDeliveryRun(req *mailpump.EtrnRequest) (
+	*mailpump.MailSubmissionResult, error) {
+	var backend *mailstreamBackend
+	var ret *mailpump.MailSubmissionResult
+	var err error
+
+	err = ErrNoMailstreamBackends
+	for _, backend = range self.pickOrder() {
+		var resp *mailpump.MailSubmissionResult
+		var callerr error
+
+		callerr = backend.client.Call("MailSubmissionService.StartDeliveryRun",
+			*req, &resp)
+		self.recordResult(backend, callerr)
+		if callerr != nil {
+			log.Print("Error requesting delivery run from ",
+				backend.client.URI(), ": ", callerr)
+			continue
+		}
+		if ret == nil || etrn_response_rank[resp.GetErrorCode()] >
+			etrn_response_rank[ret.GetErrorCode()] {
+			ret = resp
+		}
+		err = nil
+	}
+
+	return ret, err
+}
@@ -0,0 +1,380 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Pooled client for the mailstream submission service.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/rpc"
+	"net/url"
+	"sync"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/certmanager"
+	"github.com/caoimhechaos/go-urlconnection"
+)
+
+var mailstream_dials = expvar.NewInt("mailstream-client-dials")
+var mailstream_dial_errors = expvar.NewMap("mailstream-client-dial-errors")
+var mailstream_open_conns = expvar.NewInt("mailstream-client-open-connections")
+var mailstream_idle_conns = expvar.NewInt("mailstream-client-idle-connections")
+var mailstream_broken_conns = expvar.NewInt("mailstream-client-broken-connections")
+var mailstream_calls = expvar.NewMap("mailstream-client-calls")
+var mailstream_call_errors = expvar.NewMap("mailstream-client-call-errors")
+var mailstream_health_check_errors = expvar.NewInt(
+	"mailstream-client-health-check-errors")
+
+// Error returned when a call could not be made because no connection to
+// the backend could be established. Since the request hasn't been sent,
+// it can safely be retried elsewhere.
+type connectError struct {
+	err error
+}
+
+func (self *connectError) Error() string {
+	return self.err.Error()
+}
+
+// A single connection to mailstream. Since net/rpc multiplexes calls,
+// it can be used by several sessions at the same time.
+type mailstreamConn struct {
+	client   *rpc.Client
+	inflight int
+	lastUsed time.Time
+	removed  bool
+}
+
+// Client for the MailSubmissionService which keeps a pool of
+// connections to mailstream around and reestablishes them as required.
+// It is safe for concurrent use.
+type MailstreamClient struct {
+	uri         string
+	certs       *certmanager.CertificateManager
+	maxConns    int
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mtx     sync.Mutex
+	dialed  *sync.Cond
+	conns   []*mailstreamConn
+	dialing int
+}
+
+// Create a new client connecting to mailstream at "uri". If "certs" is
+// not nil, connections are secured using TLS. At most "maxConns"
+// connections are opened; calls beyond that are spread across them.
+// Up to "maxIdle" connections are kept open while they're not in use,
+// but none longer than "idleTimeout".
+func NewMailstreamClient(uri string, certs *certmanager.CertificateManager,
+	maxConns, maxIdle int, idleTimeout time.Duration) *MailstreamClient {
+	var ret *MailstreamClient
+
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	ret = &MailstreamClient{
+		uri:         uri,
+		certs:       certs,
+		maxConns:    maxConns,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+	}
+	ret.dialed = sync.NewCond(&ret.mtx)
+	return ret
+}
+
+// Establish a new connection to the mailstream backend.
+func (self *MailstreamClient) dial() (*mailstreamConn, error) {
+	var conn net.Conn
+	var err error
+
+	mailstream_dials.Add(1)
+	conn, err = urlconnection.ConnectTimeout(self.uri, time.Second)
+	if err != nil {
+		mailstream_dial_errors.Add(err.Error(), 1)
+		return nil, &connectError{errors.New(
+			"Unable to connect to mailstream on " + self.uri + ": " +
+				err.Error())}
+	}
+
+	if self.certs != nil {
+		var config *tls.Config = self.certs.ClientConfig()
+		var u *url.URL
+
+		u, err = url.Parse(self.uri)
+		if err == nil {
+			config.ServerName, _, err = net.SplitHostPort(u.Host)
+			if err != nil {
+				config.ServerName = u.Host
+			}
+		}
+		conn = tls.Client(conn, config)
+	}
+
+	return &mailstreamConn{
+		client:   rpc.NewClient(conn),
+		lastUsed: time.Now(),
+	}, nil
+}
+
+// Pick the least busy connection for a new call, establishing a new one
+// if all existing connections are busy and the limit allows for it.
+func (self *MailstreamClient) acquire() (*mailstreamConn, error) {
+	var best, mc *mailstreamConn
+	var err error
+
+	self.mtx.Lock()
+	for {
+		best = nil
+		for _, mc = range self.conns {
+			if best == nil || mc.inflight < best.inflight {
+				best = mc
+			}
+		}
+		if best != nil && (best.inflight == 0 ||
+			len(self.conns)+self.dialing >= self.maxConns) {
+			best.inflight++
+			self.mtx.Unlock()
+			self.updateGauges()
+			return best, nil
+		}
+		if len(self.conns)+self.dialing < self.maxConns {
+			break
+		}
+		// All connections we may open are still being established.
+		self.dialed.Wait()
+	}
+
+	// Reserve the slot for the new connection, but don't hold the lock
+	// while dialing.
+	self.dialing++
+	self.mtx.Unlock()
+	mc, err = self.dial()
+	self.mtx.Lock()
+	self.dialing--
+	if err == nil {
+		mc.inflight++
+		self.conns = append(self.conns, mc)
+	}
+	self.dialed.Broadcast()
+	self.mtx.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	self.updateGauges()
+	return mc, nil
+}
+
+// Return the connection "mc" to the pool after a call. If "broken" is
+// set, the connection is discarded.
+func (self *MailstreamClient) release(mc *mailstreamConn, broken bool) {
+	self.mtx.Lock()
+	mc.inflight--
+	mc.lastUsed = time.Now()
+	if broken && !mc.removed {
+		mailstream_broken_conns.Add(1)
+	}
+	if broken || mc.removed {
+		self.removeLocked(mc)
+	}
+	self.mtx.Unlock()
+	self.updateGauges()
+}
+
+// Remove "mc" from the pool and close it once no more calls are in
+// flight on it. Closing it earlier would make net/rpc fail these calls
+// with rpc.ErrShutdown even though their requests may have been sent
+// already, so they could no longer be told apart from requests which
+// were never sent. Must be called with the mutex held.
+func (self *MailstreamClient) removeLocked(mc *mailstreamConn) {
+	var i int
+	var other *mailstreamConn
+
+	if !mc.removed {
+		for i, other = range self.conns {
+			if other == mc {
+				self.conns = append(self.conns[:i], self.conns[i+1:]...)
+				break
+			}
+		}
+		mc.removed = true
+	}
+	if mc.inflight == 0 {
+		mc.client.Close()
+	}
+}
+
+// Update the exported statistics about the pool.
+func (self *MailstreamClient) updateGauges() {
+	var mc *mailstreamConn
+	var idle int64
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	for _, mc = range self.conns {
+		if mc.inflight == 0 {
+			idle++
+		}
+	}
+	mailstream_open_conns.Set(int64(len(self.conns)))
+	mailstream_idle_conns.Set(idle)
+}
+
+// Determine whether "err" indicates that the connection it was returned
+// from can no longer be used.
+func isConnectionError(err error) bool {
+	var ok bool
+
+	if err == nil {
+		return false
+	}
+	_, ok = err.(rpc.ServerError)
+	return !ok
+}
+
+// Determine whether "err" guarantees that the request never reached the
+// backend, so that it is safe to send it again. Since connections are
+// never closed while calls are in flight on them, rpc.ErrShutdown can
+// only be returned if the connection was already shut down when the
+// request was about to be written.
+func isRetriableError(err error) bool {
+	var ok bool
+
+	if err == rpc.ErrShutdown {
+		return true
+	}
+	_, ok = err.(*connectError)
+	return ok
+}
+
+// Retrieve the number of calls currently in flight to the backend.
+func (self *MailstreamClient) Load() int {
+	var mc *mailstreamConn
+	var ret int
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	for _, mc = range self.conns {
+		ret += mc.inflight
+	}
+	return ret
+}
+
+// Retrieve the URI of the backend the client connects to.
+func (self *MailstreamClient) URI() string {
+	return self.uri
+}
+
+// Invoke "method" on the mailstream backend. If the connection turns out
+// to have been closed before the request could be sent, the call is
+// retried once on a fresh connection.
+func (self *MailstreamClient) Call(method string, args interface{},
+	reply interface{}) error {
+	var mc *mailstreamConn
+	var attempt int
+	var err error
+
+	mailstream_calls.Add(method, 1)
+	for attempt = 0; attempt < 2; attempt++ {
+		mc, err = self.acquire()
+		if err != nil {
+			break
+		}
+
+		err = mc.client.Call(method, args, reply)
+		self.release(mc, isConnectionError(err))
+		if !isRetriableError(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		mailstream_call_errors.Add(err.Error(), 1)
+	}
+	return err
+}
+
+// Periodically check all idle connections, closing the ones which are
+// broken, idle for too long or exceeding the number of idle connections
+// to keep around. This will block forever, so run it in a goroutine.
+func (self *MailstreamClient) MaintainConnections(interval time.Duration) {
+	for range time.Tick(interval) {
+		var idle []*mailstreamConn
+		var mc *mailstreamConn
+		var now time.Time = time.Now()
+		var err error
+
+		self.mtx.Lock()
+		// Iterate over a copy since removeLocked modifies the list.
+		for _, mc = range append([]*mailstreamConn(nil), self.conns...) {
+			if mc.inflight > 0 {
+				continue
+			}
+			if len(idle) >= self.maxIdle ||
+				now.Sub(mc.lastUsed) > self.idleTimeout {
+				self.removeLocked(mc)
+				continue
+			}
+			// Keep the connection from being closed while we ping it.
+			mc.inflight++
+			idle = append(idle, mc)
+		}
+		self.mtx.Unlock()
+
+		for _, mc = range idle {
+			var resp mailpump.PingResponse
+			err = mc.client.Call("MailSubmissionService.Ping",
+				mailpump.PingRequest{}, &resp)
+			if err != nil {
+				mailstream_health_check_errors.Add(1)
+				log.Print("Health check of mailstream connection to ",
+					self.uri, " failed: ", err)
+			}
+			// Don't let the health check count as use.
+			self.mtx.Lock()
+			mc.inflight--
+			if err != nil || mc.removed {
+				self.removeLocked(mc)
+			}
+			self.mtx.Unlock()
+		}
+		self.updateGauges()
+	}
+}
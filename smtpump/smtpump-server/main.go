@@ -34,99 +34,518 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/certmanager"
+	"ancient-solutions.com/mailpump/resolver"
 	"ancient-solutions.com/mailpump/smtpump"
 	"github.com/caoimhechaos/go-urlconnection"
 )
 
 func main() {
-	var config *tls.Config
-	var netname, laddr, webaddr string
+	var defaults = new(mailpump.SmtpumpConfiguration)
+	var conf *mailpump.SmtpumpConfiguration
+	var certs *certmanager.CertificateManager
+	var mailstream *MailstreamBackends
+	var dnslists *DNSListChecker
+	var greylister *Greylister
+	var spool *Spool
+	var mailstream_clients []*MailstreamClient
+	var upstream resolver.Resolver
+	var dns *resolver.CachingResolver
+	var srv *smtpump.SMTPServer
+	var inherited []smtpump.InheritedListener
+	var il smtpump.InheritedListener
+	var listener, bind_listener *mailpump.SmtpListener
+	var set map[string]bool
+	var configpath string
+	var netname, laddr, listeners, webaddr string
 	var maxlen int64
-	var insecure_backends bool
+	var max_errors, max_commands, max_recipients, max_transactions int
+	var insecure_backends, validate_recipients, check_senders bool
 	var callback *smtpCallback
 	var uri, buri string
 	var mailstream_uri string
+	var mailstream_balancing string
+	var mailstream_max_conns, mailstream_max_idle int
+	var mailstream_max_failures int
+	var mailstream_down_time time.Duration
+	var mailstream_idle_timeout, mailstream_check_interval time.Duration
 	var cert, key, cacert string
+	var smtp_cert, smtp_key string
+	var starttls bool
+	var cert_check_interval time.Duration
+	var dnsl_zones, dns_server string
+	var dnsl_cache_ttl, dnsl_timeout time.Duration
+	var greylisting bool
+	var greylist_db string
+	var greylist_delay, greylist_window, greylist_lifetime time.Duration
+	var greylist_awl int
+	var spool_dir string
+	var spool_interval, spool_max_age time.Duration
 	var err error
 
+	flag.StringVar(&configpath, "config", "",
+		"Path to the smtpump-server configuration file (an ascii "+
+			"protocol buffer). Flags given on the command line override "+
+			"the values from the file.")
 	flag.StringVar(&netname, "network-type", "tcp",
 		"Type of network connection (tcp, tcp4, tcp6, etc).")
 	flag.StringVar(&laddr, "bind", "[::]:2525",
-		"IP address and port to bind to (e.g. [::]:25).")
-	flag.StringVar(&webaddr, "web-port", "[::]:8025",
+		"IP address and port to bind to (e.g. [::]:25). Ignored if "+
+			"sockets are passed in via systemd socket activation.")
+	flag.StringVar(&listeners, "listeners", "",
+		"Additional comma separated listeners of the form "+
+			"policy=network:address, e.g. "+
+			"\"submission=tcp:[::]:587,local=unix:/run/smtpump.sock\".")
+	flag.StringVar(&webaddr, "web-port", defaults.GetWebPort(),
 		"IP address and port to bind the web server to (e.g. [::]:8025).")
 	flag.StringVar(&uri, "doozer-uri", os.Getenv("DOOZER_URI"),
 		"Doozer URI for lock services.")
 	flag.StringVar(&buri, "doozer-boot-uri", os.Getenv("DOOZER_BOOT_URI"),
 		"Doozer boot URI for finding the right lock service cluster.")
-	flag.Int64Var(&maxlen, "max-length-mb", 20,
+	flag.Int64Var(&maxlen, "max-length-mb", defaults.GetMaxLengthMb(),
 		"Maximum length (in megabytes) acceptable for mails to be accepted.")
-	flag.StringVar(&cert, "cert", "mailstream.crt",
+	flag.IntVar(&max_errors, "max-errors", int(defaults.GetMaxErrors()),
+		"Maximum number of failed commands per session (0 = unlimited).")
+	flag.IntVar(&max_commands, "max-commands",
+		int(defaults.GetMaxCommands()),
+		"Maximum number of commands per session (0 = unlimited).")
+	flag.IntVar(&max_recipients, "max-recipients",
+		int(defaults.GetMaxRecipients()),
+		"Maximum number of recipients per mail (0 = unlimited).")
+	flag.IntVar(&max_transactions, "max-transactions",
+		int(defaults.GetMaxTransactions()),
+		"Maximum number of mails per session (0 = unlimited).")
+	flag.StringVar(&dnsl_zones, "dnsl-zones", "",
+		"Comma separated DNS block/allow lists to check peers against, "+
+			"of the form zone[/code]=reject|allow|score[:score], e.g. "+
+			"\"zen.spamhaus.org=reject,list.dnswl.org=allow\".")
+	flag.DurationVar(&dnsl_cache_ttl, "dnsl-cache-ttl",
+		seconds(defaults.GetDnsListCacheTtl()),
+		"Time to cache DNS list results for.")
+	flag.DurationVar(&dnsl_timeout, "dnsl-timeout",
+		time.Duration(defaults.GetDnsListTimeoutMs())*time.Millisecond,
+		"Maximum time to wait for DNS list results.")
+	flag.StringVar(&dns_server, "dns-server", "",
+		"host:port of a DNS server to send queries to instead of the "+
+			"system resolver.")
+	flag.BoolVar(&greylisting, "greylisting",
+		defaults.GetGreylisting().GetEnabled(),
+		"Temporarily reject mail from unknown senders.")
+	flag.StringVar(&greylist_db, "greylist-db", "",
+		"File to keep greylisting records in. If empty, they are only "+
+			"kept in memory.")
+	flag.DurationVar(&greylist_delay, "greylist-delay",
+		seconds(defaults.GetGreylisting().GetDelay()),
+		"Time after which a greylisted sender may retry.")
+	flag.DurationVar(&greylist_window, "greylist-retry-window",
+		seconds(defaults.GetGreylisting().GetRetryWindow()),
+		"Time after the greylisting delay within which the sender must "+
+			"retry.")
+	flag.DurationVar(&greylist_lifetime, "greylist-lifetime",
+		seconds(defaults.GetGreylisting().GetLifetime()),
+		"Time to remember senders which have passed greylisting.")
+	flag.IntVar(&greylist_awl, "greylist-auto-whitelist",
+		int(defaults.GetGreylisting().GetAutoWhitelist()),
+		"Number of passed triplets after which a network is no longer "+
+			"greylisted (0 = never).")
+	flag.StringVar(&cert, "cert", defaults.GetX509Cert(),
 		"Path to the X.509 certificate of this service.")
-	flag.StringVar(&key, "key", "mailstream.key",
+	flag.StringVar(&key, "key", defaults.GetX509Key(),
 		"Path to the X.509 key of this service.")
-	flag.StringVar(&cacert, "ca-certificate", "cacert.crt",
+	flag.StringVar(&cacert, "ca-certificate", defaults.GetX509CaCert(),
 		"Path to the CA certificate clients will be checked against.")
+	flag.StringVar(&smtp_cert, "smtp-cert", defaults.GetSmtpX509Cert(),
+		"Path to the X.509 certificate presented to SMTP clients.")
+	flag.StringVar(&smtp_key, "smtp-key", defaults.GetSmtpX509Key(),
+		"Path to the X.509 key presented to SMTP clients.")
+	flag.BoolVar(&starttls, "starttls", defaults.GetStarttls(),
+		"Offer STARTTLS to SMTP clients if --smtp-cert and --smtp-key "+
+			"are given.")
+	flag.DurationVar(&cert_check_interval, "cert-check-interval",
+		seconds(defaults.GetCertCheckInterval()),
+		"Interval in which the X.509 certificate files are checked for "+
+			"changes.")
 
 	// Backend connections.
 	flag.StringVar(&mailstream_uri, "mailstream-uri", "",
-		"URI to connect to mailstream (e.g. tcp://localhost:1234).")
-	flag.BoolVar(&insecure_backends, "insecure-backends", false,
+		"Comma separated list of URIs to connect to mailstream "+
+			"(e.g. tcp://mx1:1234,tcp://mx2:1234).")
+	flag.StringVar(&mailstream_balancing, "mailstream-balancing",
+		defaults.GetMailstreamBalancing(), "How to distribute mails "+
+			"across mailstream backends ("+BALANCE_ROUND_ROBIN+" or "+
+			BALANCE_LEAST_LOADED+").")
+	flag.IntVar(&mailstream_max_failures, "mailstream-max-failures",
+		int(defaults.GetMailstreamMaxFailures()),
+		"Number of consecutive errors after which a mailstream backend "+
+			"is considered down.")
+	flag.DurationVar(&mailstream_down_time, "mailstream-down-time",
+		seconds(defaults.GetMailstreamDownTime()),
+		"Time a failed mailstream backend is not used for.")
+	flag.IntVar(&mailstream_max_conns, "mailstream-max-connections",
+		int(defaults.GetMailstreamMaxConnections()),
+		"Maximum number of connections to open to mailstream.")
+	flag.IntVar(&mailstream_max_idle, "mailstream-max-idle",
+		int(defaults.GetMailstreamMaxIdle()),
+		"Maximum number of unused connections to mailstream to keep open.")
+	flag.DurationVar(&mailstream_idle_timeout, "mailstream-idle-timeout",
+		seconds(defaults.GetMailstreamIdleTimeout()),
+		"Time after which unused connections to mailstream are closed.")
+	flag.DurationVar(&mailstream_check_interval,
+		"mailstream-health-check-interval",
+		seconds(defaults.GetMailstreamHealthCheckInterval()),
+		"Interval in which unused connections to mailstream are checked.")
+	flag.StringVar(&spool_dir, "spool-dir", "",
+		"Directory to queue mails in while mailstream is unreachable. "+
+			"If empty, senders are asked to try again later instead.")
+	flag.DurationVar(&spool_interval, "spool-retry-interval",
+		seconds(defaults.GetSpoolRetryInterval()),
+		"Interval in which queued mails are retried.")
+	flag.DurationVar(&spool_max_age, "spool-max-age",
+		seconds(defaults.GetSpoolMaxAge()),
+		"Time after which queued mails are returned to their senders.")
+	flag.BoolVar(&validate_recipients, "validate-recipients",
+		defaults.GetValidateRecipients(),
+		"Ask mailstream whether recipients exist before accepting them.")
+	flag.BoolVar(&check_senders, "check-senders",
+		defaults.GetCheckSenders(),
+		"Ask mailstream whether to accept mail from a sender before "+
+			"accepting MAIL From.")
+	flag.BoolVar(&insecure_backends, "insecure-backends",
+		defaults.GetInsecureBackends(),
 		"Use insecure connections to backends. Do NOT use this for "+
 			"production! Mails with user data will be transmitted unencrypted!")
 	flag.Parse()
 
-	if maxlen < 1 {
-		log.Fatal("Maximum length of a mail must be 1MB or greater.")
+	// Listener for --bind and --network-type. Sockets passed in by
+	// systemd take its place.
+	bind_listener = new(mailpump.SmtpListener)
+	bind_listener.Network = &netname
+	bind_listener.Address = &laddr
+
+	conf = new(mailpump.SmtpumpConfiguration)
+	if len(configpath) > 0 {
+		conf, err = readConfig(configpath)
+		if err != nil {
+			log.Fatal("Error reading ", configpath, ": ", err)
+		}
+	}
+
+	// Let the flags given on the command line override the configuration.
+	set = explicitFlags()
+	if set["network-type"] || set["bind"] {
+		conf.Listeners = []*mailpump.SmtpListener{bind_listener}
 	}
+	if set["listeners"] {
+		var extra []*mailpump.SmtpListener
 
-	if len(uri) > 0 {
-		err = urlconnection.SetupDoozer(buri, uri)
+		extra, err = parseListenerSpecs(listeners)
 		if err != nil {
-			log.Print("Unable to connect to Doozer: ", err, " Disabling.")
+			log.Fatal("Error parsing listeners: ", err)
+		}
+		// --listeners only adds to the other listeners, so keep the
+		// --bind one if the configuration doesn't name any.
+		if len(conf.Listeners) == 0 {
+			conf.Listeners = append(conf.Listeners, bind_listener)
+		}
+		conf.Listeners = append(conf.Listeners, extra...)
+	}
+	if set["web-port"] {
+		conf.WebPort = &webaddr
+	}
+	if set["doozer-uri"] || (conf.DoozerUri == nil && len(uri) > 0) {
+		conf.DoozerUri = &uri
+	}
+	if set["doozer-boot-uri"] || (conf.DoozerBootUri == nil && len(buri) > 0) {
+		conf.DoozerBootUri = &buri
+	}
+	if set["max-length-mb"] {
+		conf.MaxLengthMb = &maxlen
+	}
+	if set["max-errors"] {
+		conf.MaxErrors = int32p(max_errors)
+	}
+	if set["max-commands"] {
+		conf.MaxCommands = int32p(max_commands)
+	}
+	if set["max-recipients"] {
+		conf.MaxRecipients = int32p(max_recipients)
+	}
+	if set["max-transactions"] {
+		conf.MaxTransactions = int32p(max_transactions)
+	}
+	if set["dnsl-zones"] {
+		conf.DnsLists, err = ParseDNSListZones(dnsl_zones)
+		if err != nil {
+			log.Fatal("Error parsing DNS lists: ", err)
 		}
 	}
+	if set["dnsl-cache-ttl"] {
+		conf.DnsListCacheTtl = toSeconds(dnsl_cache_ttl)
+	}
+	if set["dnsl-timeout"] {
+		conf.DnsListTimeoutMs = new(int64)
+		*conf.DnsListTimeoutMs = int64(dnsl_timeout / time.Millisecond)
+	}
+	if set["dns-server"] {
+		conf.DnsServer = &dns_server
+	}
+	if conf.Greylisting == nil {
+		conf.Greylisting = new(mailpump.GreylistConfiguration)
+	}
+	if set["greylisting"] {
+		conf.Greylisting.Enabled = &greylisting
+	}
+	if set["greylist-db"] {
+		conf.Greylisting.DbPath = &greylist_db
+	}
+	if set["greylist-delay"] {
+		conf.Greylisting.Delay = toSeconds(greylist_delay)
+	}
+	if set["greylist-retry-window"] {
+		conf.Greylisting.RetryWindow = toSeconds(greylist_window)
+	}
+	if set["greylist-lifetime"] {
+		conf.Greylisting.Lifetime = toSeconds(greylist_lifetime)
+	}
+	if set["greylist-auto-whitelist"] {
+		conf.Greylisting.AutoWhitelist = int32p(greylist_awl)
+	}
+	if set["cert"] {
+		conf.X509Cert = &cert
+	}
+	if set["key"] {
+		conf.X509Key = &key
+	}
+	if set["ca-certificate"] {
+		conf.X509CaCert = &cacert
+	}
+	if set["smtp-cert"] {
+		conf.SmtpX509Cert = &smtp_cert
+	}
+	if set["smtp-key"] {
+		conf.SmtpX509Key = &smtp_key
+	}
+	if set["starttls"] {
+		conf.Starttls = &starttls
+	}
+	if set["cert-check-interval"] {
+		conf.CertCheckInterval = toSeconds(cert_check_interval)
+	}
+	if set["mailstream-uri"] {
+		conf.MailstreamUris = splitList(mailstream_uri)
+	}
+	if set["mailstream-balancing"] {
+		conf.MailstreamBalancing = &mailstream_balancing
+	}
+	if set["mailstream-max-failures"] {
+		conf.MailstreamMaxFailures = int32p(mailstream_max_failures)
+	}
+	if set["mailstream-down-time"] {
+		conf.MailstreamDownTime = toSeconds(mailstream_down_time)
+	}
+	if set["mailstream-max-connections"] {
+		conf.MailstreamMaxConnections = int32p(mailstream_max_conns)
+	}
+	if set["mailstream-max-idle"] {
+		conf.MailstreamMaxIdle = int32p(mailstream_max_idle)
+	}
+	if set["mailstream-idle-timeout"] {
+		conf.MailstreamIdleTimeout = toSeconds(mailstream_idle_timeout)
+	}
+	if set["mailstream-health-check-interval"] {
+		conf.MailstreamHealthCheckInterval =
+			toSeconds(mailstream_check_interval)
+	}
+	if set["spool-dir"] {
+		conf.SpoolDir = &spool_dir
+	}
+	if set["spool-retry-interval"] {
+		conf.SpoolRetryInterval = toSeconds(spool_interval)
+	}
+	if set["spool-max-age"] {
+		conf.SpoolMaxAge = toSeconds(spool_max_age)
+	}
+	if set["validate-recipients"] {
+		conf.ValidateRecipients = &validate_recipients
+	}
+	if set["check-senders"] {
+		conf.CheckSenders = &check_senders
+	}
+	if set["insecure-backends"] {
+		conf.InsecureBackends = &insecure_backends
+	}
 
-	if !insecure_backends {
-		var tlscert tls.Certificate
-		var certdata []byte
+	if len(conf.Listeners) == 0 {
+		conf.Listeners = append(conf.Listeners, bind_listener)
+	}
 
-		config = new(tls.Config)
-		config.MinVersion = tls.VersionTLS12
+	if conf.GetMaxLengthMb() < 1 {
+		log.Fatal("Maximum length of a mail must be 1MB or greater.")
+	}
 
-		tlscert, err = tls.LoadX509KeyPair(cert, key)
+	if len(conf.GetDoozerUri()) > 0 {
+		err = urlconnection.SetupDoozer(conf.GetDoozerBootUri(),
+			conf.GetDoozerUri())
 		if err != nil {
-			log.Fatal("Unable to load X.509 key pair: ", err)
+			log.Print("Unable to connect to Doozer: ", err, " Disabling.")
 		}
-		config.Certificates = append(config.Certificates, tlscert)
-		config.BuildNameToCertificate()
+	}
 
-		config.RootCAs = x509.NewCertPool()
-		certdata, err = ioutil.ReadFile(cert)
+	if !conf.GetInsecureBackends() {
+		certs, err = certmanager.NewCertificateManager(conf.GetX509Cert(),
+			conf.GetX509Key(), conf.GetX509CaCert())
 		if err != nil {
-			log.Fatal("Error reading ", cacert, ": ", err)
+			log.Fatal(err)
 		}
-		if !config.ClientCAs.AppendCertsFromPEM(certdata) {
-			log.Fatal("Unable to load the X.509 certificates from ", cacert)
+		certs.WatchFiles(seconds(conf.GetCertCheckInterval()))
+		certs.ReloadOnSignal()
+	}
+
+	for _, mailstream_uri = range conf.MailstreamUris {
+		var client *MailstreamClient
+		client = NewMailstreamClient(mailstream_uri, certs,
+			int(conf.GetMailstreamMaxConnections()),
+			int(conf.GetMailstreamMaxIdle()),
+			seconds(conf.GetMailstreamIdleTimeout()))
+		go client.MaintainConnections(
+			seconds(conf.GetMailstreamHealthCheckInterval()))
+		mailstream_clients = append(mailstream_clients, client)
+	}
+	mailstream, err = NewMailstreamBackends(mailstream_clients,
+		conf.GetMailstreamBalancing(), int(conf.GetMailstreamMaxFailures()),
+		seconds(conf.GetMailstreamDownTime()))
+	if err != nil {
+		log.Fatal("Error setting up mailstream backends: ", err)
+	}
+
+	// DNS lists have their own cache with its own lifetime, so they talk
+	// to the upstream resolver directly.
+	upstream = resolver.NewUpstream(conf.GetDnsServer())
+	dns = resolver.NewCachingResolver(upstream,
+		seconds(conf.GetDnsCacheTtl()),
+		seconds(conf.GetDnsNegativeCacheTtl()))
+	go dns.ExpireCache(time.Minute)
+
+	if len(conf.DnsLists) > 0 {
+		var zones []*DNSListZone
+		var zoneconf *mailpump.DnsListConfiguration
+
+		for _, zoneconf = range conf.DnsLists {
+			var zone *DNSListZone
+			zone, err = NewDNSListZone(zoneconf)
+			if err != nil {
+				log.Fatal("Error in DNS list ", zoneconf.GetZone(), ": ",
+					err)
+			}
+			zones = append(zones, zone)
 		}
+		dnslists = NewDNSListChecker(zones, upstream,
+			seconds(conf.GetDnsListCacheTtl()),
+			time.Duration(conf.GetDnsListTimeoutMs())*time.Millisecond)
+		go dnslists.ExpireCache(seconds(conf.GetDnsListCacheTtl()))
+	}
+
+	if conf.GetGreylisting().GetEnabled() {
+		var glconf *mailpump.GreylistConfiguration = conf.GetGreylisting()
+		var store GreylistStore
+
+		if len(glconf.GetDbPath()) > 0 {
+			var filestore *FileGreylistStore
+			filestore, err = NewFileGreylistStore(glconf.GetDbPath())
+			if err != nil {
+				log.Fatal("Error loading greylisting records from ",
+					glconf.GetDbPath(), ": ", err)
+			}
+			go filestore.SyncPeriodically(time.Minute)
+			store = filestore
+		} else {
+			store = NewMemoryGreylistStore()
+		}
+		greylister = NewGreylister(store, seconds(glconf.GetDelay()),
+			seconds(glconf.GetRetryWindow()), seconds(glconf.GetLifetime()),
+			int(glconf.GetAutoWhitelist()))
+		go greylister.ExpireRecords(time.Hour)
+	}
+
+	if len(conf.GetSpoolDir()) > 0 {
+		spool, err = NewSpool(conf.GetSpoolDir(), mailstream,
+			seconds(conf.GetSpoolMaxAge()))
+		if err != nil {
+			log.Fatal("Error setting up spool in ", conf.GetSpoolDir(),
+				": ", err)
+		}
+		go spool.ForwardPeriodically(seconds(conf.GetSpoolRetryInterval()))
+	}
+
+	if conf.PeerChecks == nil {
+		conf.PeerChecks = new(mailpump.PeerCheckConfiguration)
 	}
 
 	callback = &smtpCallback{
-		mailstreamUri:    mailstream_uri,
-		maxContentLength: maxlen * 1048576,
-		tlsConfig:        config,
+		maxContentLength:   conf.GetMaxLengthMb() * 1048576,
+		mailstream:         mailstream,
+		validateRecipients: conf.GetValidateRecipients(),
+		checkSenders:       conf.GetCheckSenders(),
+		dnsLists:           dnslists,
+		greylister:         greylister,
+		spool:              spool,
+		peerChecks:         NewPeerChecker(conf.PeerChecks, dns),
+		submission:         NewSubmissionPolicy(conf.Submission),
+		mimeLimits: mailpump.MimeLimits{
+			MaxDepth: int(conf.GetMimeMaxDepth()),
+			MaxParts: int(conf.GetMimeMaxParts()),
+		},
 	}
-	_, err = smtpump.NewSMTPServer(netname, laddr, *callback)
+	srv = smtpump.NewSMTPServerWithoutListeners(*callback)
+	srv.SetSessionLimits(smtpump.SessionLimits{
+		MaxErrors:       int(conf.GetMaxErrors()),
+		MaxCommands:     int(conf.GetMaxCommands()),
+		MaxRecipients:   int(conf.GetMaxRecipients()),
+		MaxTransactions: int(conf.GetMaxTransactions()),
+	})
+	if conf.GetStarttls() && len(conf.GetSmtpX509Cert()) > 0 &&
+		len(conf.GetSmtpX509Key()) > 0 {
+		var smtp_certs *certmanager.CertificateManager
+
+		smtp_certs, err = certmanager.NewCertificateManager(
+			conf.GetSmtpX509Cert(), conf.GetSmtpX509Key(), "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		smtp_certs.WatchFiles(seconds(conf.GetCertCheckInterval()))
+		smtp_certs.ReloadOnSignal()
+		srv.SetTLSConfig(smtp_certs.ServerConfig(tls.NoClientCert))
+	}
+
+	inherited, err = smtpump.GetSystemdListeners()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error picking up systemd sockets: ", err)
+	}
+	for _, il = range inherited {
+		srv.Serve(il.Listener, il.Name)
+	}
+
+	for _, listener = range conf.Listeners {
+		if len(inherited) > 0 && listener == bind_listener {
+			continue
+		}
+		err = srv.Listen(listener.GetNetwork(), listener.GetAddress(),
+			listener.GetPolicy())
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	http.ListenAndServe(webaddr, nil)
+	RegisterSessionAdmin(srv)
+
+	log.Print("Listening on ", srv.Addrs())
+
+	http.ListenAndServe(conf.GetWebPort(), nil)
 }
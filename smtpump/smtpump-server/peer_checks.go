@@ -0,0 +1,359 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Checks of the reverse DNS and HELO names of SMTP peers.
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/resolver"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+var fcrdns_results = expvar.NewMap("fcrdns-results")
+var helo_check_results = expvar.NewMap("helo-check-results")
+
+// Verifies the names SMTP peers claim for themselves.
+type PeerChecker struct {
+	config     *mailpump.PeerCheckConfiguration
+	resolver   resolver.Resolver
+	timeout    time.Duration
+	localNames map[string]bool
+}
+
+// Outcome of looking up the reverse DNS names of a peer.
+type FCrDNSResult struct {
+	// All names the address of the peer maps to.
+	Names []string
+
+	// Those of the names which resolve back to the address of the peer.
+	Confirmed []string
+
+	// Set if the lookup could not be completed due to a temporary error.
+	Temporary bool
+}
+
+// Create a new peer checker configured by "config", using "res" for all
+// lookups.
+func NewPeerChecker(config *mailpump.PeerCheckConfiguration,
+	res resolver.Resolver) *PeerChecker {
+	var ret = &PeerChecker{
+		config:     config,
+		resolver:   res,
+		timeout:    time.Duration(config.GetTimeoutMs()) * time.Millisecond,
+		localNames: make(map[string]bool),
+	}
+	var name string
+
+	for _, name = range config.LocalNames {
+		ret.localNames[normalizeName(name)] = true
+	}
+	if len(ret.localNames) == 0 {
+		var err error
+		if name, err = os.Hostname(); err == nil {
+			ret.localNames[normalizeName(name)] = true
+		}
+	}
+	return ret
+}
+
+// Bring a host name into a canonical form for comparisons.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Look up the reverse DNS names of "ip" and determine which of them
+// resolve back to it.
+func (self *PeerChecker) LookupFCrDNS(ip net.IP) FCrDNSResult {
+	var ret FCrDNSResult
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var name string
+	var err error
+
+	ctx, cancel = resolver.WithTimeout(self.timeout)
+	defer cancel()
+
+	ret.Names, err = self.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		ret.Temporary = !resolver.IsNotFound(err)
+		return ret
+	}
+	if !self.config.GetCheckFcrdns() {
+		return ret
+	}
+
+	for _, name = range ret.Names {
+		var addrs []string
+		var addr string
+
+		addrs, err = self.resolver.LookupHost(ctx, name)
+		if err != nil {
+			if !resolver.IsNotFound(err) {
+				ret.Temporary = true
+			}
+			continue
+		}
+		for _, addr = range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				ret.Confirmed = append(ret.Confirmed, normalizeName(name))
+				break
+			}
+		}
+	}
+	if len(ret.Confirmed) > 0 {
+		ret.Temporary = false
+	}
+	return ret
+}
+
+// Turn the result of a reverse DNS lookup of "ip" into a verdict and,
+// if required by the policy, a rejection. Rejections are skipped if
+// "exempt" is set.
+func (self *PeerChecker) CheckFCrDNS(ip net.IP, res FCrDNSResult,
+	exempt bool) (verdict *mailpump.QualityVerdict,
+	ret smtpump.SmtpReturnCode) {
+	if !self.config.GetCheckFcrdns() {
+		return
+	}
+
+	if len(res.Confirmed) > 0 {
+		fcrdns_results.Add("confirmed", 1)
+		verdict = mailpump.NewVerdict("FCrDNS", mailpump.QualityVerdict_OK,
+			res.Confirmed[0]+" resolves back to "+ip.String())
+		return
+	}
+
+	if res.Temporary {
+		fcrdns_results.Add("temporary-error", 1)
+		if self.config.GetRequireFcrdns() && !exempt {
+			ret.Code = smtpump.SMTP_UNAVAIL
+			ret.Message = "Temporary failure looking up [" + ip.String() +
+				"], please try again later"
+			ret.Terminate = true
+		}
+		return
+	}
+
+	verdict = mailpump.NewVerdict("FCrDNS", mailpump.QualityVerdict_SPAM,
+		"")
+	verdict.Score = new(float64)
+	*verdict.Score = self.config.GetFcrdnsFailureScore()
+	if len(res.Names) == 0 {
+		fcrdns_results.Add("no-ptr", 1)
+		*verdict.Reason = ip.String() + " has no reverse DNS"
+	} else {
+		fcrdns_results.Add("mismatch", 1)
+		*verdict.Reason = "None of the reverse DNS names of " +
+			ip.String() + " resolve back to it"
+	}
+
+	if self.config.GetRequireFcrdns() && !exempt {
+		ret.Code = smtpump.SMTP_TRANSACTION_FAILED
+		ret.Message = "Client [" + ip.String() +
+			"] has no forward-confirmed reverse DNS"
+		ret.Terminate = true
+	}
+	return
+}
+
+// Determine whether "name" is a syntactically valid fully qualified
+// domain name.
+func isValidDomain(name string) bool {
+	var labels []string
+	var label string
+	var i int
+
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels = strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label = range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' ||
+			label[len(label)-1] == '-' {
+			return false
+		}
+		for i = 0; i < len(label); i++ {
+			var c byte = label[i]
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	// Top level domains are never numeric; this is an IP address.
+	label = labels[len(labels)-1]
+	for i = 0; i < len(label); i++ {
+		if label[i] < '0' || label[i] > '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse an address literal as specified in RFC 5321, section 4.1.3,
+// e.g. "[192.0.2.1]" or "[IPv6:2001:db8::1]". Returns nil if "literal"
+// isn't a valid address literal.
+func parseAddressLiteral(literal string) net.IP {
+	var ip net.IP
+
+	if !strings.HasPrefix(literal, "[") || !strings.HasSuffix(literal, "]") {
+		return nil
+	}
+	literal = literal[1 : len(literal)-1]
+
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		ip = net.ParseIP(literal[5:])
+		if ip == nil || !strings.Contains(literal[5:], ":") {
+			return nil
+		}
+		return ip
+	}
+
+	ip = net.ParseIP(literal)
+	if ip == nil || ip.To4() == nil || strings.Contains(literal, ":") {
+		return nil
+	}
+	return ip
+}
+
+// Create a SPAM verdict about the HELO name with the score "score".
+func heloVerdict(score float64, reason string) *mailpump.QualityVerdict {
+	var ret = mailpump.NewVerdict("HELO", mailpump.QualityVerdict_SPAM,
+		reason)
+	ret.Score = new(float64)
+	*ret.Score = score
+	return ret
+}
+
+// Check the name "helo" a peer from "peer" has given in HELO/EHLO on a
+// connection to "local". "rdns" are the forward-confirmed reverse DNS
+// names of the peer. Rejections are skipped if "exempt" is set.
+func (self *PeerChecker) CheckHelo(helo string, peer, local net.IP,
+	rdns []string, exempt bool) (verdicts []*mailpump.QualityVerdict,
+	ret smtpump.SmtpReturnCode) {
+	var literal net.IP
+	var name string
+
+	if !self.config.GetCheckHelo() {
+		return
+	}
+
+	if net.ParseIP(helo) != nil {
+		helo_check_results.Add("bare-ip", 1)
+		verdicts = append(verdicts, heloVerdict(
+			self.config.GetInvalidHeloScore(),
+			"HELO "+helo+" is a bare IP address instead of an address "+
+				"literal"))
+		literal = net.ParseIP(helo)
+		if self.config.GetRejectInvalidHelo() && !exempt {
+			ret.Code = smtpump.SMTP_PARAMETER_ERROR
+			ret.Message = "IP addresses in HELO must be enclosed in " +
+				"brackets, e.g. [" + helo + "]"
+			return
+		}
+	} else if literal = parseAddressLiteral(helo); literal == nil &&
+		!isValidDomain(helo) {
+		helo_check_results.Add("invalid", 1)
+		verdicts = append(verdicts, heloVerdict(
+			self.config.GetInvalidHeloScore(),
+			"HELO "+helo+" is not a valid hostname"))
+		if self.config.GetRejectInvalidHelo() && !exempt {
+			ret.Code = smtpump.SMTP_PARAMETER_ERROR
+			ret.Message = "HELO requires a fully qualified hostname or " +
+				"an address literal"
+		}
+		return
+	}
+
+	// Someone claiming to be us is almost certainly lying.
+	if (literal != nil && local != nil && literal.Equal(local) &&
+		!literal.Equal(peer)) ||
+		(literal == nil && self.localNames[normalizeName(helo)]) {
+		helo_check_results.Add("impersonation", 1)
+		verdicts = append(verdicts, heloVerdict(
+			self.config.GetHeloImpersonationScore(),
+			"HELO "+helo+" claims to be this server"))
+		if self.config.GetRejectHeloImpersonation() && !exempt {
+			ret.Code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+			ret.Message = "You are not me"
+		}
+		return
+	}
+
+	if literal != nil {
+		if literal.Equal(peer) {
+			helo_check_results.Add("matches-peer", 1)
+			verdicts = append(verdicts, mailpump.NewVerdict("HELO",
+				mailpump.QualityVerdict_OK,
+				"HELO "+helo+" matches the peer address"))
+		} else {
+			helo_check_results.Add("mismatch", 1)
+			verdicts = append(verdicts, heloVerdict(
+				self.config.GetHeloMismatchScore(),
+				"HELO "+helo+" doesn't match the peer address "+
+					peer.String()))
+		}
+		return
+	}
+
+	if len(rdns) == 0 {
+		helo_check_results.Add("no-rdns", 1)
+		return
+	}
+	for _, name = range rdns {
+		if normalizeName(helo) == name {
+			helo_check_results.Add("matches-rdns", 1)
+			verdicts = append(verdicts, mailpump.NewVerdict("HELO",
+				mailpump.QualityVerdict_OK,
+				"HELO "+helo+" matches the reverse DNS"))
+			return
+		}
+	}
+	helo_check_results.Add("mismatch", 1)
+	verdicts = append(verdicts, heloVerdict(
+		self.config.GetHeloMismatchScore(),
+		"HELO "+helo+" doesn't match the reverse DNS name "+rdns[0]))
+	return
+}
@@ -0,0 +1,252 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/resolver"
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Create a peer checker which rejects everything it can, looking names
+// up in "zone".
+func strictPeerChecker(zone *resolver.Zone) *PeerChecker {
+	var config = new(mailpump.PeerCheckConfiguration)
+	var yes bool = true
+
+	config.RequireFcrdns = &yes
+	config.RejectInvalidHelo = &yes
+	config.RejectHeloImpersonation = &yes
+	config.LocalNames = []string{"mx.example.net"}
+	return NewPeerChecker(config, zone)
+}
+
+func TestLookupFCrDNS(t *testing.T) {
+	var zone *resolver.Zone = resolver.NewZone()
+	var checker *PeerChecker
+	var tests = []struct {
+		ip                string
+		names, confirmed  int
+		temporary         bool
+		expectedConfirmed string
+	}{
+		{"192.0.2.1", 2, 1, false, "mail.example.com"},
+		{"192.0.2.2", 1, 0, false, ""},
+		{"192.0.2.3", 0, 0, false, ""},
+		{"192.0.2.4", 0, 0, true, ""},
+		{"192.0.2.5", 1, 0, true, ""},
+		{"2001:db8::25", 1, 1, false, "mail6.example.com"},
+	}
+	var i int
+
+	zone.AddPTR("192.0.2.1", "Mail.Example.COM.")
+	zone.AddPTR("192.0.2.1", "unknown.example.com.")
+	zone.AddHost("mail.example.com", "192.0.2.1")
+	zone.AddPTR("192.0.2.2", "spoofed.example.com.")
+	zone.AddHost("spoofed.example.com", "198.51.100.2")
+	zone.SetError("192.0.2.4", errors.New("server failure"))
+	zone.AddPTR("192.0.2.5", "broken.example.com.")
+	zone.SetError("broken.example.com", errors.New("server failure"))
+	zone.AddPTR("2001:db8::25", "mail6.example.com.")
+	zone.AddHost("mail6.example.com", "2001:db8:0:0::25")
+	checker = strictPeerChecker(zone)
+
+	for i = range tests {
+		var res FCrDNSResult = checker.LookupFCrDNS(
+			net.ParseIP(tests[i].ip))
+
+		if len(res.Names) != tests[i].names ||
+			len(res.Confirmed) != tests[i].confirmed ||
+			res.Temporary != tests[i].temporary {
+			t.Errorf("LookupFCrDNS(%s) = %+v", tests[i].ip, res)
+			continue
+		}
+		if tests[i].confirmed > 0 &&
+			res.Confirmed[0] != tests[i].expectedConfirmed {
+			t.Errorf("LookupFCrDNS(%s) confirmed %s, expected %s",
+				tests[i].ip, res.Confirmed[0], tests[i].expectedConfirmed)
+		}
+	}
+}
+
+func TestCheckFCrDNS(t *testing.T) {
+	var checker *PeerChecker = strictPeerChecker(resolver.NewZone())
+	var ip net.IP = net.ParseIP("192.0.2.1")
+	var tests = []struct {
+		res       FCrDNSResult
+		exempt    bool
+		verdict   mailpump.QualityVerdict_VerdictType
+		code      int
+		terminate bool
+	}{
+		{FCrDNSResult{Names: []string{"a.example"},
+			Confirmed: []string{"a.example"}}, false,
+			mailpump.QualityVerdict_OK, 0, false},
+		{FCrDNSResult{Names: []string{"a.example"}}, false,
+			mailpump.QualityVerdict_SPAM, smtpump.SMTP_TRANSACTION_FAILED,
+			true},
+		{FCrDNSResult{}, false, mailpump.QualityVerdict_SPAM,
+			smtpump.SMTP_TRANSACTION_FAILED, true},
+		{FCrDNSResult{}, true, mailpump.QualityVerdict_SPAM, 0, false},
+		{FCrDNSResult{Temporary: true}, false, -1, smtpump.SMTP_UNAVAIL,
+			true},
+		{FCrDNSResult{Temporary: true}, true, -1, 0, false},
+	}
+	var i int
+
+	for i = range tests {
+		var verdict *mailpump.QualityVerdict
+		var ret smtpump.SmtpReturnCode
+
+		verdict, ret = checker.CheckFCrDNS(ip, tests[i].res,
+			tests[i].exempt)
+		if tests[i].verdict < 0 && verdict != nil {
+			t.Errorf("Test %d: unexpected verdict %v", i, verdict)
+		} else if tests[i].verdict >= 0 &&
+			(verdict == nil || verdict.GetVerdict() != tests[i].verdict) {
+			t.Errorf("Test %d: verdict %v, expected %v", i, verdict,
+				tests[i].verdict)
+		}
+		if ret.Code != tests[i].code || ret.Terminate != tests[i].terminate {
+			t.Errorf("Test %d: returned %d (terminate: %v), expected %d "+
+				"(terminate: %v)", i, ret.Code, ret.Terminate,
+				tests[i].code, tests[i].terminate)
+		}
+	}
+}
+
+func TestCheckHelo(t *testing.T) {
+	var checker *PeerChecker = strictPeerChecker(resolver.NewZone())
+	var peer net.IP = net.ParseIP("192.0.2.1")
+	var local net.IP = net.ParseIP("198.51.100.25")
+	var rdns = []string{"mail.example.com"}
+	var tests = []struct {
+		helo    string
+		exempt  bool
+		verdict mailpump.QualityVerdict_VerdictType
+		code    int
+	}{
+		{"mail.example.com", false, mailpump.QualityVerdict_OK, 0},
+		{"MAIL.example.com.", false, mailpump.QualityVerdict_OK, 0},
+		{"other.example.com", false, mailpump.QualityVerdict_SPAM, 0},
+		{"[192.0.2.1]", false, mailpump.QualityVerdict_OK, 0},
+		{"[192.0.2.99]", false, mailpump.QualityVerdict_SPAM, 0},
+		{"192.0.2.1", false, mailpump.QualityVerdict_SPAM,
+			smtpump.SMTP_PARAMETER_ERROR},
+		{"192.0.2.1", true, mailpump.QualityVerdict_SPAM, 0},
+		{"localhost", false, mailpump.QualityVerdict_SPAM,
+			smtpump.SMTP_PARAMETER_ERROR},
+		{"bad_name.example.com", true, mailpump.QualityVerdict_SPAM, 0},
+		{"mx.example.net", false, mailpump.QualityVerdict_SPAM,
+			smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl},
+		{"[198.51.100.25]", false, mailpump.QualityVerdict_SPAM,
+			smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl},
+		{"mx.example.net", true, mailpump.QualityVerdict_SPAM, 0},
+	}
+	var i int
+
+	for i = range tests {
+		var verdicts []*mailpump.QualityVerdict
+		var ret smtpump.SmtpReturnCode
+
+		verdicts, ret = checker.CheckHelo(tests[i].helo, peer, local,
+			rdns, tests[i].exempt)
+		if len(verdicts) == 0 ||
+			verdicts[0].GetVerdict() != tests[i].verdict {
+			t.Errorf("CheckHelo(%q): verdicts %v, expected %v",
+				tests[i].helo, verdicts, tests[i].verdict)
+		}
+		if ret.Code != tests[i].code {
+			t.Errorf("CheckHelo(%q): returned %d, expected %d",
+				tests[i].helo, ret.Code, tests[i].code)
+		}
+	}
+}
+
+func TestIsValidDomain(t *testing.T) {
+	var tests = []struct {
+		name  string
+		valid bool
+	}{
+		{"mail.example.com", true},
+		{"mail.example.com.", true},
+		{"xn--bcher-kva.example", true},
+		{"a-b.example", true},
+		{"localhost", false},
+		{"", false},
+		{".", false},
+		{"-mail.example.com", false},
+		{"mail-.example.com", false},
+		{"mail..example.com", false},
+		{"mail_1.example.com", false},
+		{"192.0.2.1", false},
+		{"[192.0.2.1]", false},
+	}
+	var i int
+
+	for i = range tests {
+		if isValidDomain(tests[i].name) != tests[i].valid {
+			t.Errorf("isValidDomain(%q) = %v", tests[i].name,
+				!tests[i].valid)
+		}
+	}
+}
+
+func TestParseAddressLiteral(t *testing.T) {
+	var tests = []struct {
+		literal, expected string
+	}{
+		{"[192.0.2.1]", "192.0.2.1"},
+		{"[IPv6:2001:db8::1]", "2001:db8::1"},
+		{"[ipv6:2001:db8::1]", "2001:db8::1"},
+		{"[IPv6:192.0.2.1]", ""},
+		{"[2001:db8::1]", ""},
+		{"192.0.2.1", ""},
+		{"[192.0.2.256]", ""},
+		{"[]", ""},
+	}
+	var i int
+
+	for i = range tests {
+		var ip net.IP = parseAddressLiteral(tests[i].literal)
+
+		if (ip == nil) != (len(tests[i].expected) == 0) ||
+			(ip != nil && ip.String() != tests[i].expected) {
+			t.Errorf("parseAddressLiteral(%q) = %v, expected %q",
+				tests[i].literal, ip, tests[i].expected)
+		}
+	}
+}
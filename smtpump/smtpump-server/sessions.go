@@ -0,0 +1,223 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Inspection of the SMTP sessions currently handled by smtpump-server.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ancient-solutions.com/mailpump/smtpump"
+)
+
+// Names of the TLS versions, for display purposes.
+var tls_version_names = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// Information about an SMTP session as exported by the admin pages.
+type sessionInfo struct {
+	Id             uint64  `json:"id"`
+	Policy         string  `json:"policy"`
+	Peer           string  `json:"peer"`
+	LocalAddr      string  `json:"local_addr"`
+	Revdns         string  `json:"revdns"`
+	Helo           string  `json:"helo"`
+	User           string  `json:"authenticated_user"`
+	Tls            string  `json:"tls"`
+	CurrentCommand string  `json:"current_command"`
+	Sender         string  `json:"sender"`
+	Recipients     int     `json:"recipients"`
+	BytesIn        int64   `json:"bytes_in"`
+	BytesOut       int64   `json:"bytes_out"`
+	Started        string  `json:"started"`
+	Age            float64 `json:"age_seconds"`
+}
+
+// Describe the TLS state of a session in human readable form.
+func describeTls(status smtpump.SessionStatus) string {
+	var version string
+	var ok bool
+
+	if !status.Tls {
+		return ""
+	}
+	if version, ok = tls_version_names[status.TlsVersion]; !ok {
+		version = "TLS 0x" + strconv.FormatUint(uint64(status.TlsVersion), 16)
+	}
+	return version + " " + tls.CipherSuiteName(status.TlsCipher)
+}
+
+// Convert the status of a session into the exported form.
+func newSessionInfo(status smtpump.SessionStatus, now time.Time) sessionInfo {
+	return sessionInfo{
+		Id:             status.Id,
+		Policy:         status.Policy,
+		Peer:           status.Peer,
+		LocalAddr:      status.LocalAddr,
+		Revdns:         status.PeerName,
+		Helo:           status.Helo,
+		User:           status.AuthenticatedUser,
+		Tls:            describeTls(status),
+		CurrentCommand: status.CurrentCommand,
+		Sender:         status.Sender,
+		Recipients:     status.Recipients,
+		BytesIn:        status.BytesIn,
+		BytesOut:       status.BytesOut,
+		Started:        status.Started.Format(time.RFC3339),
+		Age:            now.Sub(status.Started).Seconds(),
+	}
+}
+
+// HTTP handlers for listing and closing the sessions of an SMTP server.
+type SessionAdmin struct {
+	srv *smtpump.SMTPServer
+}
+
+// Create the admin pages for the sessions of "srv" and register them
+// under /sessions of the default HTTP server.
+func RegisterSessionAdmin(srv *smtpump.SMTPServer) *SessionAdmin {
+	var ret = &SessionAdmin{srv: srv}
+
+	http.HandleFunc("/sessions", ret.ServeList)
+	http.HandleFunc("/sessions.json", ret.ServeJSON)
+	http.HandleFunc("/sessions/close", ret.ServeClose)
+	return ret
+}
+
+// Collect information about all active sessions.
+func (self *SessionAdmin) sessions() []sessionInfo {
+	var ret []sessionInfo = make([]sessionInfo, 0)
+	var conn *smtpump.SmtpConnection
+	var now time.Time = time.Now()
+
+	for _, conn = range self.srv.Sessions() {
+		ret = append(ret, newSessionInfo(conn.Status(), now))
+	}
+	return ret
+}
+
+var session_list_template = template.Must(template.New("sessions").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>Active SMTP sessions</title></head>
+<body>
+<h1>Active SMTP sessions</h1>
+<table border="1">
+<tr><th>ID</th><th>Policy</th><th>Peer</th><th>rDNS</th><th>HELO</th>
+<th>User</th><th>TLS</th><th>Command</th><th>Sender</th><th>Recipients</th>
+<th>Bytes in</th><th>Bytes out</th><th>Age (s)</th><th></th></tr>
+{{range .}}<tr><td>{{.Id}}</td><td>{{.Policy}}</td><td>{{.Peer}}</td>
+<td>{{.Revdns}}</td><td>{{.Helo}}</td><td>{{.User}}</td><td>{{.Tls}}</td>
+<td>{{.CurrentCommand}}</td><td>{{.Sender}}</td><td>{{.Recipients}}</td>
+<td>{{.BytesIn}}</td><td>{{.BytesOut}}</td><td>{{printf "%.0f" .Age}}</td>
+<td><form method="post" action="/sessions/close">
+<input type="hidden" name="id" value="{{.Id}}">
+<input type="submit" value="Close"></form></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Display a table of all active sessions.
+func (self *SessionAdmin) ServeList(rw http.ResponseWriter,
+	req *http.Request) {
+	var err error
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = session_list_template.Execute(rw, self.sessions())
+	if err != nil {
+		log.Print("Error rendering session list: ", err)
+	}
+}
+
+// Export all active sessions as a JSON list.
+func (self *SessionAdmin) ServeJSON(rw http.ResponseWriter,
+	req *http.Request) {
+	var err error
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(self.sessions())
+	if err != nil {
+		log.Print("Error encoding session list: ", err)
+	}
+}
+
+// Forcibly close the session given in the "id" form value. Only POST
+// requests are accepted so that crawlers and prefetchers can't close
+// sessions by accident.
+func (self *SessionAdmin) ServeClose(rw http.ResponseWriter,
+	req *http.Request) {
+	var conn *smtpump.SmtpConnection
+	var id uint64
+	var err error
+
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Sessions can only be closed using POST",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err = strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(rw, "Invalid session ID: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	conn = self.srv.GetSession(id)
+	if conn == nil {
+		http.Error(rw, "No such session", http.StatusNotFound)
+		return
+	}
+
+	if err = conn.Close(); err != nil {
+		http.Error(rw, "Error closing session: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if req.Header.Get("Accept") == "application/json" {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(rw, req, "/sessions", http.StatusSeeOther)
+}
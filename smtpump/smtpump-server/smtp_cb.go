@@ -33,29 +33,34 @@
 package main
 
 import (
-	"crypto/tls"
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/mail"
-	"net/rpc"
-	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"ancient-solutions.com/mailpump"
 	"ancient-solutions.com/mailpump/smtpump"
-	"github.com/caoimhechaos/go-urlconnection"
 )
 
 type smtpCallback struct {
 	smtpump.SmtpReceiver
-	mailstreamUri    string
-	maxContentLength int64
-	tlsConfig        *tls.Config
+	maxContentLength   int64
+	mailstream         *MailstreamBackends
+	validateRecipients bool
+	checkSenders       bool
+	dnsLists           *DNSListChecker
+	greylister         *Greylister
+	spool              *Spool
+	peerChecks         *PeerChecker
+	submission         *SubmissionPolicy
+	mimeLimits         mailpump.MimeLimits
 }
 
 var features = []string{"ETRN", "8BITMIME", "DSN"}
@@ -63,59 +68,81 @@ var features = []string{"ETRN", "8BITMIME", "DSN"}
 // String representation of an email regular expression.
 var email_re string = "([\\w\\+-\\.]+(?:%[\\w\\+-\\.]+)?@[\\w\\+-\\.]+)"
 
-// RE match to extract the mail address from a MAIL From command.
+// RE match to extract the mail address and the parameters from a MAIL
+// From command. The address may be empty (<>) for the null sender.
 var from_re *regexp.Regexp = regexp.MustCompile(
-	"^[Ff][Rr][Oo][Mm]:\\s*(?:<" + email_re + ">|" + email_re + ")$")
+	"^[Ff][Rr][Oo][Mm]:\\s*(?:<" + email_re + "?>|" + email_re +
+		")((?:\\s+\\S+)*)\\s*$")
 
-// RE match to extract the mail address from a RCPT To command.
+// RE match to extract the mail address and the parameters from a RCPT To
+// command.
 var rcpt_re *regexp.Regexp = regexp.MustCompile(
-	"^[Tt][Oo]:\\s*(?:<" + email_re + ">|" + email_re + ")$")
+	"^[Tt][Oo]:\\s*(?:<" + email_re + ">|" + email_re +
+		")((?:\\s+\\S+)*)\\s*$")
+
+// Conditions which may be given in the NOTIFY parameter of RCPT.
+var notify_conditions = map[string]mailpump.DsnRecipientParameters_Notify{
+	"NEVER":   mailpump.DsnRecipientParameters_NEVER,
+	"SUCCESS": mailpump.DsnRecipientParameters_SUCCESS,
+	"FAILURE": mailpump.DsnRecipientParameters_FAILURE,
+	"DELAY":   mailpump.DsnRecipientParameters_DELAY,
+}
 
-func getConnectionData(conn *smtpump.SmtpConnection) *mailpump.MailMessage {
-	var msg *mailpump.MailMessage
-	var val reflect.Value
+// Everything we know about an SMTP connection.
+type connectionState struct {
+	// The message currently being transmitted, including the information
+	// about the peer.
+	msg *mailpump.MailMessage
+
+	// Verdicts about the peer which apply to all messages transmitted
+	// over the connection.
+	peerVerdicts []*mailpump.QualityVerdict
+
+	// Verdicts about the most recent HELO name of the peer.
+	heloVerdicts []*mailpump.QualityVerdict
+
+	// Reverse DNS names of the peer which resolve back to it.
+	confirmedNames []string
+
+	// Set if the peer is listed on a DNS allowlist.
+	allowlisted bool
+
+	// Identity the client has authenticated as, if any.
+	authenticatedUser string
+}
+
+// Retrieve the state of the connection "conn", creating it if required.
+func getConnectionState(conn *smtpump.SmtpConnection) *connectionState {
+	var state *connectionState
 	var ud interface{}
 	var ok bool
 
 	ud = conn.GetUserdata()
-	val = reflect.ValueOf(ud)
-	if !val.IsValid() || val.IsNil() {
-		msg = new(mailpump.MailMessage)
-		conn.SetUserdata(msg)
-		return msg
+	if ud == nil {
+		state = &connectionState{
+			msg: new(mailpump.MailMessage),
+		}
+		conn.SetUserdata(state)
+		return state
 	}
 
-	msg, ok = ud.(*mailpump.MailMessage)
+	state, ok = ud.(*connectionState)
 	if !ok {
-		log.Print("Connection userdata is not a MailMessage!")
+		log.Print("Connection userdata is not a connectionState!")
 		return nil
 	}
 
-	if msg == nil {
-		msg = new(mailpump.MailMessage)
-		conn.SetUserdata(msg)
-	}
-
-	return msg
+	return state
 }
 
-// Establish a connection to the mailstream backend.
-func (self *smtpCallback) GetMailstreamBackend() (*net.Conn, error) {
-	var conn *net.Conn = new(net.Conn)
-	var err error
-
-	*conn, err = urlconnection.ConnectTimeout(
-		self.mailstreamUri, time.Second)
-	if err != nil {
-		return nil, errors.New("Unable to connect to mailstream on " +
-			self.mailstreamUri + ": " + err.Error())
-	}
+// Retrieve the message currently being transmitted over "conn".
+func getConnectionData(conn *smtpump.SmtpConnection) *mailpump.MailMessage {
+	var state *connectionState = getConnectionState(conn)
 
-	if self.tlsConfig != nil {
-		*conn = tls.Client(*conn, self.tlsConfig)
+	if state == nil {
+		return nil
 	}
-
-	return conn, nil
+	return state.msg
 }
 
 // Store all available information about the peer in the message structure
@@ -125,6 +152,8 @@ func (self smtpCallback) ConnectionOpened(
 	ret smtpump.SmtpReturnCode) {
 	var host string
 	var msg *mailpump.MailMessage = getConnectionData(conn)
+	var ip net.IP
+	var submission bool
 	var err error
 
 	if msg == nil {
@@ -134,6 +163,13 @@ func (self smtpCallback) ConnectionOpened(
 		return
 	}
 
+	// Local injection via unix sockets has no IP address to speak of.
+	if peer.Network() == "unix" || peer.Network() == "unixpacket" {
+		host = "unix:" + conn.LocalAddr().String()
+		msg.SmtpPeer = &host
+		return
+	}
+
 	host, _, err = net.SplitHostPort(peer.String())
 	if err == nil {
 		msg.SmtpPeer = &host
@@ -141,7 +177,84 @@ func (self smtpCallback) ConnectionOpened(
 		host = peer.String()
 		msg.SmtpPeer = &host
 	}
-	msg.SmtpPeerRevdns, _ = net.LookupAddr(host)
+	ip = net.ParseIP(host)
+	// Users of submission listeners often connect from dynamic addresses,
+	// so the checks only yield verdicts until they authenticate.
+	submission = self.submission.IsSubmission(conn)
+	if self.dnsLists != nil && ip != nil {
+		ret = self.checkDNSLists(getConnectionState(conn), ip, submission)
+		if ret.Code != 0 {
+			return
+		}
+	}
+
+	if ip != nil {
+		ret = self.checkFCrDNS(getConnectionState(conn), ip, submission)
+	}
+	if len(msg.SmtpPeerRevdns) > 0 {
+		conn.SetPeerName(msg.SmtpPeerRevdns[0])
+	}
+	return
+}
+
+// Look up the reverse DNS names of the peer and check whether they
+// resolve back to it. If "exempt" is set, the peer is never rejected.
+func (self smtpCallback) checkFCrDNS(state *connectionState, ip net.IP,
+	exempt bool) (ret smtpump.SmtpReturnCode) {
+	var res FCrDNSResult = self.peerChecks.LookupFCrDNS(ip)
+	var verdict *mailpump.QualityVerdict
+
+	state.msg.SmtpPeerRevdns = res.Names
+	state.confirmedNames = res.Confirmed
+
+	verdict, ret = self.peerChecks.CheckFCrDNS(ip, res,
+		state.allowlisted || exempt)
+	if verdict != nil {
+		state.peerVerdicts = append(state.peerVerdicts, verdict)
+		state.msg.Verdicts = append(state.msg.Verdicts, verdict)
+	}
+	return
+}
+
+// Look the peer up in the configured DNS lists and record the results
+// as verdicts about the peer. If "exempt" is set, the peer is never
+// rejected.
+func (self smtpCallback) checkDNSLists(state *connectionState, ip net.IP,
+	exempt bool) (ret smtpump.SmtpReturnCode) {
+	var hit, rejected DNSListHit
+	var verdict *mailpump.QualityVerdict
+	var reject bool
+
+	for _, hit = range self.dnsLists.Check(ip) {
+		var reason string = ip.String() + " is listed in " + hit.Zone +
+			" (" + hit.Code + ")"
+
+		switch hit.Action {
+		case DNSL_ALLOW:
+			state.allowlisted = true
+			verdict = mailpump.NewVerdict("DNSL", mailpump.QualityVerdict_OK,
+				reason)
+		case DNSL_SCORE:
+			verdict = mailpump.NewVerdict("DNSL",
+				mailpump.QualityVerdict_SPAM, reason)
+			verdict.Score = new(float64)
+			*verdict.Score = hit.Score
+		case DNSL_REJECT:
+			verdict = mailpump.NewVerdict("DNSL",
+				mailpump.QualityVerdict_SPAM, reason)
+			rejected = hit
+			reject = true
+		}
+		state.peerVerdicts = append(state.peerVerdicts, verdict)
+		state.msg.Verdicts = append(state.msg.Verdicts, verdict)
+	}
+
+	if reject && !state.allowlisted && !exempt {
+		ret.Code = smtpump.SMTP_TRANSACTION_FAILED
+		ret.Message = "Service unavailable; client [" + ip.String() +
+			"] blocked using " + rejected.Zone
+		ret.Terminate = true
+	}
 	return
 }
 
@@ -153,19 +266,55 @@ func (self smtpCallback) ConnectionClosed(conn *smtpump.SmtpConnection) {
 func (self smtpCallback) Helo(
 	conn *smtpump.SmtpConnection, hostname string, esmtp bool) (
 	ret smtpump.SmtpReturnCode) {
-	var msg *mailpump.MailMessage = getConnectionData(conn)
+	var state *connectionState = getConnectionState(conn)
+	var msg *mailpump.MailMessage
 	var response string = fmt.Sprintf("Hello, %s! Nice to meet you.",
 		hostname)
+	var peer net.IP = net.ParseIP(state.msg.GetSmtpPeer())
+
+	// Local injection via unix sockets has no names to check.
+	if peer != nil {
+		var local net.IP
+		var verdicts []*mailpump.QualityVerdict
+		var host string
+		var err error
+
+		host, _, err = net.SplitHostPort(conn.LocalAddr().String())
+		if err == nil {
+			local = net.ParseIP(host)
+		}
+
+		verdicts, ret = self.peerChecks.CheckHelo(hostname, peer, local,
+			state.confirmedNames,
+			state.allowlisted || self.submission.IsSubmission(conn))
+		if ret.Code != 0 {
+			return
+		}
+		state.heloVerdicts = verdicts
+	}
+
+	// A new HELO implies a reset of the current transaction.
+	resetTransaction(state)
+	msg = state.msg
 	msg.SmtpHelo = &hostname
 
 	if esmtp {
+		var capabilities []string = append([]string{}, features...)
 		var pos int
 		var capa string
-		conn.Respond(smtpump.SMTP_COMPLETED, true, response)
 
-		for pos, capa = range features {
+		if conn.CanStartTls() {
+			capabilities = append(capabilities, "STARTTLS")
+		}
+		if self.submission.AuthAllowed(conn) {
+			capabilities = append(capabilities,
+				"AUTH "+strings.Join(smtpump.AuthMechanisms, " "))
+		}
+
+		conn.Respond(smtpump.SMTP_COMPLETED, true, response)
+		for pos, capa = range capabilities {
 			conn.Respond(smtpump.SMTP_COMPLETED,
-				pos < (len(features)-1), capa)
+				pos < (len(capabilities)-1), capa)
 		}
 		return
 	}
@@ -175,13 +324,133 @@ func (self smtpCallback) Helo(
 	return
 }
 
+// Verify the credentials of clients on submission listeners.
+func (self smtpCallback) Auth(conn *smtpump.SmtpConnection, params string) (
+	ret smtpump.SmtpReturnCode) {
+	var state *connectionState = getConnectionState(conn)
+	var user, password, name string
+	var ok bool
+
+	if !self.submission.IsSubmission(conn) {
+		ret.Code = smtpump.SMTP_NOT_IMPLEMENTED
+		ret.Message = "AUTH is not available."
+		return
+	}
+
+	if !self.submission.AuthAllowed(conn) {
+		ret.Code = smtpump.SMTP_ACCESS_DENIED
+		ret.Message = "Must issue a STARTTLS command first."
+		return
+	}
+
+	if state.msg.SmtpHelo == nil {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "Polite people say Hello first!"
+		return
+	}
+
+	if len(state.authenticatedUser) > 0 {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "Already authenticated."
+		return
+	}
+
+	if state.msg.SmtpFrom != nil {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "AUTH not allowed during a mail transaction."
+		return
+	}
+
+	user, password, ret = conn.ReadCredentials(params)
+	if ret.Code != 0 {
+		return
+	}
+
+	if name, ok = self.submission.Authenticate(user, password); !ok {
+		log.Print("Authentication as ", strconv.Quote(user), " from ",
+			state.msg.GetSmtpPeer(), " failed")
+		ret.Code = smtpump.SMTP_BAD_AUTH
+		ret.Message = "Authentication credentials invalid."
+		return
+	}
+
+	state.authenticatedUser = name
+	conn.SetAuthenticatedUser(name)
+	ret.Code = smtpump.SMTP_AUTH_SUCCEEDED
+	ret.Message = "Authentication successful."
+	return
+}
+
+// Forget everything the client told us before switching to TLS, and
+// record the parameters of the encryption.
+func (self smtpCallback) TlsStarted(conn *smtpump.SmtpConnection) {
+	var state *connectionState = getConnectionState(conn)
+	var tlsinfo string = describeTls(conn.Status())
+
+	state.heloVerdicts = nil
+	state.authenticatedUser = ""
+	state.msg.SmtpHelo = nil
+	state.msg.SmtpPeerTlsInfo = &tlsinfo
+	resetTransaction(state)
+}
+
+// Split the ESMTP parameters "params" of MAIL or RCPT into keywords (in
+// upper case) and values. Returns false if they are malformed.
+func parseEsmtpParameters(params string) (map[string]string, bool) {
+	var ret = make(map[string]string)
+	var field string
+
+	for _, field = range strings.Fields(params) {
+		var kv []string = strings.SplitN(field, "=", 2)
+		var key string = strings.ToUpper(kv[0])
+
+		if _, ok := ret[key]; ok || len(key) == 0 {
+			return nil, false
+		}
+		if len(kv) > 1 {
+			ret[key] = kv[1]
+		} else {
+			ret[key] = ""
+		}
+	}
+	return ret, true
+}
+
+// Parse the value of the NOTIFY parameter of RCPT (RFC 3461, section
+// 4.1). Returns false if it is invalid.
+func parseNotify(value string) (
+	ret []mailpump.DsnRecipientParameters_Notify, ok bool) {
+	var cond mailpump.DsnRecipientParameters_Notify
+	var name string
+
+	for _, name = range strings.Split(strings.ToUpper(value), ",") {
+		if cond, ok = notify_conditions[name]; !ok {
+			return nil, false
+		}
+		ret = append(ret, cond)
+	}
+
+	// NEVER can't be combined with anything else.
+	for _, cond = range ret {
+		if cond == mailpump.DsnRecipientParameters_NEVER && len(ret) > 1 {
+			return nil, false
+		}
+	}
+	return ret, true
+}
+
 // Ensure HELO has been set, then record From.
 func (self smtpCallback) MailFrom(
 	conn *smtpump.SmtpConnection, sender string) (
 	ret smtpump.SmtpReturnCode) {
-	var msg *mailpump.MailMessage = getConnectionData(conn)
+	var state *connectionState = getConnectionState(conn)
+	var msg *mailpump.MailMessage = state.msg
 	var matches []string
-	var addr string
+	var params map[string]string
+	var key, value string
+	var realaddr, envid string
+	var dsnRet *mailpump.MailMessage_DsnReturn
+	var ok bool
 
 	if msg.SmtpHelo == nil {
 		ret.Code = smtpump.SMTP_BAD_SEQUENCE
@@ -189,6 +458,12 @@ func (self smtpCallback) MailFrom(
 		return
 	}
 
+	if msg.SmtpFrom != nil {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "Sender already specified."
+		return
+	}
+
 	matches = from_re.FindStringSubmatch(sender)
 	if len(matches) == 0 {
 		if len(sender) > 0 {
@@ -199,12 +474,107 @@ func (self smtpCallback) MailFrom(
 		return
 	}
 
-	for _, addr = range matches {
-		if len(addr) > 0 {
-			msg.SmtpFrom = new(string)
-			*msg.SmtpFrom = addr
+	realaddr = matches[1] + matches[2]
+	if params, ok = parseEsmtpParameters(matches[3]); !ok {
+		ret.Code = smtpump.SMTP_PARAMETER_ERROR
+		ret.Message = "Malformed parameters."
+		return
+	}
+
+	for key, value = range params {
+		var err error
+
+		switch key {
+		case "BODY":
+			if !strings.EqualFold(value, "7BIT") &&
+				!strings.EqualFold(value, "8BITMIME") {
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid BODY parameter."
+				return
+			}
+		case "RET":
+			var r mailpump.MailMessage_DsnReturn
+
+			switch strings.ToUpper(value) {
+			case "FULL":
+				r = mailpump.MailMessage_FULL
+			case "HDRS":
+				r = mailpump.MailMessage_HDRS
+			default:
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid RET parameter."
+				return
+			}
+			dsnRet = &r
+		case "ENVID":
+			envid, err = smtpump.DecodeXtext(value)
+			if err != nil || len(value) == 0 || len(value) > 100 {
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid ENVID parameter."
+				return
+			}
+		case "AUTH":
+			// The identity which originally submitted the message
+			// (RFC 4954, section 5). We don't trust other servers to
+			// vouch for it, so it's only checked for validity.
+			if _, err = smtpump.DecodeXtext(value); err != nil ||
+				len(value) == 0 {
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid AUTH parameter."
+				return
+			}
+		default:
+			ret.Code = smtpump.SMTP_PARAMETERS_UNKNOWN
+			ret.Message = "Parameter " + key + " not recognized."
+			return
 		}
 	}
+
+	if self.submission.IsSubmission(conn) {
+		ret = self.submission.CheckSender(state.authenticatedUser,
+			realaddr)
+		if ret.Code != 0 {
+			return
+		}
+	}
+
+	if self.checkSenders {
+		var req mailpump.SenderCheckRequest
+		var resp mailpump.MailSubmissionResult
+		var err error
+
+		req.SmtpPeer = msg.SmtpPeer
+		req.SmtpHelo = msg.SmtpHelo
+		req.SmtpFrom = &realaddr
+		if len(state.authenticatedUser) > 0 {
+			req.AuthenticatedUser = &state.authenticatedUser
+		}
+		err = self.mailstream.Call("MailSubmissionService.CheckSender",
+			req, &resp)
+		if err == ErrNoMailstreamBackends && self.spool != nil {
+			// The spool is there to take mail while mailstream is
+			// down, so accept the sender unchecked.
+			log.Print("Unable to check sender ", realaddr, ", accepting ",
+				"it for the spool: ", err)
+		} else if err != nil {
+			log.Print("Error checking sender ", realaddr, ": ", err)
+			ret.Code = smtpump.SMTP_LOCALERR
+			ret.Message = "Unable to verify sender, try again later."
+			return
+		}
+		if resp.GetErrorCode() >= 400 {
+			ret.Code = int(resp.GetErrorCode())
+			ret.Message = resp.GetErrorText()
+			return
+		}
+		msg.Verdicts = append(msg.Verdicts, resp.Verdicts...)
+	}
+
+	msg.SmtpFrom = &realaddr
+	msg.DsnRet = dsnRet
+	if len(envid) > 0 {
+		msg.DsnEnvid = &envid
+	}
 	ret.Code = smtpump.SMTP_COMPLETED
 	ret.Message = "Ok."
 	return
@@ -214,10 +584,14 @@ func (self smtpCallback) MailFrom(
 func (self smtpCallback) RcptTo(
 	conn *smtpump.SmtpConnection, recipient string) (
 	ret smtpump.SmtpReturnCode) {
-	var msg *mailpump.MailMessage = getConnectionData(conn)
+	var state *connectionState = getConnectionState(conn)
+	var msg *mailpump.MailMessage = state.msg
+	var dsn = new(mailpump.DsnRecipientParameters)
 	var matches []string
-	var addr string
+	var params map[string]string
+	var key, value string
 	var realaddr string
+	var ok bool
 
 	if msg.SmtpHelo == nil {
 		ret.Code = smtpump.SMTP_BAD_SEQUENCE
@@ -241,30 +615,111 @@ func (self smtpCallback) RcptTo(
 		return
 	}
 
-	for _, addr = range matches {
-		if len(addr) > 0 {
-			realaddr = addr
+	realaddr = matches[1] + matches[2]
+	if params, ok = parseEsmtpParameters(matches[3]); !ok {
+		ret.Code = smtpump.SMTP_PARAMETER_ERROR
+		ret.Message = "Malformed parameters."
+		return
+	}
+
+	for key, value = range params {
+		switch key {
+		case "NOTIFY":
+			if dsn.Notify, ok = parseNotify(value); !ok {
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid NOTIFY parameter."
+				return
+			}
+		case "ORCPT":
+			var orcpt string
+			var err error
+
+			orcpt, err = smtpump.DecodeXtext(value)
+			if err != nil || !strings.Contains(orcpt, ";") {
+				ret.Code = smtpump.SMTP_PARAMETER_ERROR
+				ret.Message = "Invalid ORCPT parameter."
+				return
+			}
+			dsn.OriginalRecipient = &orcpt
+		default:
+			ret.Code = smtpump.SMTP_PARAMETERS_UNKNOWN
+			ret.Message = "Parameter " + key + " not recognized."
+			return
+		}
+	}
+
+	// Mail submitted by our own users is relayed to wherever it's
+	// addressed to.
+	if self.validateRecipients && len(state.authenticatedUser) == 0 {
+		var req mailpump.RecipientValidationRequest
+		var resp mailpump.MailSubmissionResult
+		var err error
+
+		req.Recipient = &realaddr
+		req.SmtpPeer = msg.SmtpPeer
+		req.SmtpFrom = msg.SmtpFrom
+		err = self.mailstream.Call("MailSubmissionService.ValidateRecipient",
+			req, &resp)
+		if err == ErrNoMailstreamBackends && self.spool != nil {
+			// The mail will be spooled, and returned to the sender if
+			// mailstream doesn't know the recipient.
+			log.Print("Unable to validate recipient ", realaddr,
+				", accepting it for the spool: ", err)
+		} else if err != nil {
+			log.Print("Error validating recipient ", realaddr, ": ", err)
+			ret.Code = smtpump.SMTP_LOCALERR
+			ret.Message = "Unable to verify recipient, try again later."
+			return
+		}
+		if resp.GetErrorCode() >= 400 {
+			ret.Code = int(resp.GetErrorCode())
+			ret.Message = resp.GetErrorText()
+			return
+		}
+	}
+
+	if self.greylister != nil {
+		var ip net.IP = net.ParseIP(msg.GetSmtpPeer())
+		var wait time.Duration
+		var pass bool
+
+		if ip != nil && !state.allowlisted &&
+			len(state.authenticatedUser) == 0 {
+			pass, wait = self.greylister.Check(ip, msg.GetSmtpFrom(),
+				realaddr)
+			if !pass {
+				ret.Code = smtpump.SMTP_MAILBOX_UNAVAIL
+				ret.Message = fmt.Sprintf("Greylisted, please try again "+
+					"in %d seconds.", int(wait.Seconds()+0.5))
+				return
+			}
 		}
 	}
+
 	msg.SmtpTo = append(msg.SmtpTo, realaddr)
+	if len(dsn.Notify) > 0 || dsn.OriginalRecipient != nil {
+		dsn.Recipient = &realaddr
+		msg.DsnRecipients = append(msg.DsnRecipients, dsn)
+	}
 	ret.Code = smtpump.SMTP_COMPLETED
 	ret.Message = "Ok."
 	return
 }
 
 // Read the data following the DATA command, up to the configured limit.
+// The mail transaction is over afterwards, no matter what the outcome.
 func (self smtpCallback) Data(conn *smtpump.SmtpConnection) (
 	ret smtpump.SmtpReturnCode) {
-	var cli *rpc.Client
-	var msg *mailpump.MailMessage = getConnectionData(conn)
+	var state *connectionState = getConnectionState(conn)
+	var msg *mailpump.MailMessage = state.msg
 	var resp *mailpump.MailSubmissionResult
 	var hdr string
-	var vals []string
+	var raw []byte
+	var offset int
 	var addrs []*mail.Address
 	var addr *mail.Address
 	var dotreader io.Reader
 	var contentsreader *io.LimitedReader
-	var mailstream_conn *net.Conn
 	var message *mail.Message
 	var tm time.Time
 	var err error
@@ -288,18 +743,21 @@ func (self smtpCallback) Data(conn *smtpump.SmtpConnection) (
 	}
 
 	conn.Respond(smtpump.SMTP_PROCEED, false, "Proceed with message.")
+	defer resetTransaction(state)
 
-	dotreader = conn.GetDotReader()
+	// Keep the message exactly as it was sent so spamd, signature checks
+	// and the final delivery all see the same bytes.
+	dotreader = conn.GetRawDotReader()
 	contentsreader = &io.LimitedReader{
 		R: dotreader,
 		N: self.maxContentLength + 1,
 	}
-	message, err = mail.ReadMessage(contentsreader)
+	raw, err = ioutil.ReadAll(contentsreader)
+	conn.ReportBytesRead(int64(len(raw)))
 	if err != nil {
 		ret.Code = smtpump.SMTP_LOCALERR
 		ret.Message = "Unable to read message: " + err.Error()
-		// Consume all remaining output before returning an error.
-		ioutil.ReadAll(dotreader)
+		ret.Terminate = true
 		return
 	}
 
@@ -311,22 +769,33 @@ func (self smtpCallback) Data(conn *smtpump.SmtpConnection) (
 		return
 	}
 
-	msg.Body, err = ioutil.ReadAll(message.Body)
+	if len(state.authenticatedUser) > 0 {
+		raw = self.submission.AddMissingHeaders(raw)
+	}
+
+	message, err = mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
 		ret.Code = smtpump.SMTP_LOCALERR
-		ret.Message = "Unable to parse message: " + err.Error()
+		ret.Message = "Unable to read message: " + err.Error()
 		return
 	}
 
-	for hdr, vals = range message.Header {
-		var header = new(mailpump.MailMessage_MailHeader)
-		header.Name = new(string)
-		*header.Name = hdr
-		header.Value = make([]string, len(vals))
-		copy(header.Value, vals)
-		msg.Headers = append(msg.Headers, header)
+	if len(state.authenticatedUser) > 0 {
+		var user string = state.authenticatedUser
+
+		ret = self.submission.CheckAuthorHeaders(user, message.Header)
+		if ret.Code != 0 {
+			return
+		}
+		msg.AuthenticatedUser = &user
 	}
 
+	msg.RawMessage = raw
+	msg.Headers, offset = mailpump.SplitHeaders(raw)
+	msg.BodyOffset = new(int64)
+	*msg.BodyOffset = int64(offset)
+	msg.MimeStructure = mailpump.ParseMimeStructure(raw, self.mimeLimits)
+
 	tm, err = message.Header.Date()
 	if err == nil {
 		msg.DateHdr = new(int64)
@@ -364,38 +833,91 @@ func (self smtpCallback) Data(conn *smtpump.SmtpConnection) (
 		*msg.MsgidHdr = hdr
 	}
 
-	mailstream_conn, err = self.GetMailstreamBackend()
-	if err != nil {
-		ret.Code = smtpump.SMTP_LOCALERR
-		ret.Message = "Error connecting to mailstream: " + err.Error()
-	}
-	cli = rpc.NewClient(*mailstream_conn)
-	err = cli.Call("MailSubmissionService.Send", *msg, &resp)
-	if err != nil {
+	resp, err = self.mailstream.Send(msg)
+	if err == ErrNoMailstreamBackends && self.spool != nil {
+		err = self.spool.Store(msg)
+		if err != nil {
+			log.Print("Error spooling mail: ", err)
+			ret.Code = smtpump.SMTP_LOCALERR
+			ret.Message = "Unable to queue mail, try again later."
+		} else {
+			ret.Code = smtpump.SMTP_COMPLETED
+			ret.Message = "Queued for delivery."
+		}
+	} else if err == ErrNoMailstreamBackends {
+		// 421 means the connection is closed (RFC 5321, section 3.8).
+		ret.Code = smtpump.SMTP_UNAVAIL
+		ret.Message = "Service temporarily unavailable, try again later."
+		ret.Terminate = true
+	} else if err != nil {
 		ret.Code = smtpump.SMTP_LOCALERR
 		ret.Message = "Error talking to mailstream: " + err.Error()
 	} else {
 		ret.Code = int(resp.GetErrorCode())
 		ret.Message = resp.GetErrorText()
 	}
-	// TODO(caoimhe): Reuse the connections somewhat, as reestablishing
-	// them is expensive.
-	(*mailstream_conn).Close()
 	return
 }
 
-// FIXME: STUB.
+// Ask mailstream to start delivering the mail queued for "domain".
 func (self smtpCallback) Etrn(conn *smtpump.SmtpConnection, domain string) (
 	ret smtpump.SmtpReturnCode) {
-	ret.Code = smtpump.SMTP_NOT_IMPLEMENTED
-	ret.Message = "Not yet implemented."
+	var state *connectionState = getConnectionState(conn)
+	var req mailpump.EtrnRequest
+	var resp *mailpump.MailSubmissionResult
+	var err error
+
+	if state.msg.SmtpHelo == nil {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "Polite people say Hello first!"
+		return
+	}
+
+	// ETRN is not permitted during a mail transaction (RFC 1985,
+	// section 3).
+	if state.msg.SmtpFrom != nil {
+		ret.Code = smtpump.SMTP_BAD_SEQUENCE
+		ret.Message = "ETRN not allowed during a mail transaction."
+		return
+	}
+
+	if len(domain) == 0 || strings.ContainsAny(domain, " \t") {
+		ret.Code = smtpump.SMTP_PARAMETER_ERROR
+		ret.Message = "Syntax Error in Parameters"
+		return
+	}
+
+	req.Node = &domain
+	req.SmtpPeer = state.msg.SmtpPeer
+	if len(state.authenticatedUser) > 0 {
+		req.AuthenticatedUser = &state.authenticatedUser
+	}
+	resp, err = self.mailstream.StartDeliveryRun(&req)
+	if err != nil {
+		log.Print("Error requesting delivery for ", domain, ": ", err)
+		ret.Code = smtpump.SMTP_ETRN_UNABLE_TO_QUEUE
+		ret.Message = "Unable to queue messages for node " + domain
+		return
+	}
+
+	ret.Code = int(resp.GetErrorCode())
+	ret.Message = resp.GetErrorText()
 	return
 }
 
 // Forget all connection related data except HELO and the peer information.
 func (self smtpCallback) Reset(conn *smtpump.SmtpConnection) (
 	ret smtpump.SmtpReturnCode) {
-	var msg = getConnectionData(conn)
+	resetTransaction(getConnectionState(conn))
+	ret.Code = smtpump.SMTP_COMPLETED
+	ret.Message = "Ok."
+	return
+}
+
+// Clear all data of the current mail transaction from the message in
+// "state", keeping only HELO and the peer information.
+func resetTransaction(state *connectionState) {
+	var msg *mailpump.MailMessage = state.msg
 	var peer, tlsc, helo string
 	var rdns []string
 	peer = msg.GetSmtpPeer()
@@ -415,9 +937,8 @@ func (self smtpCallback) Reset(conn *smtpump.SmtpConnection) (
 	if len(helo) > 0 {
 		msg.SmtpHelo = &helo
 	}
-	ret.Code = smtpump.SMTP_COMPLETED
-	ret.Message = "Ok."
-	return
+	msg.Verdicts = append(msg.Verdicts, state.peerVerdicts...)
+	msg.Verdicts = append(msg.Verdicts, state.heloVerdicts...)
 }
 
 // Close the connection with a friendly message.
@@ -0,0 +1,300 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Local spool for mails which couldn't be handed to mailstream.
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var spool_stored = expvar.NewInt("spool-messages-stored")
+var spool_store_errors = expvar.NewMap("spool-store-errors")
+var spool_forwarded = expvar.NewInt("spool-messages-forwarded")
+var spool_forward_errors = expvar.NewMap("spool-forward-errors")
+var spool_failed = expvar.NewInt("spool-messages-failed")
+var spool_depth = expvar.NewInt("spool-depth")
+
+// Suffix of completely written spool files.
+const spoolSuffix = ".msg"
+
+// Directory of a spool holding mails which couldn't be forwarded ever.
+const spoolFailedDir = "failed"
+
+// Directory of a spool holding mails which are still being written.
+const spoolTmpDir = "tmp"
+
+// Directory on local disk holding mails which have been accepted while
+// mailstream was unreachable, until they can be forwarded.
+type Spool struct {
+	dir        string
+	mailstream *MailstreamBackends
+	maxAge     time.Duration
+
+	counter uint64
+	mtx     sync.Mutex
+}
+
+// Create a new spool in the directory "dir", forwarding mails to
+// "mailstream". Mails which couldn't be forwarded within "maxAge" are
+// returned to their senders by mailstream once it's reachable again.
+// Mails mailstream refuses to take are moved to the "failed"
+// subdirectory for manual inspection.
+func NewSpool(dir string, mailstream *MailstreamBackends,
+	maxAge time.Duration) (*Spool, error) {
+	var sub string
+	var err error
+
+	for _, sub = range []string{spoolTmpDir, spoolFailedDir} {
+		err = os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Spool{
+		dir:        dir,
+		mailstream: mailstream,
+		maxAge:     maxAge,
+	}, nil
+}
+
+// Write the file "name" with "data" to disk, making sure it's fully on
+// disk before returning.
+func writeFileSync(name string, data []byte) error {
+	var f *os.File
+	var err error
+
+	f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	return f.Close()
+}
+
+// Flush the directory entries of "dir" to disk, so renames into it
+// survive a crash.
+func syncDir(dir string) error {
+	var f *os.File
+	var err error
+
+	f, err = os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Write "msg" to the spool. It is only considered spooled if no error
+// is returned.
+func (self *Spool) Store(msg *mailpump.MailMessage) error {
+	var data []byte
+	var name, tmpname string
+	var err error
+
+	data, err = proto.Marshal(msg)
+	if err != nil {
+		spool_store_errors.Add(err.Error(), 1)
+		return err
+	}
+
+	name = strconv.FormatInt(time.Now().UnixNano(), 10) + "." +
+		strconv.Itoa(os.Getpid()) + "." +
+		strconv.FormatUint(atomic.AddUint64(&self.counter, 1), 10) +
+		spoolSuffix
+	tmpname = filepath.Join(self.dir, spoolTmpDir, name)
+
+	err = writeFileSync(tmpname, data)
+	if err == nil {
+		err = os.Rename(tmpname, filepath.Join(self.dir, name))
+	}
+	if err == nil {
+		err = syncDir(self.dir)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		spool_store_errors.Add(err.Error(), 1)
+		return err
+	}
+
+	spool_stored.Add(1)
+	spool_depth.Add(1)
+	return nil
+}
+
+// Move the spool file "name" aside into the failed directory.
+func (self *Spool) fail(name, reason string) {
+	var err error
+
+	log.Print("Giving up on spooled mail ", name, ": ", reason)
+	err = os.Rename(filepath.Join(self.dir, name),
+		filepath.Join(self.dir, spoolFailedDir, name))
+	if err != nil {
+		log.Print("Error moving ", name, " to ", spoolFailedDir, ": ", err)
+		return
+	}
+	spool_failed.Add(1)
+	spool_depth.Add(-1)
+}
+
+// Try to forward the spool file "name" to mailstream. Returns an error
+// if it should be retried later.
+func (self *Spool) forwardOne(name string) error {
+	var msg = new(mailpump.MailMessage)
+	var resp *mailpump.MailSubmissionResult
+	var fi os.FileInfo
+	var data []byte
+	var accepted, final bool = true, false
+	var acceptedAt int64
+	var err error
+
+	fi, err = os.Stat(filepath.Join(self.dir, name))
+	if err != nil {
+		return err
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(self.dir, name))
+	if err != nil {
+		return err
+	}
+	if err = proto.Unmarshal(data, msg); err != nil {
+		self.fail(name, "unparseable: "+err.Error())
+		return nil
+	}
+
+	// The client has been told that the mail was accepted, so mailstream
+	// has to return it to the sender rather than reject it. Once it's
+	// too old, temporary failures are returned as well.
+	acceptedAt = fi.ModTime().Unix()
+	final = time.Now().Sub(fi.ModTime()) > self.maxAge
+	msg.AlreadyAccepted = &accepted
+	msg.AcceptedAt = &acceptedAt
+	msg.FinalAttempt = &final
+
+	resp, err = self.mailstream.Send(msg)
+	if err == nil && resp.GetErrorCode() >= 500 {
+		// Only happens for mail which must not be returned, like SPAM.
+		self.fail(name, "rejected by mailstream: "+resp.GetErrorText())
+		return nil
+	}
+	if err == nil && resp.GetErrorCode() >= 400 {
+		err = errors.New(resp.GetErrorText())
+	}
+	if err != nil {
+		if final {
+			log.Print("Spooled mail ", name, " couldn't be forwarded for ",
+				self.maxAge, ", will be returned to the sender once ",
+				"mailstream is reachable: ", err)
+		}
+		return err
+	}
+
+	if err = os.Remove(filepath.Join(self.dir, name)); err != nil {
+		log.Print("Error removing forwarded mail ", name, ": ", err)
+	}
+	spool_forwarded.Add(1)
+	spool_depth.Add(-1)
+	return nil
+}
+
+// Try to forward all spooled mails to mailstream. Mails are forwarded
+// in the order they were received; if mailstream is still unreachable,
+// the run is aborted.
+func (self *Spool) Forward() {
+	var entries []os.FileInfo
+	var fi os.FileInfo
+	var depth int64
+	var err error
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+
+	entries, err = ioutil.ReadDir(self.dir)
+	if err != nil {
+		log.Print("Error reading spool directory ", self.dir, ": ", err)
+		return
+	}
+	for _, fi = range entries {
+		if fi.Mode().IsRegular() &&
+			strings.HasSuffix(fi.Name(), spoolSuffix) {
+			depth++
+		}
+	}
+	spool_depth.Set(depth)
+
+	for _, fi = range entries {
+		if !fi.Mode().IsRegular() ||
+			!strings.HasSuffix(fi.Name(), spoolSuffix) {
+			continue
+		}
+
+		err = self.forwardOne(fi.Name())
+		if err == ErrNoMailstreamBackends {
+			spool_forward_errors.Add(err.Error(), 1)
+			return
+		} else if err != nil {
+			spool_forward_errors.Add(err.Error(), 1)
+			log.Print("Error forwarding spooled mail ", fi.Name(), ": ",
+				err)
+		}
+	}
+}
+
+// Try to forward the spooled mails every "interval". This will block
+// forever, so run it in a goroutine.
+func (self *Spool) ForwardPeriodically(interval time.Duration) {
+	self.Forward()
+	for range time.Tick(interval) {
+		self.Forward()
+	}
+}
@@ -0,0 +1,263 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Message submission profile (RFC 6409).
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/mailpump"
+	"ancient-solutions.com/mailpump/smtpump"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var submission_auth_results = expvar.NewMap("submission-auth-results")
+var submission_rejections = expvar.NewMap("submission-rejections")
+var submission_header_fixups = expvar.NewMap("submission-header-fixups")
+
+// Hash to compare passwords of unknown users against, so they take as
+// long to be refused as wrong passwords.
+var dummy_password_hash = []byte(
+	"$2a$10$PW6GRXJCwy0eDb/rXaHvD.px3EUaZDdyN.0/8z0Xam25Uu.j5GO52")
+
+// Rules for the listeners which accept mail submissions from our own
+// users rather than mail from other MTAs.
+type SubmissionPolicy struct {
+	config   *mailpump.SubmissionConfiguration
+	policies map[string]bool
+	users    map[string]*mailpump.SubmissionUser
+	domain   string
+}
+
+// Create a new submission policy configured by "config".
+func NewSubmissionPolicy(
+	config *mailpump.SubmissionConfiguration) *SubmissionPolicy {
+	var ret = &SubmissionPolicy{
+		config:   config,
+		policies: make(map[string]bool),
+		users:    make(map[string]*mailpump.SubmissionUser),
+		domain:   config.GetMessageIdDomain(),
+	}
+	var user *mailpump.SubmissionUser
+	var policy string
+	var err error
+
+	for _, policy = range config.GetPolicies() {
+		ret.policies[policy] = true
+	}
+	if len(ret.policies) == 0 {
+		ret.policies["submission"] = true
+	}
+
+	for _, user = range config.GetUsers() {
+		ret.users[strings.ToLower(user.GetName())] = user
+	}
+
+	if len(ret.domain) == 0 {
+		if ret.domain, err = os.Hostname(); err != nil {
+			ret.domain = "localhost"
+		}
+	}
+
+	return ret
+}
+
+// Determine whether "conn" was accepted on a submission listener.
+func (self *SubmissionPolicy) IsSubmission(
+	conn *smtpump.SmtpConnection) bool {
+	return self.policies[conn.GetPolicy()]
+}
+
+// Determine whether the client on "conn" may authenticate.
+func (self *SubmissionPolicy) AuthAllowed(
+	conn *smtpump.SmtpConnection) bool {
+	return self.IsSubmission(conn) &&
+		(conn.IsTls() || self.config.GetAllowInsecureAuth())
+}
+
+// Verify the password "password" of the user "name". Returns the name
+// of the user as configured if it is correct.
+func (self *SubmissionPolicy) Authenticate(name, password string) (
+	string, bool) {
+	var user *mailpump.SubmissionUser = self.users[strings.ToLower(name)]
+	var err error
+
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummy_password_hash, []byte(password))
+		submission_auth_results.Add("unknown-user", 1)
+		return "", false
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.GetPasswordHash()),
+		[]byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		submission_auth_results.Add("wrong-password", 1)
+		return "", false
+	} else if err != nil {
+		log.Print("Unusable password hash for user ", user.GetName(), ": ",
+			err)
+		submission_auth_results.Add("bad-hash", 1)
+		return "", false
+	}
+
+	submission_auth_results.Add("success", 1)
+	return user.GetName(), true
+}
+
+// Determine whether the user "name" may send mail as "addr".
+func (self *SubmissionPolicy) AddressAllowed(name, addr string) bool {
+	var user *mailpump.SubmissionUser = self.users[strings.ToLower(name)]
+	var pattern string
+
+	if user == nil {
+		return false
+	}
+
+	addr = strings.ToLower(addr)
+	if len(user.Addresses) == 0 {
+		return addr == strings.ToLower(user.GetName())
+	}
+	for _, pattern = range user.Addresses {
+		pattern = strings.ToLower(pattern)
+		if addr == pattern {
+			return true
+		}
+		if strings.HasPrefix(pattern, "@") &&
+			strings.HasSuffix(addr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the authenticated user "user" may use "sender" as the
+// envelope sender of a submission.
+func (self *SubmissionPolicy) CheckSender(user, sender string) (
+	ret smtpump.SmtpReturnCode) {
+	if len(user) == 0 {
+		submission_rejections.Add("unauthenticated", 1)
+		ret.Code = smtpump.SMTP_ACCESS_DENIED
+		ret.Message = "Authentication required."
+		return
+	}
+	if !self.AddressAllowed(user, sender) {
+		submission_rejections.Add("envelope-sender", 1)
+		ret.Code = smtpump.SMTP_ILLEGAL_MAILBOX_NAME
+		ret.Message = "Sender address " + sender + " not allowed for " +
+			user + "."
+	}
+	return
+}
+
+// Check whether the authenticated user "user" may use all of the
+// addresses in the From: and Sender: headers of "header".
+func (self *SubmissionPolicy) CheckAuthorHeaders(user string,
+	header mail.Header) (ret smtpump.SmtpReturnCode) {
+	var addrs []*mail.Address
+	var addr *mail.Address
+	var name string
+	var err error
+
+	addrs, err = header.AddressList("From")
+	if err != nil || len(addrs) == 0 {
+		submission_rejections.Add("from-header", 1)
+		ret.Code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+		ret.Message = "Message lacks a valid From: header."
+		return
+	}
+
+	for _, name = range []string{"From", "Sender"} {
+		addrs, _ = header.AddressList(name)
+		for _, addr = range addrs {
+			if !self.AddressAllowed(user, addr.Address) {
+				submission_rejections.Add("from-header", 1)
+				ret.Code = smtpump.SMTP_NO_ACTION_MAILBOX_UNAVAIl
+				ret.Message = name + ": address " + addr.Address +
+					" not allowed for " + user + "."
+				return
+			}
+		}
+	}
+	return
+}
+
+// Determine whether there is a header named "name" among "headers".
+func hasHeader(headers []*mailpump.MailMessage_MailHeader,
+	name string) bool {
+	var hdr *mailpump.MailMessage_MailHeader
+
+	for _, hdr = range headers {
+		if strings.EqualFold(hdr.GetName(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate a new, unique Message-ID.
+func (self *SubmissionPolicy) newMessageId() string {
+	var id [16]byte
+
+	rand.Read(id[:])
+	return "<" + hex.EncodeToString(id[:]) + "@" + self.domain + ">"
+}
+
+// Add the Date: and Message-ID: headers to the raw message "raw" if it
+// doesn't have them yet (RFC 6409, section 8).
+func (self *SubmissionPolicy) AddMissingHeaders(raw []byte) []byte {
+	var headers []*mailpump.MailMessage_MailHeader
+	var added bytes.Buffer
+
+	headers, _ = mailpump.SplitHeaders(raw)
+	if !hasHeader(headers, "Date") {
+		submission_header_fixups.Add("date", 1)
+		added.WriteString("Date: " + time.Now().Format(time.RFC1123Z) +
+			"\r\n")
+	}
+	if !hasHeader(headers, "Message-ID") {
+		submission_header_fixups.Add("message-id", 1)
+		added.WriteString("Message-ID: " + self.newMessageId() + "\r\n")
+	}
+
+	if added.Len() == 0 {
+		return raw
+	}
+	return append(added.Bytes(), raw...)
+}
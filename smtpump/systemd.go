@@ -0,0 +1,118 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Support for sockets handed to us by systemd socket activation.
+package smtpump
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by the service manager, see
+// sd_listen_fds(3).
+const SD_LISTEN_FDS_START = 3
+
+// A listener inherited from the service manager, along with the name it
+// was given there (FileDescriptorName= in the socket unit).
+type InheritedListener struct {
+	Name     string
+	Listener net.Listener
+}
+
+// Pick up all listening sockets passed to this process through the
+// LISTEN_FDS protocol. If the process was not started through socket
+// activation, an empty list is returned. The environment variables are
+// unset afterwards so they aren't passed on to child processes.
+func GetSystemdListeners() ([]InheritedListener, error) {
+	var ret []InheritedListener
+	var names []string
+	var pid, nfds, i int
+	var err error
+
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if len(os.Getenv("LISTEN_PID")) == 0 {
+		return ret, nil
+	}
+
+	pid, err = strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, errors.New("Unable to parse LISTEN_PID: " + err.Error())
+	}
+	if pid != os.Getpid() {
+		// The sockets were meant for someone else.
+		return ret, nil
+	}
+
+	nfds, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, errors.New("Unable to parse LISTEN_FDS: " + err.Error())
+	}
+
+	if len(os.Getenv("LISTEN_FDNAMES")) > 0 {
+		names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	}
+
+	for i = 0; i < nfds; i++ {
+		var fd int = SD_LISTEN_FDS_START + i
+		var name string = "unknown"
+		var f *os.File
+		var l net.Listener
+
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f = os.NewFile(uintptr(fd), name)
+		l, err = net.FileListener(f)
+		// FileListener duplicates the descriptor, so we can get rid of
+		// the original.
+		f.Close()
+		if err != nil {
+			return nil, errors.New("Inherited file descriptor " +
+				strconv.Itoa(fd) + " (" + name + ") is not a listener: " +
+				err.Error())
+		}
+
+		ret = append(ret, InheritedListener{
+			Name:     name,
+			Listener: l,
+		})
+	}
+
+	return ret, nil
+}
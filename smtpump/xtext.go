@@ -0,0 +1,89 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Encoding of DSN parameters (RFC 3461, section 4).
+package smtpump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Decode the xtext "s", in which "+" followed by two hex digits stands
+// for the character with that code.
+func DecodeXtext(s string) (string, error) {
+	var ret bytes.Buffer
+	var pos int
+
+	for pos = 0; pos < len(s); pos++ {
+		var c byte = s[pos]
+
+		if c == '+' {
+			var code uint64
+			var err error
+
+			if pos+3 > len(s) {
+				return "", errors.New("Truncated xtext escape")
+			}
+			code, err = strconv.ParseUint(s[pos+1:pos+3], 16, 8)
+			if err != nil {
+				return "", errors.New("Invalid xtext escape " +
+					s[pos:pos+3])
+			}
+			ret.WriteByte(byte(code))
+			pos += 2
+		} else if c < '!' || c > '~' || c == '=' {
+			return "", errors.New("Invalid character in xtext")
+		} else {
+			ret.WriteByte(c)
+		}
+	}
+	return ret.String(), nil
+}
+
+// Encode "s" as xtext.
+func EncodeXtext(s string) string {
+	var ret bytes.Buffer
+	var pos int
+
+	for pos = 0; pos < len(s); pos++ {
+		var c byte = s[pos]
+
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&ret, "+%02X", c)
+		} else {
+			ret.WriteByte(c)
+		}
+	}
+	return ret.String()
+}
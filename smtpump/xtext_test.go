@@ -0,0 +1,105 @@
+/**
+ * (c) 2014, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Ancient Solutions. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the  name  of  Ancient Solutions  nor  the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package smtpump
+
+import (
+	"testing"
+)
+
+func TestDecodeXtext(t *testing.T) {
+	var tests = []struct {
+		input, expected string
+		err             bool
+	}{
+		{"", "", false},
+		{"<1234@example.com>", "<1234@example.com>", false},
+		{"a+2Bb+3Dc", "a+b=c", false},
+		{"a+2bb", "a+b", false},
+		{"+20+7F", " \x7f", false},
+		{"a+2", "", true},
+		{"a+", "", true},
+		{"a+ZZb", "", true},
+		{"a b", "", true},
+		{"a=b", "", true},
+		{"\xe4", "", true},
+	}
+	var i int
+
+	for i = range tests {
+		var decoded string
+		var err error
+
+		decoded, err = DecodeXtext(tests[i].input)
+		if tests[i].err {
+			if err == nil {
+				t.Errorf("DecodeXtext(%q) = %q, expected an error",
+					tests[i].input, decoded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("DecodeXtext(%q): %s", tests[i].input, err)
+		} else if decoded != tests[i].expected {
+			t.Errorf("DecodeXtext(%q) = %q, expected %q", tests[i].input,
+				decoded, tests[i].expected)
+		}
+	}
+}
+
+func TestEncodeXtext(t *testing.T) {
+	var tests = []struct {
+		input, expected string
+	}{
+		{"", ""},
+		{"<1234@example.com>", "<1234@example.com>"},
+		{"a+b=c", "a+2Bb+3Dc"},
+		{"rfc822; a b", "rfc822;+20a+20b"},
+		{"\xe4\n", "+E4+0A"},
+	}
+	var i int
+
+	for i = range tests {
+		var encoded string = EncodeXtext(tests[i].input)
+		var decoded string
+		var err error
+
+		if encoded != tests[i].expected {
+			t.Errorf("EncodeXtext(%q) = %q, expected %q", tests[i].input,
+				encoded, tests[i].expected)
+		}
+		if decoded, err = DecodeXtext(encoded); err != nil ||
+			decoded != tests[i].input {
+			t.Errorf("DecodeXtext(EncodeXtext(%q)) = %q, %v",
+				tests[i].input, decoded, err)
+		}
+	}
+}